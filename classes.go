@@ -23,13 +23,23 @@
 package main
 
 import (
-    "log"
+    "strings"
 )
 
 // 1-based, assigned as we read class definitions from the dump
 //
 type ClassId uint32
 
+// Graph edge labels for references from a class object other than its static
+// fields, which are labeled by their index in staticRefs.
+//
+const (
+    SuperLabel uint32 = 1 << 31 + iota
+    LoaderLabel
+    SignersLabel
+    DomainLabel
+)
+
 // One of these per class we find in the heap dump
 //
 type ClassDef struct {
@@ -43,6 +53,12 @@ type ClassDef struct {
     Hid HeapId
     // native id of superclass
     SuperHid HeapId
+    // native id of class loader, or 0 for the bootstrap loader
+    LoaderHid HeapId
+    // object id of same, after heap is post-processed
+    Loader ObjectId
+    // object id of the class object itself
+    Oid ObjectId
     // have we completed post-processing
     cooked bool
     // superclass def, after classdef is cooked
@@ -59,10 +75,18 @@ type ClassDef struct {
     NumBytes uint64
     // heap ids of static referees
     staticRefs []HeapId
+    // names of the static fields holding same
+    staticNames []string
     // size of instance layout, including superclasses; returned by layoutSize()
     span uint32
     // offsets of reference fields, including superclases; returned by refOffsets()
     refs []uint32
+    // the reference fields themselves, parallel to refs; returned by RefFields()
+    refFields []*Field
+    // all fields, including superclasses, in instance dump order; returned by Layout()
+    layout []*Field
+    // offsets of same from the start of the instance data
+    layoutOffsets []uint32
     // can instances of this class be skipped in graph searches
     Skip bool
 }
@@ -91,10 +115,19 @@ type JType struct {
     Class *ClassDef
 }
 
+// Return the Java name of this type, e.g. "int", or "Object" for references.
+//
+func (jtype *JType) Name() string {
+    if jtype.IsObj {
+        return "Object"
+    }
+    return strings.TrimSuffix(Demangle(jtype.ArrayClass), "[]")
+}
+
 // Create a ClassDef given the minimal required information.
 //
 func NewClassDef(heap *Heap, name string, cid ClassId, hid HeapId, superHid HeapId,
-                    fields []*Field, staticRefs []HeapId) *ClassDef {
+                    fields []*Field, staticRefs []HeapId, staticNames []string) *ClassDef {
     isRoot := name == "java.lang.Object"
     return &ClassDef{
         Heap: heap,
@@ -109,6 +142,7 @@ func NewClassDef(heap *Heap, name string, cid ClassId, hid HeapId, superHid Heap
         NumInstances: 0,
         NumBytes: 0,
         staticRefs: staticRefs,
+        staticNames: staticNames,
         span: 0,
         refs: nil,
         Skip: false,
@@ -136,6 +170,48 @@ func (class *ClassDef) RefOffsets() []uint32 {
     return class.Cook().refs
 }
 
+// Return reference fields, including superclasses, in the same order as
+// RefOffsets.  Cooks the class as a side effect.
+//
+func (class *ClassDef) RefFields() []*Field {
+    return class.Cook().refFields
+}
+
+// Return all fields, including superclasses, in the order they're found in an
+// instance dump, with their offsets from the start of the instance data.
+// Cooks the class as a side effect.
+//
+func (class *ClassDef) Layout() ([]*Field, []uint32) {
+    class.Cook()
+    return class.layout, class.layoutOffsets
+}
+
+// Return the name of a reference from this class's class object, given the
+// edge label.
+//
+func (class *ClassDef) StaticRefName(label uint32) string {
+    switch label {
+        case SuperLabel:
+            return "<super>"
+        case LoaderLabel:
+            return "<classloader>"
+        case SignersLabel:
+            return "<signers>"
+        case DomainLabel:
+            return "<protection domain>"
+    }
+    if int(label) < len(class.staticNames) {
+        return class.staticNames[label]
+    }
+    return "?"
+}
+
+// Is this an array class.
+//
+func (class *ClassDef) IsArray() bool {
+    return strings.HasSuffix(class.Name, "[]")
+}
+
 // Return size of the instance layout in bytes, including superclasses.
 // Cooks the class as a side effect.
 //
@@ -162,7 +238,7 @@ func (class *ClassDef) Cook() *ClassDef {
     if ! class.IsRoot {
         class.super = class.HidClass(class.SuperHid)
         if class.super == nil {
-            log.Fatalf("No super def for %v\n", class)
+            panic(newReadError(ErrBadRecord, "no CLASS_DUMP for superclass of %s", class.Name))
         }
         class.super.subclasses = append(class.super.subclasses, class)
         class.super.Cook()
@@ -184,6 +260,9 @@ func (class *ClassDef) Cook() *ClassDef {
     // of a given class will be different for different subclasses.
 
     offsets := []uint32{}
+    refFields := []*Field{}
+    layout := []*Field{}
+    layoutOffsets := []uint32{}
     offset := uint32(0)
     c := class
 
@@ -191,13 +270,19 @@ func (class *ClassDef) Cook() *ClassDef {
         for _, field := range c.fields {
             if field.JType.IsObj {
                 offsets = append(offsets, offset)
+                refFields = append(refFields, field)
             }
+            layout = append(layout, field)
+            layoutOffsets = append(layoutOffsets, offset)
             offset += field.JType.Size
         }
         c = c.super
     }
 
     class.refs = offsets
+    class.refFields = refFields
+    class.layout = layout
+    class.layoutOffsets = layoutOffsets
     // log.Printf("%s has refs at %v\n", class.Name, class.refs)
 
     class.cooked = true
@@ -0,0 +1,245 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "sort"
+)
+
+// Knows how to find the size & capacity of one kind of collection, given
+// the instance.  Capacity is in slots of the backing array(s); ok is false
+// if the instance doesn't have the expected fields.
+//
+type collectionAnalyzer struct {
+    className string
+    analyze func(heap *Heap, in *MappedSection, oid ObjectId, class *ClassDef) (size, capacity int64, ok bool)
+}
+
+// Analyzers for the collections we know the internals of.  Subclasses are
+// handled by the analyzer for the superclass, first match wins.
+//
+var collectionAnalyzers = []*collectionAnalyzer{
+    &collectionAnalyzer{"java.util.HashMap", analyzeHashMap},
+    &collectionAnalyzer{"java.util.HashSet", analyzeHashSet},
+    &collectionAnalyzer{"java.util.ArrayList", analyzeArrayList},
+    &collectionAnalyzer{"java.util.LinkedList", analyzeLinkedList},
+    &collectionAnalyzer{"java.util.concurrent.ConcurrentHashMap", analyzeConcurrentHashMap},
+}
+
+// HashMap has a table of buckets, allocated lazily as of JDK 8.
+//
+func analyzeHashMap(heap *Heap, in *MappedSection, oid ObjectId, class *ClassDef) (int64, int64, bool) {
+    size, ok := heap.intField(in, oid, class, "size")
+    if !ok {
+        return 0, 0, false
+    }
+    capacity, _ := heap.arrayLength(in, heap.refField(oid, class, "table"))
+    return size, int64(capacity), true
+}
+
+// HashSet is a wrapper around a HashMap.
+//
+func analyzeHashSet(heap *Heap, in *MappedSection, oid ObjectId, class *ClassDef) (int64, int64, bool) {
+    if m := heap.refField(oid, class, "map"); m != 0 {
+        return analyzeHashMap(heap, in, m, heap.ClassOf(m))
+    }
+    return 0, 0, false
+}
+
+func analyzeArrayList(heap *Heap, in *MappedSection, oid ObjectId, class *ClassDef) (int64, int64, bool) {
+    size, ok := heap.intField(in, oid, class, "size")
+    if !ok {
+        return 0, 0, false
+    }
+    capacity, _ := heap.arrayLength(in, heap.refField(oid, class, "elementData"))
+    return size, int64(capacity), true
+}
+
+// LinkedList has no backing array, so only emptiness is of interest.
+//
+func analyzeLinkedList(heap *Heap, in *MappedSection, oid ObjectId, class *ClassDef) (int64, int64, bool) {
+    size, ok := heap.intField(in, oid, class, "size")
+    return size, size, ok
+}
+
+// ConcurrentHashMap is a single table with a base count as of JDK 8, and an
+// array of segments, each with its own table & count, before that.
+//
+func analyzeConcurrentHashMap(heap *Heap, in *MappedSection, oid ObjectId, class *ClassDef) (int64, int64, bool) {
+    if size, ok := heap.intField(in, oid, class, "baseCount"); ok {
+        capacity, _ := heap.arrayLength(in, heap.refField(oid, class, "table"))
+        return size, int64(capacity), true
+    }
+    segments := heap.refField(oid, class, "segments")
+    if segments == 0 {
+        return 0, 0, false
+    }
+    size, capacity := int64(0), int64(0)
+    for segment, pos := heap.OutEdges(segments); pos != 0; segment, pos = heap.NextOutEdge(pos) {
+        if segment == 0 {
+            continue
+        }
+        segClass := heap.ClassOf(segment)
+        count, _ := heap.intField(in, segment, segClass, "count")
+        length, _ := heap.arrayLength(in, heap.refField(segment, segClass, "table"))
+        size += count
+        capacity += int64(length)
+    }
+    return size, capacity, true
+}
+
+// Totals for one kind of collection held by one owning class
+//
+type CollectionStats struct {
+    Collection *ClassDef
+    // class of the immediate dominator of the collections, or nil if they're
+    // GC roots or unreachable
+    Owner *ClassDef
+    Count uint32
+    Empty uint32
+    Size int64
+    Capacity int64
+    // bytes in unused slots of backing arrays
+    Wasted uint64
+}
+
+// Analyze every collection we know the internals of, and total size, capacity,
+// empty instances and wasted bytes by collection class & owning class.  The
+// owner of a collection is its immediate dominator, the object that would free
+// it.  Results are ordered by wasted bytes, most first.  Requires the reference
+// graph.
+//
+func (heap *Heap) AnalyzeCollections() []*CollectionStats {
+
+    analyzerOf := make([]*collectionAnalyzer, heap.MaxClassId + 1)
+    for _, analyzer := range collectionAnalyzers {
+        cids := heap.CidsMatching(analyzer.className)
+        for cid := range analyzerOf {
+            if analyzerOf[cid] == nil && cids.Has(uint32(cid)) {
+                analyzerOf[cid] = analyzer
+            }
+        }
+    }
+
+    if heap.MaxObjectId == 0 {
+        return nil
+    }
+
+    // A HashSet's map is counted with the set, not on its own.
+
+    in := heap.seekObject(1)
+    claimed := NewBitSet(uint32(heap.MaxObjectId) + 1)
+    for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+        class := heap.ClassOf(oid)
+        if analyzer := analyzerOf[class.Cid]; analyzer != nil && analyzer.className == "java.util.HashSet" {
+            if m := heap.refField(oid, class, "map"); m != 0 {
+                claimed.Set(uint32(m))
+            }
+        }
+    }
+
+    type key struct { collection, owner ClassId }
+    stats := make(map[key]*CollectionStats)
+    dominators := heap.Dominators()
+
+    for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+        class := heap.ClassOf(oid)
+        analyzer := analyzerOf[class.Cid]
+        if analyzer == nil || claimed.Has(uint32(oid)) {
+            continue
+        }
+        size, capacity, ok := analyzer.analyze(heap, in, oid, class)
+        if !ok {
+            continue
+        }
+        var owner *ClassDef
+        k := key{class.Cid, 0}
+        if dom := dominators.Dominator(oid); dom != 0 {
+            owner = heap.ClassOf(dom)
+            k.owner = owner.Cid
+        }
+        s := stats[k]
+        if s == nil {
+            s = &CollectionStats{Collection: class, Owner: owner}
+            stats[k] = s
+        }
+        s.Count++
+        if size == 0 {
+            s.Empty++
+        }
+        s.Size += size
+        s.Capacity += capacity
+        if capacity > size {
+            s.Wasted += uint64(capacity - size) * uint64(heap.IdSize)
+        }
+    }
+
+    result := make([]*CollectionStats, 0, len(stats))
+    for _, s := range stats {
+        result = append(result, s)
+    }
+    sort.Sort(collectionsByWaste(result))
+    return result
+}
+
+// Print collection stats: count, empty count, total size, total capacity,
+// wasted bytes, collection class and owning class.
+//
+func (heap *Heap) PrintCollections(out ReportWriter, stats []*CollectionStats) {
+    out.Begin("collections", Column{"count", "%10v"}, Column{"empty", "%10v"}, Column{"size", "%10v"},
+              Column{"capacity", "%10v"}, Column{"wasted", "%10v"}, Column{"collection", "%v"},
+              Column{"owner", "in %v"})
+    var total CollectionStats
+    for _, s := range stats {
+        owner := "<none>"
+        if s.Owner != nil {
+            owner = s.Owner.Name
+        }
+        out.Row(s.Count, s.Empty, s.Size, s.Capacity, s.Wasted, s.Collection.Name, owner)
+        total.Count += s.Count
+        total.Empty += s.Empty
+        total.Size += s.Size
+        total.Capacity += s.Capacity
+        total.Wasted += s.Wasted
+    }
+    out.Total(total.Count, total.Empty, total.Size, total.Capacity, total.Wasted, "total", "")
+}
+
+// Sort collection stats by wasted bytes, then by count
+//
+type collectionsByWaste []*CollectionStats
+func (c collectionsByWaste) Len() int { return len(c) }
+func (c collectionsByWaste) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+
+func (c collectionsByWaste) Less(i, j int) bool {
+    if c[i].Wasted != c[j].Wasted {
+        return c[i].Wasted > c[j].Wasted
+    }
+    if c[i].Count != c[j].Count {
+        return c[i].Count > c[j].Count
+    }
+    if c[i].Collection.Name != c[j].Collection.Name {
+        return c[i].Collection.Name < c[j].Collection.Name
+    }
+    return c[i].Owner != nil && (c[j].Owner == nil || c[i].Owner.Name < c[j].Owner.Name)
+}
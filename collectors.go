@@ -0,0 +1,321 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "container/heap"
+    "sort"
+)
+
+// A function that can be used in a search, e.g. count(x) in "run count(x) from
+// String x".  It creates a Collector that's given the objects bound to the
+// function's variables for each match, then reports on what it collected.
+//
+type SearchFunction struct {
+    // name in searches
+    Name string
+    // for error messages
+    Usage string
+    // number of variable args
+    NumVars int
+    // takes a leading numeric arg, e.g. the n in top(n, x)
+    HasLimit bool
+    // create a collector for one search, given the numeric arg if any
+    New func(heap *Heap, limit int) ReportCollector
+}
+
+// A Collector that can print what it collected.
+//
+type ReportCollector interface {
+    Collector
+    Print(out ReportWriter)
+}
+
+// Search functions by name
+//
+var searchFunctions = map[string]*SearchFunction {
+    "histo": &SearchFunction{"histo", "histo(x, y)", 2, false, func(heap *Heap, limit int) ReportCollector {
+        return heap.NewHisto()
+    }},
+    "count": &SearchFunction{"count", "count(x)", 1, false, func(heap *Heap, limit int) ReportCollector {
+        return &countCollector{}
+    }},
+    "distinct": &SearchFunction{"distinct", "distinct(x)", 1, false, func(heap *Heap, limit int) ReportCollector {
+        return &distinctCollector{heap: heap, known: NewBitSet(uint32(heap.MaxObjectId) + 1)}
+    }},
+    "list": &SearchFunction{"list", "list(x)", 1, false, func(heap *Heap, limit int) ReportCollector {
+        return &listCollector{heap: heap, known: NewBitSet(uint32(heap.MaxObjectId) + 1)}
+    }},
+    "top": &SearchFunction{"top", "top(n, x)", 1, true, func(heap *Heap, limit int) ReportCollector {
+        return &topCollector{heap: heap, known: NewBitSet(uint32(heap.MaxObjectId) + 1), limit: limit,
+                             top: smallestFirst{oidsBySize{sizes: heap.objectSizes}}}
+    }},
+    "sum": &SearchFunction{"sum", "sum(x)", 1, false, func(heap *Heap, limit int) ReportCollector {
+        return &sumCollector{distinctCollector{heap: heap, known: NewBitSet(uint32(heap.MaxObjectId) + 1)}}
+    }},
+    "groupby": &SearchFunction{"groupby", "groupby(x, y)", 2, false, func(heap *Heap, limit int) ReportCollector {
+        return &groupCollector{heap: heap, groupIndex: make(map[ObjectId]int), compactAt: groupCompactSize}
+    }},
+}
+
+// count(x): the number of matches, counting an object once per path to it
+//
+type countCollector struct {
+    matches uint64
+}
+
+func (c *countCollector) Collect(oids []ObjectId) {
+    c.matches++
+}
+
+func (c *countCollector) Print(out ReportWriter) {
+    out.Begin("count", Column{"count", "%10v"})
+    out.Row(c.matches)
+}
+
+// distinct(x): the number of distinct objects and their total size
+//
+type distinctCollector struct {
+    heap *Heap
+    known BitSet
+    count uint32
+    nbytes uint64
+}
+
+func (c *distinctCollector) Collect(oids []ObjectId) {
+    if ! c.known.Has(uint32(oids[0])) {
+        c.known.Set(uint32(oids[0]))
+        c.count++
+        c.nbytes += uint64(c.heap.SizeOf(oids[0]))
+    }
+}
+
+func (c *distinctCollector) Print(out ReportWriter) {
+    out.Begin("distinct", Column{"count", "%10v"}, Column{"bytes", "%10v"})
+    out.Row(c.count, c.nbytes)
+}
+
+// sum(x): same as distinct, plus the retained size of the objects as a group
+//
+type sumCollector struct {
+    distinctCollector
+}
+
+func (c *sumCollector) Print(out ReportWriter) {
+    retained := c.heap.Dominators().GroupRetained(func(oid ObjectId) int {
+        if c.known.Has(uint32(oid)) {
+            return 0
+        }
+        return -1
+    }, 1)
+    out.Begin("sum", Column{"count", "%10v"}, Column{"bytes", "%10v"}, Column{"retained", "%10v"})
+    out.Row(c.count, c.nbytes, retained[0])
+}
+
+// list(x): the distinct objects, in the order found
+//
+type listCollector struct {
+    heap *Heap
+    known BitSet
+    oids []ObjectId
+}
+
+func (c *listCollector) Collect(oids []ObjectId) {
+    if ! c.known.Has(uint32(oids[0])) {
+        c.known.Set(uint32(oids[0]))
+        c.oids = append(c.oids, oids[0])
+    }
+}
+
+func (c *listCollector) Print(out ReportWriter) {
+    out.Begin("list", Column{"oid", "%10v"}, Column{"bytes", "%10v"}, Column{"class", "%v"})
+    for _, oid := range c.oids {
+        out.Row(oid, c.heap.SizeOf(oid), c.heap.ClassOf(oid).Name)
+    }
+}
+
+// top(n, x): the n largest distinct objects by size, with retained sizes.  Only
+// the n largest so far are kept, in a heap with the smallest of them on top.
+//
+type topCollector struct {
+    heap *Heap
+    known BitSet
+    limit int
+    top smallestFirst
+}
+
+func (c *topCollector) Collect(oids []ObjectId) {
+    if ! c.known.Has(uint32(oids[0])) {
+        c.known.Set(uint32(oids[0]))
+        heap.Push(&c.top, oids[0])
+        if c.top.Len() > c.limit {
+            heap.Pop(&c.top)
+        }
+    }
+}
+
+func (c *topCollector) Print(out ReportWriter) {
+    sort.Sort(&c.top.oidsBySize)
+    out.Begin("top", Column{"oid", "%10v"}, Column{"bytes", "%10v"}, Column{"retained", "%10v"},
+              Column{"class", "%v"})
+    for _, oid := range c.top.oids {
+        out.Row(oid, c.heap.SizeOf(oid), c.heap.RetainedSizeOf(oid), c.heap.ClassOf(oid).Name)
+    }
+}
+
+// groupby(x, y): the distinct y objects for each x object, with their size and
+// retained size as a group.  An object in more than one group counts toward the
+// retained size of the one whose x object was found first.
+//
+type groupCollector struct {
+    heap *Heap
+    groups []*objectGroup
+    // index in groups of each x object
+    groupIndex map[ObjectId]int
+    // y object id << 32 | group index for each match; sorted & deduplicated
+    // by compact when it reaches compactAt
+    members []uint64
+    compactAt int
+}
+
+// Minimum size at which groupCollector.members is compacted
+//
+const groupCompactSize = 1 << 16
+
+type objectGroup struct {
+    oid ObjectId
+    count uint32
+    nbytes uint64
+    retained uint64
+}
+
+func (c *groupCollector) Collect(oids []ObjectId) {
+    index, ok := c.groupIndex[oids[0]]
+    if ! ok {
+        index = len(c.groups)
+        c.groupIndex[oids[0]] = index
+        c.groups = append(c.groups, &objectGroup{oid: oids[0]})
+    }
+    c.members = append(c.members, uint64(oids[1]) << 32 | uint64(index))
+    if len(c.members) >= c.compactAt {
+        c.compact()
+        c.compactAt = 2 * len(c.members) + groupCompactSize
+    }
+}
+
+// Sort the matches by y object then group, dropping repeats.
+//
+func (c *groupCollector) compact() {
+    sort.Sort(uint64List(c.members))
+    n := 0
+    for i, key := range c.members {
+        if i == 0 || key != c.members[n-1] {
+            c.members[n] = key
+            n++
+        }
+    }
+    c.members = c.members[:n]
+}
+
+func (c *groupCollector) Print(out ReportWriter) {
+    heap := c.heap
+    c.compact()
+    groupOf := make(map[ObjectId]int)
+    for i, key := range c.members {
+        member, index := ObjectId(key >> 32), int(key & 0xffffffff)
+        group := c.groups[index]
+        group.count++
+        group.nbytes += uint64(heap.SizeOf(member))
+        if i == 0 || c.members[i-1] >> 32 != key >> 32 {
+            groupOf[member] = index
+        }
+    }
+    retained := heap.Dominators().GroupRetained(func(oid ObjectId) int {
+        if index, ok := groupOf[oid]; ok {
+            return index
+        }
+        return -1
+    }, len(c.groups))
+    for i, group := range c.groups {
+        group.retained = retained[i]
+    }
+    sort.Sort(groupsByRetained(c.groups))
+    out.Begin("groupby", Column{"oid", "%10v"}, Column{"count", "%10v"}, Column{"bytes", "%10v"},
+              Column{"retained", "%10v"}, Column{"class", "%v"})
+    for _, group := range c.groups {
+        out.Row(group.oid, group.count, group.nbytes, group.retained, heap.ClassOf(group.oid).Name)
+    }
+}
+
+// Sort object ids by size, largest first, then by id
+//
+type oidsBySize struct {
+    oids []ObjectId
+    sizes []uint32
+}
+
+func (o *oidsBySize) Len() int { return len(o.oids) }
+func (o *oidsBySize) Swap(i, j int) { o.oids[i], o.oids[j] = o.oids[j], o.oids[i] }
+
+func (o *oidsBySize) Less(i, j int) bool {
+    si, sj := o.sizes[o.oids[i]], o.sizes[o.oids[j]]
+    if si != sj {
+        return si > sj
+    }
+    return o.oids[i] < o.oids[j]
+}
+
+// Same, smallest first, as a container/heap
+//
+type smallestFirst struct {
+    oidsBySize
+}
+
+func (h *smallestFirst) Less(i, j int) bool { return h.oidsBySize.Less(j, i) }
+func (h *smallestFirst) Push(x interface{}) { h.oids = append(h.oids, x.(ObjectId)) }
+
+func (h *smallestFirst) Pop() interface{} {
+    oid := h.oids[len(h.oids) - 1]
+    h.oids = h.oids[:len(h.oids) - 1]
+    return oid
+}
+
+// Sort uint64s ascending
+//
+type uint64List []uint64
+func (u uint64List) Len() int { return len(u) }
+func (u uint64List) Swap(i, j int) { u[i], u[j] = u[j], u[i] }
+func (u uint64List) Less(i, j int) bool { return u[i] < u[j] }
+
+// Sort object groups by retained size, then by id
+//
+type groupsByRetained []*objectGroup
+func (g groupsByRetained) Len() int { return len(g) }
+func (g groupsByRetained) Swap(i, j int) { g[i], g[j] = g[j], g[i] }
+
+func (g groupsByRetained) Less(i, j int) bool {
+    if g[i].retained != g[j].retained {
+        return g[i].retained > g[j].retained
+    }
+    return g[i].oid < g[j].oid
+}
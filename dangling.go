@@ -0,0 +1,80 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "fmt"
+    "sort"
+)
+
+// Print the references to objects that aren't in the heap dump, with the field
+// each is found in and the heap id it refers to.
+//
+func (heap *Heap) PrintDangling(out ReportWriter) {
+    out.Begin("dangling", Column{"oid", "%10v"}, Column{"class", "%v"}, Column{"field", "%v"},
+              Column{"hid", "-> %v"})
+    for _, ref := range heap.dangling {
+        out.Row(ref.From, heap.ClassOf(ref.From).Name, heap.EdgeName(ref.From, ref.Label),
+                fmt.Sprintf("%#x", ref.To))
+    }
+}
+
+// Print the number of dangling references from instances of each class, most
+// first.
+//
+func (heap *Heap) PrintDanglingByClass(out ReportWriter) {
+
+    counts := make([]int, heap.MaxClassId + 1)
+    for _, ref := range heap.dangling {
+        counts[heap.ClassOf(ref.From).Cid]++
+    }
+    classes := []*ClassDef{}
+    for _, class := range heap.classes[1:] {
+        if counts[class.Cid] > 0 {
+            classes = append(classes, class)
+        }
+    }
+    sort.Sort(classesByDangling{classes, counts})
+
+    out.Begin("danglingbyclass", Column{"count", "%10v"}, Column{"class", "%v"})
+    for _, class := range classes {
+        out.Row(counts[class.Cid], class.Name)
+    }
+    out.Total(len(heap.dangling), "total")
+}
+
+type classesByDangling struct {
+    classes []*ClassDef
+    counts []int
+}
+
+func (c classesByDangling) Len() int { return len(c.classes) }
+func (c classesByDangling) Swap(i, j int) { c.classes[i], c.classes[j] = c.classes[j], c.classes[i] }
+
+func (c classesByDangling) Less(i, j int) bool {
+    ci, cj := c.counts[c.classes[i].Cid], c.counts[c.classes[j].Cid]
+    if ci != cj {
+        return ci > cj
+    }
+    return c.classes[i].Name < c.classes[j].Name
+}
@@ -0,0 +1,239 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "log"
+    "sort"
+)
+
+// Change in one class between two heaps
+//
+type ClassDelta struct {
+    Name string
+    Count int64
+    Bytes int64
+    Retained int64
+    // class is only in the second heap
+    New bool
+    // class is only in the first heap
+    Gone bool
+}
+
+// Survivors vs new allocations of one class, matched by heap id
+//
+type ClassSurvivors struct {
+    Name string
+    Survivors uint32
+    New uint32
+}
+
+// Compare the class histograms of two heaps, including retained sizes.  Classes
+// are matched by name.  Results are ordered by growth in retained size, then
+// shallow size.  Requires the reference graph in both heaps.
+//
+func DiffHeaps(before, after *Heap) []*ClassDelta {
+
+    deltas := make(map[string]*ClassDelta)
+    tally := func(heap *Heap, sign int64) {
+        counts := make([]int64, heap.MaxClassId + 1)
+        bytes := make([]int64, heap.MaxClassId + 1)
+        for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+            counts[heap.objectCids[oid]]++
+            bytes[heap.objectCids[oid]] += int64(heap.objectSizes[oid])
+        }
+        retained := heap.Dominators().GroupRetained(func(oid ObjectId) int {
+            return int(heap.objectCids[oid])
+        }, int(heap.MaxClassId) + 1)
+        for _, class := range heap.classes[1:] {
+            delta := deltas[class.Name]
+            if delta == nil {
+                delta = &ClassDelta{Name: class.Name, New: sign > 0, Gone: sign < 0}
+                deltas[class.Name] = delta
+            } else {
+                delta.New, delta.Gone = false, false
+            }
+            delta.Count += sign * counts[class.Cid]
+            delta.Bytes += sign * bytes[class.Cid]
+            delta.Retained += sign * int64(retained[class.Cid])
+        }
+    }
+    tally(before, -1)
+    tally(after, 1)
+
+    result := make([]*ClassDelta, 0, len(deltas))
+    for _, delta := range deltas {
+        if delta.Count != 0 || delta.Bytes != 0 || delta.Retained != 0 || delta.New || delta.Gone {
+            result = append(result, delta)
+        }
+    }
+    sort.Sort(deltasByGrowth(result))
+    return result
+}
+
+// Match the objects of two heaps by heap id, and count the objects in the second
+// heap that survived from the first vs those newly allocated, by class.  This is
+// only meaningful if the JVM didn't move objects in between, so also return the
+// number of heap ids found in both heaps with different classes; if that's not
+// small, objects were moved.  Requires both heaps to be read with NeedHids.
+//
+func MatchObjects(before, after *Heap) ([]*ClassSurvivors, uint32) {
+
+    // Merge join on heap id.
+
+    beforeOids := before.oidsByHid()
+    afterOids := after.oidsByHid()
+    survived := NewBitSet(uint32(after.MaxObjectId) + 1)
+    moved := uint32(0)
+
+    for i, j := 0, 0; i < len(beforeOids) && j < len(afterOids); {
+        a, b := beforeOids[i], afterOids[j]
+        switch ha, hb := before.objectHids[a], after.objectHids[b]; {
+            case ha < hb:
+                i++
+            case ha > hb:
+                j++
+            default:
+                if before.ClassOf(a).Name == after.ClassOf(b).Name {
+                    survived.Set(uint32(b))
+                } else {
+                    moved++
+                }
+                i++
+                j++
+        }
+    }
+
+    counts := make([]*ClassSurvivors, after.MaxClassId + 1)
+    for oid := ObjectId(1); oid <= after.MaxObjectId; oid++ {
+        class := after.ClassOf(oid)
+        count := counts[class.Cid]
+        if count == nil {
+            count = &ClassSurvivors{Name: class.Name}
+            counts[class.Cid] = count
+        }
+        if survived.Has(uint32(oid)) {
+            count.Survivors++
+        } else {
+            count.New++
+        }
+    }
+
+    result := []*ClassSurvivors{}
+    for _, count := range counts {
+        if count != nil {
+            result = append(result, count)
+        }
+    }
+    sort.Sort(survivorsByNew(result))
+    return result, moved
+}
+
+// Return object ids ordered by heap id.
+//
+func (heap *Heap) oidsByHid() []ObjectId {
+    oids := make([]ObjectId, heap.MaxObjectId)
+    for i := range oids {
+        oids[i] = ObjectId(i + 1)
+    }
+    sort.Sort(&oidsByHid{oids, heap.objectHids})
+    return oids
+}
+
+// Print class deltas: count, shallow & retained size changes, and name.
+//
+func PrintDiff(out ReportWriter, deltas []*ClassDelta) {
+    out.Begin("diff", Column{"count", "%+10v"}, Column{"bytes", "%+10v"}, Column{"retained", "%+10v"},
+              Column{"class", "%v"}, Column{"change", "(%v)"})
+    var total ClassDelta
+    for _, delta := range deltas {
+        change := ""
+        switch {
+            case delta.New:
+                change = "new"
+            case delta.Gone:
+                change = "gone"
+        }
+        out.Row(delta.Count, delta.Bytes, delta.Retained, delta.Name, change)
+        total.Count += delta.Count
+        total.Bytes += delta.Bytes
+        total.Retained += delta.Retained
+    }
+    out.Total(total.Count, total.Bytes, total.Retained, "total", "")
+}
+
+// Print survivors & new objects by class, and a warning if objects were moved.
+//
+func PrintSurvivors(out ReportWriter, counts []*ClassSurvivors, moved uint32) {
+    if moved > 0 {
+        log.Printf("Warning: %d heap ids changed class, objects were probably moved\n", moved)
+    }
+    out.Begin("survivors", Column{"survivors", "%10v"}, Column{"new", "%10v"}, Column{"class", "%v"})
+    var survivors, allocated uint32
+    for _, count := range counts {
+        out.Row(count.Survivors, count.New, count.Name)
+        survivors += count.Survivors
+        allocated += count.New
+    }
+    out.Total(survivors, allocated, "total")
+}
+
+// Sort class deltas by retained size growth, then shallow size growth, then name
+//
+type deltasByGrowth []*ClassDelta
+func (d deltasByGrowth) Len() int { return len(d) }
+func (d deltasByGrowth) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+
+func (d deltasByGrowth) Less(i, j int) bool {
+    if d[i].Retained != d[j].Retained {
+        return d[i].Retained > d[j].Retained
+    }
+    if d[i].Bytes != d[j].Bytes {
+        return d[i].Bytes > d[j].Bytes
+    }
+    return d[i].Name < d[j].Name
+}
+
+// Sort survivor counts by new objects, most first, then name
+//
+type survivorsByNew []*ClassSurvivors
+func (s survivorsByNew) Len() int { return len(s) }
+func (s survivorsByNew) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (s survivorsByNew) Less(i, j int) bool {
+    if s[i].New != s[j].New {
+        return s[i].New > s[j].New
+    }
+    return s[i].Name < s[j].Name
+}
+
+// Sort object ids by heap id
+//
+type oidsByHid struct {
+    oids []ObjectId
+    hids []HeapId
+}
+
+func (o *oidsByHid) Len() int { return len(o.oids) }
+func (o *oidsByHid) Swap(i, j int) { o.oids[i], o.oids[j] = o.oids[j], o.oids[i] }
+func (o *oidsByHid) Less(i, j int) bool { return o.hids[o.oids[i]] < o.hids[o.oids[j]] }
@@ -0,0 +1,106 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    . "launchpad.net/gocheck"
+    "os"
+)
+
+// Diff the test heap after 5000 passes against the same after 10000 passes, plus
+// a class only in the second heap.  The first 5000 Things and their Integers
+// survive with the same heap ids; the Things after them are new.
+//
+func (s *SearchSuite) TestDiff(c *C) {
+
+    LogTestOutput()
+    dir := c.MkDir()
+    c.Assert(BuildGenHeap(5000).WriteFile(dir + "/before.hprof"), IsNil)
+    w := BuildGenHeap(10000)
+    w.AddRoot(0x01, w.AddInstance(w.DefineClass("com.myco.Extra", nil), nil))
+    c.Assert(w.WriteFile(dir + "/after.hprof"), IsNil)
+
+    options := &Options{NeedRefs: true, NeedHids: true, NoIndex: true}
+    before, err := ReadHeapDump(dir + "/before.hprof", options)
+    c.Assert(err, IsNil)
+    after, err := ReadHeapDump(dir + "/after.hprof", options)
+    c.Assert(err, IsNil)
+
+    // Deltas match the class histograms, and retained sizes grow with the map.
+
+    deltas := DiffHeaps(before, after)
+    PrintDiff(NewTextReport(os.Stdout), deltas)
+    byName := make(map[string]*ClassDelta)
+    for _, delta := range deltas {
+        byName[delta.Name] = delta
+    }
+    beforeHisto, afterHisto := before.ClassHisto(), after.ClassHisto()
+    for _, name := range []string{"com.myco.GenHeap$Thing", "java.lang.Integer", "java.util.ArrayList"} {
+        delta := byName[name]
+        c.Assert(delta, NotNil, Commentf(name))
+        count, nbytes := beforeHisto.Counts(before.ClassNamed(name))
+        afterCount, afterBytes := afterHisto.Counts(after.ClassNamed(name))
+        c.Check(delta.Count, Equals, int64(afterCount) - int64(count), Commentf(name))
+        c.Check(delta.Bytes, Equals, int64(afterBytes) - int64(nbytes), Commentf(name))
+        c.Check(delta.New || delta.Gone, Equals, false, Commentf(name))
+    }
+    c.Check(byName["com.myco.GenHeap$Thing"].Count, Equals, int64(5000))
+    c.Check(byName["com.myco.GenHeap"].Retained > 0, Equals, true)
+    c.Check(deltas[0].Retained >= deltas[len(deltas) - 1].Retained, Equals, true)
+    c.Check(byName["com.myco.Extra"].New, Equals, true)
+    c.Check(byName["com.myco.Extra"].Count, Equals, int64(1))
+    for _, delta := range DiffHeaps(after, before) {
+        c.Check(delta.Gone, Equals, delta.Name == "com.myco.Extra", Commentf(delta.Name))
+    }
+
+    // The objects from after the first 5000 passes in the first heap have the
+    // ids of Things & Integers in the second, so most show as moved.
+
+    counts, moved := MatchObjects(before, after)
+    PrintSurvivors(NewTextReport(os.Stdout), counts, moved)
+    survivors := make(map[string]*ClassSurvivors)
+    total := uint32(0)
+    for _, count := range counts {
+        survivors[count.Name] = count
+        total += count.Survivors
+    }
+    thing, integer := before.ClassNamed("com.myco.GenHeap$Thing"), before.ClassNamed("java.lang.Integer")
+    things, _ := beforeHisto.Counts(thing)
+    values, numValues := NewBitSet(uint32(before.MaxObjectId) + 1), uint32(0)
+    for oid := ObjectId(1); oid <= before.MaxObjectId; oid++ {
+        if before.ClassOf(oid) == thing {
+            for dst, pos := before.OutEdges(oid); pos != 0; dst, pos = before.NextOutEdge(pos) {
+                if before.ClassOf(dst) == integer && !values.Has(uint32(dst)) {
+                    values.Set(uint32(dst))
+                    numValues++
+                }
+            }
+        }
+    }
+    c.Check(survivors["com.myco.GenHeap$Thing"].Survivors, Equals, things)
+    c.Check(survivors["com.myco.GenHeap$Thing"].New, Equals, uint32(5000))
+    c.Check(survivors["java.lang.Integer"].Survivors >= numValues, Equals, true)
+    c.Check(survivors["com.myco.Extra"].New, Equals, uint32(1))
+    c.Check(moved > 0, Equals, true)
+    c.Check(total + moved, Equals, uint32(before.MaxObjectId))
+}
@@ -0,0 +1,308 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+// Dominator tree and retained sizes for an object graph.  An object's retained
+// size is the total size of everything it dominates, i.e. what would be freed
+// if it were no longer referenced.
+//
+// ObjectId 0 is never assigned to an object, so it serves as a virtual root whose
+// successors are the GC roots.  Objects not reachable from any GC root have no
+// dominator and a retained size of zero.
+//
+type Dominators struct {
+    // immediate dominator of each object, or 0 for GC roots & unreachable objects
+    idom []ObjectId
+    // retained size of each object, indexed by same
+    retained []uint64
+    // reachable objects in DFS preorder, starting with the virtual root
+    order []ObjectId
+    // dominator tree, built on demand by tree()
+    children *EdgeSet
+}
+
+// Compute dominators with the Lengauer-Tarjan algorithm, using path compression
+// but not balancing, as in Appel's "Modern Compiler Implementation."  All working
+// state is in flat slices indexed by object id or DFS number, and both the DFS
+// and the path compression are iterative, since dominator chains in a large heap
+// can be millions of objects deep.
+//
+func NewDominators(g *Graph, maxNode ObjectId, roots []ObjectId, sizes []uint32) *Dominators {
+
+    // DFS numbers are 1-based so 0 can mean "not visited" or "none."  The
+    // virtual root is always 1.
+
+    dfnum := make([]uint32, maxNode + 1)
+    vertex := make([]ObjectId, 2, maxNode + 2) // entry [0] not used
+    parent := make([]uint32, 2, maxNode + 2)
+
+    dfnum[0] = 1
+    n := uint32(1)
+
+    // DFS from each root, tracking the pending out edge at each level.
+
+    stackDst := make([]ObjectId, 0, 10000)
+    stackPos := make([]int, 0, 10000)
+    stackNum := make([]uint32, 0, 10000)
+
+    visit := func(node ObjectId, from uint32) {
+        n++
+        dfnum[node] = n
+        vertex = append(vertex, node)
+        parent = append(parent, from)
+        dst, pos := g.OutEdges(node)
+        stackDst = append(stackDst, dst)
+        stackPos = append(stackPos, pos)
+        stackNum = append(stackNum, n)
+    }
+
+    for _, root := range roots {
+        if root == 0 || root > maxNode || dfnum[root] != 0 {
+            continue
+        }
+        visit(root, 1)
+        for len(stackPos) > 0 {
+            top := len(stackPos) - 1
+            pos := stackPos[top]
+            if pos == 0 {
+                stackDst = stackDst[:top]
+                stackPos = stackPos[:top]
+                stackNum = stackNum[:top]
+                continue
+            }
+            dst := stackDst[top]
+            stackDst[top], stackPos[top] = g.NextOutEdge(pos)
+            if dst <= maxNode && dfnum[dst] == 0 {
+                visit(dst, stackNum[top])
+            }
+        }
+    }
+
+    isRoot := NewBitSet(uint32(maxNode) + 1)
+    for _, root := range roots {
+        if root <= maxNode {
+            isRoot.Set(uint32(root))
+        }
+    }
+
+    // Compute semidominators in reverse DFS order, deferring the idom calculation
+    // for each vertex in the bucket of its semidominator.
+
+    semi := make([]uint32, n + 1)
+    ancestor := make([]uint32, n + 1)
+    best := make([]uint32, n + 1)
+    samedom := make([]uint32, n + 1)
+    idom := make([]uint32, n + 1)
+    buckets := NewIntLists(n)
+    path := make([]uint32, 0, 10000)
+
+    // Find the ancestor of v with the lowest semidominator, compressing the path
+    // along the way.
+
+    eval := func(v uint32) uint32 {
+        path = path[:0]
+        for u := v; ancestor[ancestor[u]] != 0; u = ancestor[u] {
+            path = append(path, u)
+        }
+        for i := len(path) - 1; i >= 0; i-- {
+            x := path[i]
+            a := ancestor[x]
+            if semi[best[a]] < semi[best[x]] {
+                best[x] = best[a]
+            }
+            ancestor[x] = ancestor[a]
+        }
+        return best[v]
+    }
+
+    // Candidate semidominator from predecessor v of the vertex numbered i
+
+    candidate := func(v uint32, i uint32) uint32 {
+        if v <= i {
+            return v
+        }
+        return semi[eval(v)]
+    }
+
+    for i := n; i >= 2; i-- {
+        node := vertex[i]
+        p := parent[i]
+        s := p
+        for src, pos := g.InEdges(node); pos != 0; src, pos = g.NextInEdge(pos) {
+            if src <= maxNode && dfnum[src] != 0 {
+                if s1 := candidate(dfnum[src], i); s1 < s {
+                    s = s1
+                }
+            }
+        }
+        if isRoot.Has(uint32(node)) {
+            s = 1 // the virtual root is a predecessor of every GC root
+        }
+        semi[i] = s
+        buckets.Add(s, i)
+        ancestor[i] = p
+        best[i] = i
+        for v, pos := buckets.Walk(p); pos != NIL; v, pos = buckets.Next(pos) {
+            y := eval(v)
+            if semi[y] == semi[v] {
+                idom[v] = p
+            } else {
+                samedom[v] = y
+            }
+        }
+        buckets.Clear(p)
+    }
+
+    for i := uint32(2); i <= n; i++ {
+        if samedom[i] != 0 {
+            idom[i] = idom[samedom[i]]
+        }
+    }
+
+    // Convert to object ids, then accumulate retained sizes bottom-up; every
+    // dominator precedes the objects it dominates in DFS order.
+
+    d := &Dominators{
+        idom: make([]ObjectId, maxNode + 1),
+        retained: make([]uint64, maxNode + 1),
+        order: vertex[1:],
+    }
+
+    for i := uint32(2); i <= n; i++ {
+        node := vertex[i]
+        d.idom[node] = vertex[idom[i]]
+        d.retained[node] = uint64(sizes[node])
+    }
+
+    for i := n; i >= 2; i-- {
+        node := vertex[i]
+        d.retained[d.idom[node]] += d.retained[node]
+    }
+
+    return d
+}
+
+// Return the immediate dominator of an object, or 0 if it's a GC root or is
+// unreachable.
+//
+func (d *Dominators) Dominator(oid ObjectId) ObjectId {
+    return d.idom[oid]
+}
+
+// Return the retained size of an object, or 0 if it's unreachable.
+//
+func (d *Dominators) RetainedSize(oid ObjectId) uint64 {
+    return d.retained[oid]
+}
+
+// Return the total size of all reachable objects.
+//
+func (d *Dominators) ReachableSize() uint64 {
+    return d.retained[0]
+}
+
+// Return the number of objects reachable from GC roots.
+//
+func (d *Dominators) NumReachable() int {
+    return len(d.order) - 1
+}
+
+// Compute retained sizes for groups of objects, given a function assigning each
+// object to a group in [0, numGroups) or -1 for none.  An object's retained size
+// is added to its group only if no other member of the group dominates it, so
+// the result is the retained size of the group as a whole, with nothing counted
+// twice.  This is a single walk over the dominator tree, keeping a count of how
+// many members of each group are on the current path.
+//
+func (d *Dominators) GroupRetained(group func(ObjectId) int, numGroups int) []uint64 {
+
+    retained := make([]uint64, numGroups)
+    active := make([]uint32, numGroups)
+    tree := d.tree()
+
+    enter := func(node ObjectId) {
+        if g := group(node); g >= 0 {
+            if active[g] == 0 {
+                retained[g] += d.retained[node]
+            }
+            active[g]++
+        }
+    }
+
+    leave := func(node ObjectId) {
+        if g := group(node); g >= 0 {
+            active[g]--
+        }
+    }
+
+    stackNode := make([]ObjectId, 0, 10000)
+    stackDst := make([]ObjectId, 0, 10000)
+    stackPos := make([]int, 0, 10000)
+
+    push := func(node ObjectId) {
+        enter(node)
+        dst, pos := tree.walk(node)
+        stackNode = append(stackNode, node)
+        stackDst = append(stackDst, dst)
+        stackPos = append(stackPos, pos)
+    }
+
+    for root, rpos := tree.walk(0); rpos != 0; root, rpos = tree.next(rpos) {
+        push(root)
+        for len(stackPos) > 0 {
+            top := len(stackPos) - 1
+            pos := stackPos[top]
+            if pos == 0 {
+                leave(stackNode[top])
+                stackNode = stackNode[:top]
+                stackDst = stackDst[:top]
+                stackPos = stackPos[:top]
+                continue
+            }
+            child := stackDst[top]
+            stackDst[top], stackPos[top] = tree.next(pos)
+            push(child)
+        }
+    }
+
+    return retained
+}
+
+// Return the dominator tree as an EdgeSet from each object to the objects it
+// immediately dominates, building it on first use.  GC roots are the children
+// of node 0.
+//
+func (d *Dominators) tree() *EdgeSet {
+    if d.children == nil {
+        src := make([]ObjectId, len(d.order) - 1)
+        dst := make([]ObjectId, len(d.order) - 1)
+        counts := make([]int, len(d.idom))
+        for i, node := range d.order[1:] {
+            src[i] = d.idom[node]
+            dst[i] = node
+            counts[src[i]]++
+        }
+        d.children = newEdgeSet(src, dst, nil, counts)
+    }
+    return d.children
+}
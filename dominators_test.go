@@ -0,0 +1,125 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "math/rand"
+    "testing"
+)
+
+// Check dominators & retained sizes for edges_2 (from graph_test.go) rooted at 1.
+//
+func TestDominators(t *testing.T) {
+    g := makeGraph(edges_2)
+    sizes := make([]uint32, g.MaxNode + 1)
+    for i := range sizes {
+        sizes[i] = 1
+    }
+    d := NewDominators(g, g.MaxNode, []ObjectId{1}, sizes)
+
+    // node -> expected idom; nodes 25 & 26 are unreachable
+    expected := [][]int {
+        []int{1, 0}, []int{2, 1}, []int{3, 2}, []int{4, 5}, []int{5, 2},
+        []int{6, 2}, []int{7, 6}, []int{8, 7}, []int{9, 7}, []int{10, 7},
+        []int{11, 10}, []int{14, 10}, []int{16, 8}, []int{17, 16}, []int{18, 7},
+        []int{19, 1}, []int{23, 1}, []int{24, 23}, []int{25, 0},
+    }
+    for _, pair := range expected {
+        idom := d.Dominator(ObjectId(pair[0]))
+        if idom != ObjectId(pair[1]) {
+            t.Errorf("Wrong dominator for %d, wanted %d, got %d\n", pair[0], pair[1], idom)
+        }
+    }
+
+    retained := [][]int {
+        []int{1, 24}, []int{2, 17}, []int{7, 12}, []int{10, 6}, []int{25, 0},
+    }
+    for _, pair := range retained {
+        size := d.RetainedSize(ObjectId(pair[0]))
+        if size != uint64(pair[1]) {
+            t.Errorf("Wrong retained size for %d, wanted %d, got %d\n", pair[0], pair[1], size)
+        }
+    }
+}
+
+// Compare against a brute-force computation on random graphs: d dominates n iff
+// n is unreachable from the roots once d is removed.
+//
+func TestRandomDominators(t *testing.T) {
+    random := rand.New(rand.NewSource(1))
+    for pass := 0; pass < 20; pass++ {
+        numNodes := 20 + random.Intn(100)
+        var src, dst []ObjectId
+        for i := 0; i < numNodes * 2; i++ {
+            src = append(src, ObjectId(1 + random.Intn(numNodes)))
+            dst = append(dst, ObjectId(1 + random.Intn(numNodes)))
+        }
+        maxNode := ObjectId(numNodes)
+        g := NewGraphWithMax(src, dst, nil, maxNode)
+        roots := []ObjectId{1, ObjectId(1 + random.Intn(numNodes))}
+        sizes := make([]uint32, maxNode + 1)
+        for i := range sizes {
+            sizes[i] = uint32(random.Intn(100))
+        }
+        d := NewDominators(g, maxNode, roots, sizes)
+
+        reachable := func(without ObjectId) []bool {
+            seen := make([]bool, maxNode + 1)
+            stack := []ObjectId{}
+            for _, root := range roots {
+                if root != without && !seen[root] {
+                    seen[root] = true
+                    stack = append(stack, root)
+                }
+            }
+            for len(stack) > 0 {
+                node := stack[len(stack)-1]
+                stack = stack[:len(stack)-1]
+                for dst, pos := g.OutEdges(node); pos != 0; dst, pos = g.NextOutEdge(pos) {
+                    if dst != without && !seen[dst] {
+                        seen[dst] = true
+                        stack = append(stack, dst)
+                    }
+                }
+            }
+            return seen
+        }
+
+        all := reachable(0)
+        for node := ObjectId(1); node <= maxNode; node++ {
+            retained := uint64(0)
+            if all[node] {
+                without := reachable(node)
+                for other := ObjectId(1); other <= maxNode; other++ {
+                    if all[other] && !without[other] {
+                        retained += uint64(sizes[other])
+                    }
+                }
+            }
+            if retained != d.RetainedSize(node) {
+                t.Fatalf("Pass %d: wrong retained size for %d, wanted %d, got %d\n",
+                         pass, node, retained, d.RetainedSize(node))
+            }
+        }
+    }
+}
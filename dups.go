@@ -0,0 +1,303 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "hash/fnv"
+    "runtime"
+    "sort"
+    "strconv"
+    "sync"
+)
+
+// Show this many duplicate groups unless told otherwise
+//
+const DefaultDupGroups = 20
+
+// Show this many referrers for each duplicate group
+//
+const MaxDupReferrers = 3
+
+// A set of strings or primitive arrays with identical contents.
+//
+type DupGroup struct {
+    Class *ClassDef
+    // the duplicates, in object id order
+    Members []ObjectId
+    // size of each member, including the value array for strings
+    Size uint64
+    // bytes that would be saved by sharing one copy
+    Wasted uint64
+}
+
+// Find strings and primitive arrays with identical contents, ranked by wasted
+// bytes.  Arrays that are the values of strings are counted with the strings,
+// not on their own.  Contents are sorted by 64-bit hash, computed on one
+// goroutine per CPU like MergeBags, then compared in full within each run of
+// equal hashes.  Returns a *ReadError if contents can't be read, as in a
+// damaged dump.  Requires the reference graph.
+//
+func (heap *Heap) FindDuplicates() (groups []*DupGroup, err error) {
+
+    defer recoverReadError(&err)
+
+    stringClass := heap.ClassNamed("java.lang.String")
+    isArray := NewBitSet(heap.MaxClassId + 1)
+    for _, jtype := range heap.Jtypes {
+        if jtype != nil && !jtype.IsObj && jtype.Class != nil {
+            isArray.Set(uint32(jtype.Class.Cid))
+        }
+    }
+
+    // Strings first, then the arrays they don't hold.
+
+    candidates := []ObjectId{}
+    held := NewBitSet(uint32(heap.MaxObjectId) + 1)
+    if stringClass != nil {
+        for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+            if heap.objectCids[oid] == stringClass.Cid {
+                candidates = append(candidates, oid)
+                if value := heap.refField(oid, stringClass, "value"); value != 0 {
+                    held.Set(uint32(value))
+                }
+            }
+        }
+    }
+    for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+        if isArray.Has(uint32(heap.objectCids[oid])) && !held.Has(uint32(oid)) {
+            candidates = append(candidates, oid)
+        }
+    }
+
+    // Partition the candidates among the CPUs, each with its own mapped section.
+
+    hashes := make([]uint64, len(candidates))
+    sizes := make([]uint64, len(candidates))
+    numWorkers := runtime.NumCPU()
+    chunk := (len(candidates) + numWorkers - 1) / numWorkers
+    errs := make([]error, numWorkers)
+
+    var wg sync.WaitGroup
+    for start := 0; start < len(candidates); start += chunk {
+        end := start + chunk
+        if end > len(candidates) {
+            end = len(candidates)
+        }
+        wg.Add(1)
+        go func(start, end int, err *error) {
+            defer wg.Done()
+            defer recoverReadError(err)
+            in := heap.file.MapAt(heap.objectOffsets[candidates[start]])
+            defer in.unmap()
+            for i := start; i < end; i++ {
+                hashes[i], sizes[i] = heap.hashContents(in, candidates[i])
+            }
+        }(start, end, &errs[start / chunk])
+    }
+    wg.Wait()
+    for _, err := range errs {
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    // Sort by class & hash, then each run of two or more is a group.
+
+    order := make([]int, len(candidates))
+    for i := range order {
+        order[i] = i
+    }
+    sort.Sort(&dupOrder{order, heap.objectCids, candidates, hashes, sizes})
+
+    groups = []*DupGroup{}
+    for i := 0; i < len(order); {
+        j := i + 1
+        first := order[i]
+        for j < len(order) && sizes[order[j]] == sizes[first] && hashes[order[j]] == hashes[first] &&
+                heap.objectCids[candidates[order[j]]] == heap.objectCids[candidates[first]] {
+            j++
+        }
+        if j - i > 1 && sizes[first] > 0 {
+            run := make([]ObjectId, 0, j - i)
+            for _, index := range order[i:j] {
+                run = append(run, candidates[index])
+            }
+            for _, members := range heap.sameContents(heap.seekObject(run[0]), run) {
+                if len(members) > 1 {
+                    group := &DupGroup{Class: heap.ClassOf(members[0]), Members: members, Size: sizes[first]}
+                    sort.Sort(oidList(group.Members))
+                    group.Wasted = uint64(len(group.Members) - 1) * group.Size
+                    groups = append(groups, group)
+                }
+            }
+        }
+        i = j
+    }
+
+    sort.Sort(dupsByWaste(groups))
+    return groups, nil
+}
+
+// Hash the contents of a string or primitive array, and return that plus its
+// size; size is 0 if there's nothing to hash.
+//
+func (heap *Heap) hashContents(in *MappedSection, oid ObjectId) (uint64, uint64) {
+    data, size := heap.contents(in, oid)
+    if size == 0 {
+        return 0, 0
+    }
+    hash := fnv.New64a()
+    hash.Write(data)
+    return hash.Sum64(), size
+}
+
+// Return the contents of a string (as UTF-8) or primitive array, and its size
+// including the value array for strings; size is 0 if there's nothing to
+// compare.  Array contents are only valid until the next read from the section.
+//
+func (heap *Heap) contents(in *MappedSection, oid ObjectId) ([]byte, uint64) {
+    class := heap.ClassOf(oid)
+    if !class.IsArray() {
+        text, ok := heap.stringValue(in, oid)
+        if !ok {
+            return nil, 0
+        }
+        value := heap.refField(oid, class, "value")
+        return []byte(text), uint64(heap.objectSizes[oid]) + uint64(heap.objectSizes[value])
+    }
+    jtype, data := heap.primitiveArray(in, oid)
+    if jtype == nil {
+        return nil, 0
+    }
+    return data, uint64(heap.objectSizes[oid])
+}
+
+// Split objects with the same class, size & content hash into sets with truly
+// identical contents, since different contents can hash the same.
+//
+func (heap *Heap) sameContents(in *MappedSection, oids []ObjectId) [][]ObjectId {
+    sets := [][]ObjectId{}
+    contents := [][]byte{}
+    for _, oid := range oids {
+        data, _ := heap.contents(in, oid)
+        found := false
+        for i, other := range contents {
+            if bytes.Equal(data, other) {
+                sets[i] = append(sets[i], oid)
+                found = true
+                break
+            }
+        }
+        if !found {
+            sets = append(sets, []ObjectId{oid})
+            contents = append(contents, append([]byte{}, data...))
+        }
+    }
+    return sets
+}
+
+// Print the top duplicate groups: count, wasted bytes, class and a sample of
+// the contents, then a few of the objects referring to the group.
+//
+func (heap *Heap) PrintDuplicates(out ReportWriter, groups []*DupGroup, limit int) {
+
+    totalCount := 0
+    totalWasted := uint64(0)
+    for _, group := range groups {
+        totalCount += len(group.Members)
+        totalWasted += group.Wasted
+    }
+
+    out.Begin("dups", Column{"count", "%10v"}, Column{"wasted", "%10v"}, Column{"class", "%v"},
+              Column{"sample", "%v"})
+    for i, group := range groups {
+        if i == limit {
+            break
+        }
+        sample := ""
+        first := group.Members[0]
+        if text, ok := heap.StringValue(first); ok {
+            if runes := []rune(text); len(runes) > MaxShowText {
+                text = string(runes[:MaxShowText]) + "..."
+            }
+            sample = strconv.Quote(text)
+        } else if jtype, data := heap.primitiveArray(heap.seekObject(first), first); jtype != nil {
+            sample = fmt.Sprintf("length %d", len(data) / int(jtype.Size))
+        }
+        out.Row(len(group.Members), group.Wasted, group.Class.Name, sample)
+
+        shown := 0
+        for _, member := range group.Members {
+            for src, pos := heap.InEdges(member); pos != 0 && shown < MaxDupReferrers; src, pos = heap.NextInEdge(pos) {
+                out.Note("%21s <- %d %s via %s", "", src, heap.ClassOf(src).Name,
+                         heap.EdgeName(src, heap.InLabel(pos)))
+                shown++
+            }
+            if shown == MaxDupReferrers {
+                break
+            }
+        }
+    }
+
+    out.Total(totalCount, totalWasted, "total", "")
+}
+
+// Sort candidate indices for FindDuplicates
+//
+type dupOrder struct {
+    order []int
+    cids []ClassId
+    oids []ObjectId
+    hashes []uint64
+    sizes []uint64
+}
+
+func (d *dupOrder) Len() int { return len(d.order) }
+func (d *dupOrder) Swap(i, j int) { d.order[i], d.order[j] = d.order[j], d.order[i] }
+
+func (d *dupOrder) Less(i, j int) bool {
+    a, b := d.order[i], d.order[j]
+    if ca, cb := d.cids[d.oids[a]], d.cids[d.oids[b]]; ca != cb {
+        return ca < cb
+    }
+    if d.hashes[a] != d.hashes[b] {
+        return d.hashes[a] < d.hashes[b]
+    }
+    return d.sizes[a] < d.sizes[b]
+}
+
+// Sort duplicate groups by wasted bytes, largest first
+//
+type dupsByWaste []*DupGroup
+func (d dupsByWaste) Len() int { return len(d) }
+func (d dupsByWaste) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d dupsByWaste) Less(i, j int) bool { return d[i].Wasted > d[j].Wasted }
+
+// Sort object ids
+//
+type oidList []ObjectId
+func (o oidList) Len() int { return len(o) }
+func (o oidList) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o oidList) Less(i, j int) bool { return o[i] < o[j] }
@@ -0,0 +1,142 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+
+package main
+
+import (
+    "math/rand"
+    "strconv"
+)
+
+// Build a heap dump shaped like the one genheap.sh gets from com.myco.GenHeap
+// on a 1.7 JVM, so tests can run without one: a GenHeap whose HashMap holds
+// ArrayLists of Things, each with an Integer value, plus the main thread asleep
+// in gen(), with its locals.  Like jmap, writes no START_THREAD records.
+//
+func BuildGenHeap(passes int) *HProfWriter {
+
+    w := NewHProfWriter(8)
+    integer := w.DefineClass("java.lang.Integer", nil, WField{"value", "int"})
+    integerCache := w.DefineClass("java.lang.Integer$IntegerCache", nil)
+    random := w.DefineClass("java.util.Random", nil, WField{"nextNextGaussian", "double"},
+                            WField{"haveNextNextGaussian", "boolean"})
+    abstractList := w.DefineClass("java.util.AbstractList", nil, WField{"modCount", "int"})
+    arrayList := w.DefineClass("java.util.ArrayList", abstractList,
+                               WField{"elementData", "java.lang.Object[]"}, WField{"size", "int"})
+    entry := w.DefineClass("java.util.HashMap$Entry", nil, WField{"key", "java.lang.Object"},
+                           WField{"value", "java.lang.Object"}, WField{"next", "java.util.HashMap$Entry"},
+                           WField{"hash", "int"})
+    hashMap := w.DefineClass("java.util.HashMap", nil, WField{"table", "java.util.HashMap$Entry[]"},
+                             WField{"size", "int"}, WField{"threshold", "int"})
+    genHeap := w.DefineClass("com.myco.GenHeap", nil, WField{"m", "java.util.Map"}, WField{"passes", "int"})
+    thing := w.DefineClass("com.myco.GenHeap$Thing", nil, WField{"value", "java.lang.Integer"},
+                           WField{"this$0", "com.myco.GenHeap"})
+    thread := w.DefineClass("java.lang.Thread", nil, WField{"name", "char[]"}, WField{"priority", "int"},
+                            WField{"daemon", "boolean"})
+
+    // Boxing goes through Integer.valueOf, which shares instances of small values.
+
+    cache := make([]HeapId, 256)
+    for i := range cache {
+        cache[i] = w.AddInstance(integer, map[string]interface{}{"value": int32(i - 128)})
+    }
+    w.AddStatic(integerCache, "cache", "java.lang.Integer[]", w.AddObjectArray("java.lang.Integer", cache))
+    w.AddRoot(0x05, integerCache.Hid)
+    valueOf := func(i int) HeapId {
+        if i >= -128 && i < 128 {
+            return cache[i + 128]
+        }
+        return w.AddInstance(integer, map[string]interface{}{"value": int32(i)})
+    }
+
+    // ArrayList grows its array by half as elements are added, from 10.
+
+    newList := func(elements []HeapId) HeapId {
+        capacity := 10
+        for capacity < len(elements) {
+            capacity += capacity >> 1
+        }
+        data := make([]HeapId, capacity)
+        copy(data, elements)
+        return w.AddInstance(arrayList, map[string]interface{}{
+            "elementData": w.AddObjectArray("java.lang.Object", data),
+            "size": int32(len(elements)), "modCount": int32(len(elements))})
+    }
+
+    // Same loop as GenHeap.gen(), but with a fixed seed.  The GenHeap and its
+    // map are written last, since they refer to everything else.
+
+    g, m := w.ReserveId(), w.ReserveId()
+    rnd := w.AddInstance(random, nil)
+    type mapping struct {
+        key int
+        value HeapId
+    }
+    source := rand.New(rand.NewSource(1))
+    mappings := []mapping{}
+    list := []HeapId{}
+
+    for i := 0; i < passes; i++ {
+        list = append(list, w.AddInstance(thing, map[string]interface{}{"value": valueOf(i), "this$0": g}))
+        if source.Intn(10) == 0 {
+            mappings = append(mappings, mapping{i, newList(list)})
+            list = nil
+        }
+    }
+    last := newList(list)
+
+    // HashMap doubles its table from 16 to stay under 3/4 full, and adds each
+    // entry at the head of its bucket.
+
+    table := make([]HeapId, 16)
+    for len(mappings) >= len(table) * 3 / 4 {
+        table = make([]HeapId, len(table) * 2)
+    }
+    for _, mapping := range mappings {
+        slot := mapping.key & (len(table) - 1)
+        table[slot] = w.AddInstance(entry, map[string]interface{}{
+            "key": valueOf(mapping.key), "value": mapping.value, "next": table[slot], "hash": int32(mapping.key)})
+    }
+    w.AddInstanceAt(m, hashMap, map[string]interface{}{
+        "table": w.AddObjectArray("java.util.HashMap$Entry", table), "size": int32(len(mappings)),
+        "threshold": int32(len(table) * 3 / 4)})
+    w.AddInstanceAt(g, genHeap, map[string]interface{}{"m": m, "passes": int32(passes)})
+    args := w.AddObjectArray("java.lang.String", []HeapId{w.AddString(strconv.Itoa(passes))})
+
+    // The main thread, asleep in gen(), and the locals of each frame
+
+    name := w.AddPrimitiveArray("char", []uint16{'m', 'a', 'i', 'n'})
+    main := w.AddInstance(thread, map[string]interface{}{"name": name, "priority": int32(5)})
+    w.AddStackTrace(1, 1, w.AddStackFrame(thread, "sleep", "", -3),
+                    w.AddStackFrame(genHeap, "gen", "GenHeap.java", 65),
+                    w.AddStackFrame(genHeap, "main", "GenHeap.java", 70))
+    w.AddRoot(0x08, main, 1, 1)
+    for _, local := range []HeapId{g, rnd, last} {
+        w.AddRoot(0x03, local, 1, 1)
+    }
+    for _, local := range []HeapId{args, g} {
+        w.AddRoot(0x03, local, 1, 2)
+    }
+
+    return w
+}
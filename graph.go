@@ -27,7 +27,8 @@ import (
 )
 
 // Implements an adjacency-list graph representation with all lists merged to a
-// single slice for minimal mark/sweep overhead.
+// single slice for minimal mark/sweep overhead.  Edges may optionally carry a
+// label; the graph doesn't interpret it.
 //
 type Graph struct {
     // max node id
@@ -48,12 +49,20 @@ type EdgeSet struct {
     offsets []int
     // Indicates which offsets are the start of a node's edge list
     isStart []bool
+    // Label of each edge, parallel to edges, or nil if unlabeled
+    labels []uint32
 }
 
 // Use this form to create a Graph if only the source and destination nodes are
 // known for each edge.
 //
 func NewGraph(src []ObjectId, dst[]ObjectId) *Graph {
+    return NewLabeledGraph(src, dst, nil)
+}
+
+// Same as NewGraph but with a label for each edge.
+//
+func NewLabeledGraph(src []ObjectId, dst []ObjectId, labels []uint32) *Graph {
 
     srcMax := ObjectId(0)
     dstMax := ObjectId(0)
@@ -80,13 +89,13 @@ func NewGraph(src []ObjectId, dst[]ObjectId) *Graph {
         srcMax = dstMax
     }
 
-    return NewGraphWithMax(src, dst, srcMax)
+    return NewGraphWithMax(src, dst, labels, srcMax)
 }
 
 // Use this form to create a Graph if the source and destination nodes + the
-// maximum node ID are known.
+// maximum node ID are known.  Labels may be nil.
 //
-func NewGraphWithMax(src []ObjectId, dst []ObjectId, maxNode ObjectId) * Graph {
+func NewGraphWithMax(src []ObjectId, dst []ObjectId, labels []uint32, maxNode ObjectId) * Graph {
 
     var srcCounts []int
     var dstCounts []int
@@ -107,25 +116,26 @@ func NewGraphWithMax(src []ObjectId, dst []ObjectId, maxNode ObjectId) * Graph {
     go counter(dst, &dstCounts)
     wg.Wait()
 
-    return NewGraphWithCounts(maxNode, src, dst, srcCounts, dstCounts)
+    return NewGraphWithCounts(maxNode, src, dst, labels, srcCounts, dstCounts)
 }
 
 // Use this form to create a Graph if the source and destination nodes + the
 // edge counts from each source & destination are known.  Modifies count arrays.
+// Labels may be nil.
 //
-func NewGraphWithCounts(maxNode ObjectId, src, dst []ObjectId, srcCounts, dstCounts []int) *Graph {
+func NewGraphWithCounts(maxNode ObjectId, src, dst []ObjectId, labels []uint32, srcCounts, dstCounts []int) *Graph {
 
     g := &Graph{MaxNode: maxNode}
     var wg sync.WaitGroup
     wg.Add(2)
 
     go func() {
-        g.outs = newEdgeSet(src, dst, srcCounts)
+        g.outs = newEdgeSet(src, dst, labels, srcCounts)
         wg.Done()
     }()
 
     go func() {
-        g.ins = newEdgeSet(dst, src, dstCounts)
+        g.ins = newEdgeSet(dst, src, labels, dstCounts)
         wg.Done()
     }()
 
@@ -147,6 +157,12 @@ func (g *Graph) NextOutEdge(pos int) (ObjectId, int) {
     return g.outs.next(pos)
 }
 
+// Return the label of the out edge at a position returned by OutEdges / NextOutEdge.
+//
+func (g *Graph) OutLabel(pos int) uint32 {
+    return g.outs.labels[pos]
+}
+
 // Walk the in edges of a node, e.g.
 //
 //     for node, pos := g.InEdges(n); pos != 0; node, pos := g.NextInEdge(pos) {
@@ -161,10 +177,16 @@ func (g *Graph) NextInEdge(pos int) (ObjectId, int) {
     return g.ins.next(pos)
 }
 
+// Return the label of the in edge at a position returned by InEdges / NextInEdge.
+//
+func (g *Graph) InLabel(pos int) uint32 {
+    return g.ins.labels[pos]
+}
+
 // Create an edge set.  Overwrites the count array as a side effect (sorry but
 // these get huge and I don't want to waste temp memory on a copy.)
 //
-func newEdgeSet(src []ObjectId, dst []ObjectId, counts []int) *EdgeSet {
+func newEdgeSet(src []ObjectId, dst []ObjectId, labels []uint32, counts []int) *EdgeSet {
 
     e := &EdgeSet {
         edges: make([]ObjectId, len(src) + 1), // 1 entry per edge, index 0 not used
@@ -186,9 +208,17 @@ func newEdgeSet(src []ObjectId, dst []ObjectId, counts []int) *EdgeSet {
 
     // Populate the edge lists
 
+    if labels != nil {
+        e.labels = make([]uint32, len(e.edges))
+    }
+
     for i, node := range src {
         counts[node]--
-        e.edges[e.offsets[node] + counts[node]] = dst[i]
+        pos := e.offsets[node] + counts[node]
+        e.edges[pos] = dst[i]
+        if labels != nil {
+            e.labels[pos] = labels[i]
+        }
     }
 
     return e
@@ -198,6 +228,9 @@ func newEdgeSet(src []ObjectId, dst []ObjectId, counts []int) *EdgeSet {
 // there are no edges from this node.
 //
 func (e *EdgeSet) walk(node ObjectId) (ObjectId, int) {
+    if int(node) >= len(e.offsets) {
+        return 0, 0 // past MaxNode, so no edges
+    }
     offset := e.offsets[node]
     if offset == 0 {
         return 0, 0
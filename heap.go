@@ -48,8 +48,10 @@ type Heap struct {
     IdSize uint32
     // static strings from UTF8 records
     strings map[HeapId]string
-    // heap IDs of GC roots
-    gcRoots []HeapId
+    // GC roots, in the order read
+    gcRoots []*GCRoot
+    // distinct object IDs of same, resolved during PostProcess
+    roots []ObjectId
     // highest class id assigned, 1-based
     MaxClassId uint32
     // class defs indexed by cid
@@ -61,12 +63,30 @@ type Heap struct {
     classesByName map[string]*ClassDef
     // same, by native heap id
     classesByHid map[HeapId]*ClassDef
+    // same, by object id of the class object
+    classesByOid map[ObjectId]*ClassDef
+    // LOAD_CLASS serial numbers to class heap ids
+    classSerials map[uint32]HeapId
+    // STACK_FRAME records by frame id
+    stackFrames map[HeapId]*StackFrame
+    // STACK_TRACE records by serial number
+    stackTraces map[uint32]*StackTrace
+    // threads, ordered by serial number after PostProcess
+    threads []*Thread
     // highect object ID assigned, 1-based
     MaxObjectId ObjectId
     // object cids, indexed by synthetic object id
     objectCids []ClassId
     // object sizes, indexed by same
     objectSizes []uint32
+    // file offsets of object records, indexed by same
+    objectOffsets []uint64
+    // object heap ids, indexed by same, if Options.NeedHids
+    objectHids []HeapId
+    // the heap dump, kept open so objects can be inspected after loading
+    file *MappedFile
+    // section of same for reading object data; see seekObject()
+    section *MappedSection
     // temporary mapping from HeapIds to ObjectIds
     objectMap *ObjectMap
     // maps java value type tags to JType objects
@@ -79,6 +99,33 @@ type Heap struct {
     skipIds []int
     // object graph
     *Graph
+    // dominator tree, computed on demand by Dominators()
+    dominators *Dominators
+    // what couldn't be read, if Options.Lenient
+    Losses
+    // references to objects not in the dump, left out of the Graph
+    dangling []DanglingRef
+}
+
+// What a lenient read left out of a heap.
+//
+type Losses struct {
+    // true if the dump was cut off
+    Truncated bool
+    // number of records & sub-records skipped, and bytes in them
+    SkippedRecords int
+    DroppedBytes uint64
+    // references to objects that aren't in the dump
+    DanglingRefs int
+    // names (or heap ids, if no LOAD_CLASS) of classes with no CLASS_DUMP
+    MissingClasses []string
+}
+
+// Return true if anything was lost apart from dangling references, which even a
+// complete dump may have.
+//
+func (losses *Losses) Any() bool {
+    return losses.Truncated || losses.SkippedRecords > 0 || len(losses.MissingClasses) > 0
 }
 
 func NewHeap(idSize uint32) *Heap {
@@ -86,18 +133,23 @@ func NewHeap(idSize uint32) *Heap {
 
         IdSize: idSize,
         strings: make(map[HeapId]string, 100000),           // good enough
-        gcRoots: make([]HeapId, 0, 10000),                  // good enough
+        gcRoots: make([]*GCRoot, 0, 10000),                 // good enough
 
         MaxClassId: 0,
         classes: []*ClassDef{nil},                          // leave room for entry [0]
         classNames: make(map[HeapId]HeapId, 50000),         // handles most heaps
         classesByName: make(map[string]*ClassDef, 50000),   // good enough
         classesByHid: make(map[HeapId]*ClassDef, 50000),
+        classesByOid: make(map[ObjectId]*ClassDef, 50000),
+        classSerials: make(map[uint32]HeapId, 50000),
+        stackFrames: make(map[HeapId]*StackFrame),
+        stackTraces: make(map[uint32]*StackTrace),
 
         MaxObjectId: 0,
         // TODO size accurately
         objectCids: make([]ClassId, 1, 10000000),           // entry[0] not used
         objectSizes: make([]uint32, 1, 10000000),           // entry[0] not used
+        objectOffsets: make([]uint64, 1, 10000000),         // entry[0] not used
         objectMap: &ObjectMap{},
 
         autoPrefixes: []string {
@@ -125,6 +177,7 @@ func NewHeap(idSize uint32) *Heap {
         skipNames: nil,
         skipIds: nil,
         Graph: nil,
+        dominators: nil,
     }
 }
 
@@ -168,16 +221,16 @@ func (heap *Heap) ClassNameId(hid HeapId) HeapId {
 // definitions if we've discovered one of the predefined primitive array types.
 //
 func (heap *Heap) AddClass(name string, hid HeapId, superHid HeapId, fieldNames []string, 
-                            fieldTypes []*JType, staticRefs []HeapId) *ClassDef {
+                            fieldTypes []*JType, staticRefs []HeapId, staticNames []string) *ClassDef {
 
     dname := Demangle(name)
     class := heap.classesByName[dname]
     if class != nil {
-        log.Fatalf("Class named %s already defined\n", dname)
+        panic(newReadError(ErrDuplicateClass, "class named %s already defined", dname))
     }
     class = heap.classesByHid[hid]
     if class != nil {
-        log.Fatalf("Class with HID %d already defined as %s\n", hid, class.Name)
+        panic(newReadError(ErrDuplicateClass, "class with hid %#x already defined as %s", hid, class.Name))
     }
 
     heap.MaxClassId += 1
@@ -192,7 +245,7 @@ func (heap *Heap) AddClass(name string, hid HeapId, superHid HeapId, fieldNames
         offset += fields[i].JType.Size
     }
 
-    class = NewClassDef(heap, dname, ClassId(cid), hid, superHid, fields, staticRefs)
+    class = NewClassDef(heap, dname, ClassId(cid), hid, superHid, fields, staticRefs, staticNames)
     heap.classes = append(heap.classes, class)
     heap.classesByName[dname] = class
     heap.classesByHid[hid] = class
@@ -213,16 +266,45 @@ func (heap *Heap) AddClass(name string, hid HeapId, superHid HeapId, fieldNames
 }
 
 // Note a class instance, incrementing MaxObjectId and binding it to its class
-// definition.  Does not record anything about the instance data.
+// definition.  Records only where the instance data is found in the heap dump.
 //
-func (heap *Heap) AddInstance(hid HeapId, class *ClassDef, size uint32) ObjectId {
+func (heap *Heap) AddInstance(hid HeapId, class *ClassDef, size uint32, offset uint64) ObjectId {
     heap.MaxObjectId++
     heap.objectCids = append(heap.objectCids, class.Cid)
     heap.objectSizes = append(heap.objectSizes, size)
+    heap.objectOffsets = append(heap.objectOffsets, offset)
+    if heap.objectHids != nil {
+        heap.objectHids = append(heap.objectHids, hid)
+    }
     heap.objectMap.Add(hid, heap.MaxObjectId)
     return heap.MaxObjectId
 }
 
+// Note the class object for a class definition.  Like AddInstance, but the class
+// of a class object is java.lang.Class, which may not have been read yet, so
+// PostProcess fills it in.
+//
+func (heap *Heap) AddClassObject(class *ClassDef, size uint32, offset uint64) ObjectId {
+    heap.MaxObjectId++
+    heap.objectCids = append(heap.objectCids, 0)
+    heap.objectSizes = append(heap.objectSizes, size)
+    heap.objectOffsets = append(heap.objectOffsets, offset)
+    if heap.objectHids != nil {
+        heap.objectHids = append(heap.objectHids, class.Hid)
+    }
+    heap.objectMap.Add(class.Hid, heap.MaxObjectId)
+    class.Oid = heap.MaxObjectId
+    heap.classesByOid[class.Oid] = class
+    return class.Oid
+}
+
+// Return the ClassDef for which an object is the class object, or nil if it's
+// not a class object.
+//
+func (heap *Heap) ClassForObject(oid ObjectId) *ClassDef {
+    return heap.classesByOid[oid]
+}
+
 // Return the ClassDef with the given name, or nil if none.
 // Uses auto-prefix list to resolve unqualified names.
 //
@@ -244,14 +326,59 @@ func (heap *Heap) ClassNamed(name string) *ClassDef {
 //
 func (heap *Heap) PostProcess(sr *SegReader) {
 
+    // Stop the segment workers first so none are left running if there's an
+    // error below.
+
+    var bags []*RefBag
+    if sr != nil {
+        var err error
+        bags, err = sr.close()
+        if err != nil {
+            panic(err)
+        }
+    }
+
     heap.objectMap.PostProcess()
 
+    // Now that all classes are known, bind class objects to java.lang.Class.
+    // Every real heap dump has it, but synthesize one just in case.
+
+    classClass := heap.ClassNamed("java.lang.Class")
+    if classClass == nil {
+        object := heap.ClassNamed("java.lang.Object")
+        if object == nil {
+            panic(newReadError(ErrBadRecord, "heap has no definition for java.lang.Object"))
+        }
+        classClass = heap.AddClass("java/lang/Class", 0, object.Hid, nil, nil, nil, nil)
+    }
+    for _, class := range heap.classes[1:] {
+        if class.Oid != 0 {
+            heap.objectCids[class.Oid] = classClass.Cid
+        }
+    }
+
+    heap.roots = make([]ObjectId, 0, len(heap.gcRoots))
+    seen := make(map[ObjectId]bool, len(heap.gcRoots))
+    for _, root := range heap.gcRoots {
+        root.Oid = heap.objectMap.Get(root.Hid)
+        if root.Oid != 0 && !seen[root.Oid] {
+            heap.roots = append(heap.roots, root.Oid)
+            seen[root.Oid] = true
+        }
+    }
+
+    for _, class := range heap.classes[1:] {
+        class.Loader = heap.objectMap.Get(class.LoaderHid)
+    }
+
+    heap.resolveThreads()
+
     if sr != nil {
-        bags := sr.close()
-        from, to := MergeBags(bags, func(hid HeapId) ObjectId {return heap.objectMap.Get(hid)})
-        log.Printf("%d references\n", len(from))
-        // TODO: add static references to graph
-        heap.Graph = NewGraph(from, to)
+        from, to, labels, dangling := MergeBags(bags, func(hid HeapId) ObjectId {return heap.objectMap.Get(hid)})
+        heap.dangling = dangling
+        heap.DanglingRefs = len(dangling)
+        log.Printf("%d references, %d dangling\n", len(from), heap.DanglingRefs)
+        heap.Graph = NewLabeledGraph(from, to, labels)
         bags = nil // allow gc
     }
 
@@ -263,6 +390,27 @@ func (heap *Heap) PostProcess(sr *SegReader) {
 
 }
 
+// Return the dominator tree, computing it on first use.  Requires the reference
+// graph.
+//
+func (heap *Heap) Dominators() *Dominators {
+    if heap.dominators == nil {
+        if heap.Graph == nil {
+            log.Fatalf("Dominators require the reference graph\n")
+        }
+        heap.dominators = NewDominators(heap.Graph, heap.MaxObjectId, heap.roots, heap.objectSizes)
+        log.Printf("%d objects reachable from %d roots\n", heap.dominators.NumReachable(), len(heap.roots))
+    }
+    return heap.dominators
+}
+
+// Return the retained size of an object, i.e. the total size of all objects
+// it dominates including itself.
+//
+func (heap *Heap) RetainedSizeOf(oid ObjectId) uint64 {
+    return heap.Dominators().RetainedSize(oid)
+}
+
 // Return the ClassDef with the given cid, or nil if none.
 //
 func (heap *Heap) HidClass(hid HeapId) *ClassDef {
@@ -280,6 +428,24 @@ func (heap *Heap) ClassOf(oid ObjectId) *ClassDef {
     return class
 }
 
+// Return the name of a reference from an object, given the edge label from the
+// Graph: the field name for an instance or class object, or the index for an array.
+//
+func (heap *Heap) EdgeName(oid ObjectId, label uint32) string {
+    if def := heap.ClassForObject(oid); def != nil {
+        return def.StaticRefName(label)
+    }
+    class := heap.ClassOf(oid)
+    if class.IsArray() {
+        return fmt.Sprintf("[%d]", label)
+    }
+    fields := class.RefFields()
+    if int(label) < len(fields) {
+        return fields[label].Name
+    }
+    return "?"
+}
+
 // Return the size for a given object id
 //
 func (heap *Heap) SizeOf(oid ObjectId) uint32 {
@@ -343,6 +509,7 @@ func (heap *Heap) WithClassesMatching(name string, f func(*ClassDef)) {
 func (heap *Heap) NewHisto() *Histo {
     return &Histo{
         heap: heap,
+        groupName: "class",
         counts: make([]*ClassCount, heap.MaxClassId + 1), // 1-based
         known: NewBitSet(uint32(heap.MaxObjectId) + 1), // 1-based
     }
@@ -25,7 +25,6 @@ package main
 import (
     "bytes"
     "fmt"
-    "io"
     "sort"
 )
 
@@ -34,16 +33,27 @@ import (
 //
 type Histo struct {
     heap *Heap
+    // what the slots are, for the report column; "class" or "loader"
+    groupName string
     // counts indexed by class ID
     counts []*ClassCount
     // indicates what objects we've seen
     known BitSet
+    // true if retained sizes have been filled in by AddRetained
+    hasRetained bool
+    // total retained size, for the summary line
+    totalRetained uint64
+    // don't print groups smaller than this, by retained size if known
+    minSize uint64
+    // print order, one of the choices for the "sort" setting
+    sortBy string
 }
 
 type ClassCount struct {
     name []byte
     count uint32
     nbytes uint64
+    retained uint64
 }
 
 // Support sort weirdness. :-(
@@ -62,23 +72,74 @@ func (cc classCounts) Less(i, j int) bool {
     return bytes.Compare(cc[i].name, cc[j].name) < 0
 }
 
+// Same, but sort on count
+//
+type countedCounts struct { classCounts }
+
+func (cc countedCounts) Less(i, j int) bool {
+    c := cc.classCounts
+    if c[i].count != c[j].count {
+        return c[i].count > c[j].count
+    }
+    return c.Less(i, j)
+}
+
+// Same, but sort on name
+//
+type namedCounts struct { classCounts }
+
+func (nc namedCounts) Less(i, j int) bool {
+    return bytes.Compare(nc.classCounts[i].name, nc.classCounts[j].name) < 0
+}
+
+// Same, but sort on retained size
+//
+type retainedCounts struct { classCounts }
+
+func (rc retainedCounts) Less(i, j int) bool {
+    cc := rc.classCounts
+    if cc[i].retained != cc[j].retained {
+        return cc[i].retained > cc[j].retained
+    }
+    return cc.Less(i, j)
+}
+
 // Add an object if not already known.
 //
 func (h *Histo) Add(oid ObjectId, class *ClassDef, size uint32) {
+    h.addTo(oid, int(class.Cid), class.Name, size)
+}
+
+// Add an object to an arbitrary slot if not already known.
+//
+func (h *Histo) addTo(oid ObjectId, index int, name string, size uint32) {
     id := uint32(oid)
     if h.known.Has(id) {
         return
     }
     h.known.Set(id)
-    slot := h.counts[class.Cid]
+    slot := h.counts[index]
     if slot == nil {
-        slot = &ClassCount{name: []byte(class.Name)}
-        h.counts[class.Cid] = slot
+        slot = &ClassCount{name: []byte(name)}
+        h.counts[index] = slot
     }
     slot.count++
     slot.nbytes += uint64(size)
 }
 
+// Fill in retained sizes given the retained size of each slot (as computed by
+// Dominators.GroupRetained) and the total retained size of the heap.
+//
+func (h *Histo) AddRetained(retained []uint64, total uint64) {
+    for i, slot := range h.counts {
+        if slot != nil {
+            slot.retained = retained[i]
+        }
+    }
+    h.hasRetained = true
+    h.totalRetained = total
+}
+
 // Return count, nbytes for a class.
 //
 func (h *Histo) Counts(class *ClassDef) (uint32, uint64) {
@@ -98,9 +159,16 @@ func (h *Histo) Collect(oids []ObjectId) {
     h.Add(member, h.heap.ClassOf(group), h.heap.SizeOf(member))
 }
 
+// Set the minimum group size and sort order for Print; see DefaultSettings.
+//
+func (h *Histo) SetOptions(minSize uint64, sortBy string) {
+    h.minSize = minSize
+    h.sortBy = sortBy
+}
+
 // Print the histogram.
 //
-func (h *Histo) Print(out io.Writer) {
+func (h *Histo) Print(out ReportWriter) {
 
     // Some classes have no instances
     counts := []*ClassCount{}
@@ -109,16 +177,107 @@ func (h *Histo) Print(out io.Writer) {
             counts = append(counts, slot)
         }
     }
-    sort.Sort(classCounts(counts))
+    switch {
+        case h.sortBy == "count":
+            sort.Sort(countedCounts{counts})
+        case h.sortBy == "name":
+            sort.Sort(namedCounts{counts})
+        case h.hasRetained && h.sortBy != "bytes":
+            sort.Sort(retainedCounts{counts})
+        default:
+            sort.Sort(classCounts(counts))
+    }
 
     totalCount := uint32(0)
     totalBytes := uint64(0)
+    hidden := 0
+
+    if h.hasRetained {
+        out.Begin("histo", Column{"count", "%10v"}, Column{"bytes", "%10v"}, Column{"retained", "%10v"},
+                  Column{h.groupName, "%v"})
+    } else {
+        out.Begin("histo", Column{"count", "%10v"}, Column{"bytes", "%10v"}, Column{h.groupName, "%v"})
+    }
 
     for _, slot := range counts {
-        fmt.Fprintf(out, "%10d %10d %s\n", slot.count, slot.nbytes, string(slot.name))
         totalCount += slot.count
         totalBytes += slot.nbytes
+        if size := slot.nbytes; size < h.minSize && (! h.hasRetained || slot.retained < h.minSize) {
+            hidden++
+        } else if h.hasRetained {
+            out.Row(slot.count, slot.nbytes, slot.retained, string(slot.name))
+        } else {
+            out.Row(slot.count, slot.nbytes, string(slot.name))
+        }
+    }
+
+    if hidden > 0 {
+        out.Note("%21s (%d smaller than mingroupsize not shown)", "", hidden)
+    }
+
+    if h.hasRetained {
+        out.Total(totalCount, totalBytes, h.totalRetained, "total")
+    } else {
+        out.Total(totalCount, totalBytes, "total")
+    }
+}
+
+// Create a histogram of every object in the heap, a la 'jmap -histo'.
+//
+func (heap *Heap) ClassHisto() *Histo {
+    histo := heap.NewHisto()
+    for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+        histo.Add(oid, heap.ClassOf(oid), heap.SizeOf(oid))
+    }
+    return histo
+}
+
+// Create histograms of every object in the heap, with retained sizes, grouped by
+// class and by class loader.  Requires the reference graph.
+//
+func (heap *Heap) RetainedHistos() (*Histo, *Histo) {
+
+    doms := heap.Dominators()
+    byClass := heap.ClassHisto()
+    byClass.AddRetained(doms.GroupRetained(func(oid ObjectId) int {
+        return int(heap.objectCids[oid])
+    }, len(byClass.counts)), doms.ReachableSize())
+
+    // Number the loaders in order of appearance; 0 is the bootstrap loader.
+
+    loaderIndex := make(map[ObjectId]int)
+    classLoaders := make([]int, heap.MaxClassId + 1)
+    for _, class := range heap.classes[1:] {
+        index, ok := loaderIndex[class.Loader]
+        if !ok {
+            index = len(loaderIndex)
+            loaderIndex[class.Loader] = index
+        }
+        classLoaders[class.Cid] = index
+    }
+
+    loaderNames := make([]string, len(loaderIndex))
+    for loader, index := range loaderIndex {
+        if loader == 0 {
+            loaderNames[index] = "<bootstrap>"
+        } else {
+            loaderNames[index] = fmt.Sprintf("%s@%d", heap.ClassOf(loader).Name, loader)
+        }
+    }
+
+    byLoader := &Histo{
+        heap: heap,
+        groupName: "loader",
+        counts: make([]*ClassCount, len(loaderIndex)),
+        known: NewBitSet(uint32(heap.MaxObjectId) + 1),
+    }
+    for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+        index := classLoaders[heap.objectCids[oid]]
+        byLoader.addTo(oid, index, loaderNames[index], heap.SizeOf(oid))
     }
+    byLoader.AddRetained(doms.GroupRetained(func(oid ObjectId) int {
+        return classLoaders[heap.objectCids[oid]]
+    }, len(loaderIndex)), doms.ReachableSize())
 
-    fmt.Fprintf(out, "%10d %10d total\n", totalCount, totalBytes)
+    return byClass, byLoader
 }
@@ -23,10 +23,84 @@
 package main
 
 import (
+    "errors"
+    "fmt"
     "log"
+    "os"
     "runtime"
+    "sort"
 )
 
+// Kinds of ReadError
+//
+var (
+    // a record runs past the end of the file or its enclosing segment
+    ErrTruncated = errors.New("truncated heap dump")
+    // unknown record, sub-record or basic type tag
+    ErrUnknownTag = errors.New("unknown tag")
+    // a class is defined twice, by name or heap id
+    ErrDuplicateClass = errors.New("duplicate class")
+    // anything else inconsistent, like a bad header or a missing name
+    ErrBadRecord = errors.New("bad record")
+)
+
+// Tag value for a ReadError not in any record, e.g. in the file header.
+//
+const NoTag = -1
+
+// Size of the file header: version string & NUL, id size, timestamp
+//
+const HeaderSize = 19 + 4 + 8
+
+// An error reading a heap dump.  Err is one of the kinds above, or the error
+// from a failed mmap.
+//
+type ReadError struct {
+    Filename string
+    // file offset of the record or sub-record being read
+    Offset uint64
+    // its tag, or NoTag
+    Tag int
+    Err error
+    Detail string
+}
+
+func (e *ReadError) Error() string {
+    msg := e.Err.Error()
+    if e.Tag != NoTag {
+        msg += fmt.Sprintf(" in record type 0x%02x", e.Tag)
+    }
+    msg += fmt.Sprintf(" at offset %d", e.Offset)
+    if e.Detail != "" {
+        msg += ": " + e.Detail
+    }
+    if e.Filename != "" {
+        msg = e.Filename + ": " + msg
+    }
+    return msg
+}
+
+// Create a ReadError for code outside HProfReader that doesn't know where it
+// is in the file; the reader fills that in when it recovers the error.  To
+// keep the read loops simple, ReadErrors are raised with panic.
+//
+func newReadError(err error, format string, args ...interface{}) *ReadError {
+    return &ReadError{Tag: NoTag, Err: err, Detail: fmt.Sprintf(format, args...)}
+}
+
+// Recover a *ReadError panic into *err; other panics are passed on.  Use as
+// defer recoverReadError(&err)
+//
+func recoverReadError(err *error) {
+    if r := recover(); r != nil {
+        rerr, ok := r.(*ReadError)
+        if !ok {
+            panic(r)
+        }
+        *err = rerr
+    }
+}
+
 // Responsible for reading an HPROF binary heap dump and handing information off
 // to a Heap instance.  See also SegReader.
 //
@@ -45,172 +119,518 @@ type HProfReader struct {
     *Heap
     // segment reader, if needRefs is true
     *SegReader
+    // offset & tag of the record or sub-record being read, for ReadErrors
+    recordOffset uint64
+    recordTag int
+    // end of the record or segment being read; reads past this are truncated
+    limit uint64
+    // ends of the current record & sub-record once known, for skipping them
+    recordEnd uint64
+    subRecordEnd uint64
+    // set when a lenient read reaches the end of a truncated dump
+    stopped bool
+    // classes whose superclass chains are complete, for lenient reads
+    goodClasses map[ClassId]bool
+    // heap ids of classes found missing by a lenient read
+    missingHids map[HeapId]bool
+    numRecords int
+    numStrings int
 }
 
-func ReadHeapDump(filename string, options *Options) *Heap {
+// Read a heap dump, or its index if there's an up-to-date one.  Errors in the
+// dump itself are returned as a *ReadError.
+//
+func ReadHeapDump(filename string, options *Options) (*Heap, error) {
 
     mappedFile, err := MapFile(filename)
     if err != nil {
-        log.Fatal("Can't map %s: %s\n", filename, err)
+        return nil, err
     }
-    defer mappedFile.Close()
-
-    // Verify this is a real HPROF file & determine native ID size.
 
-    in := mappedFile.MapAt(0)
-    version := string(in.GetRaw(18))
-    in.Skip(1) // trailing NUL
+    // Use the index if there's an up-to-date one.
 
-    if version != "JAVA PROFILE 1.0.1" && version != "JAVA PROFILE 1.0.2" {
-        log.Fatalf("Unknown heap version %s\n", version)
+    indexName := IndexName(filename)
+    if !options.NoIndex {
+        heap, err := ReadIndex(mappedFile, indexName, options)
+        if err == nil {
+            log.Printf("Loaded index %s\n", indexName)
+            heap.file = mappedFile
+            heap.nameThreads()
+            return heap, nil
+        }
+        if !os.IsNotExist(err) {
+            log.Printf("Not using index: %s\n", err)
+        }
     }
 
+    // The file stays open for inspecting objects; see Heap.ShowObject.
+
     hprof := &HProfReader{
         Options: options,
         Filename: filename,
         MappedFile: mappedFile,
     }
 
+    heap, err := hprof.read(options)
+    if err != nil {
+        mappedFile.Close()
+        return nil, err
+    }
+    heap.file = mappedFile
+    heap.nameThreads()
+
+    // Only a full read is worth indexing; one without the graph is quick anyway,
+    // and would replace an index that has it.
+
+    if !options.NoIndex && options.NeedRefs && !heap.Losses.Any() {
+        if err := WriteIndex(heap, mappedFile, indexName); err != nil {
+            log.Printf("Can't write index %s: %s\n", indexName, err)
+        } else {
+            log.Printf("Wrote index %s\n", indexName)
+        }
+    }
+    return heap, nil
+}
+
+// Complete heap reader in one call.  Errors anywhere in the read, including
+// in Heap and the segment workers, are raised as *ReadError panics and end up
+// here; we stop the workers and return the error with its location filled in.
+//
+func (hprof *HProfReader) read(options *Options) (heap *Heap, err error) {
+
+    hprof.recordTag = NoTag
+    hprof.limit = hprof.Size
+
+    defer func() {
+        if err != nil {
+            rerr := err.(*ReadError)
+            hprof.locate(rerr)
+            if hprof.SegReader != nil {
+                hprof.SegReader.close()
+                hprof.SegReader = nil
+            }
+            heap = nil
+        }
+    }()
+    defer recoverReadError(&err)
+
+    in := hprof.readHeader()
     if options.NeedRefs {
         hprof.SegReader = NewSegReader(hprof)
     }
 
+    hprof.Heap = NewHeap(hprof.IdSize)
+    heap = hprof.Heap
+    if options.NeedHids {
+        heap.objectHids = make([]HeapId, 1, 10000000) // entry[0] not used
+    }
+    if options.Lenient {
+        hprof.goodClasses = make(map[ClassId]bool)
+        hprof.missingHids = make(map[HeapId]bool)
+    }
+
+    // TODO: keep input struct constant, don't return different one
+
+    for !hprof.stopped && in.Offset() < hprof.Size {
+        hprof.recordOffset = in.Offset()
+        hprof.recordTag = NoTag
+        hprof.recordEnd = 0
+        if err := hprof.try(func() { hprof.readRecord(in) }); err != nil {
+            hprof.lose(in, err, hprof.recordEnd, hprof.Size)
+        }
+    }
+
+    hprof.recordTag = NoTag
+    if options.Lenient {
+        hprof.repairClasses()
+    }
+    sr := hprof.SegReader
+    hprof.SegReader = nil // allow GC, and PostProcess closes it
+    heap.PostProcess(sr)
+    runtime.GC()
+
+    log.Printf("%d records, %d UTF8\n", hprof.numRecords, hprof.numStrings)
+    log.Printf("%d objects\n", heap.MaxObjectId)
+    if heap.Losses.Any() {
+        log.Printf("Lenient read dropped %d bytes in %d records, truncated %v, %d classes missing\n",
+                   heap.DroppedBytes, heap.SkippedRecords, heap.Truncated, len(heap.MissingClasses))
+    }
+
+    return heap, nil
+}
+
+// Verify this is a real HPROF file & determine native ID size.  Returns a
+// section positioned at the first record.
+//
+func (hprof *HProfReader) readHeader() *MappedSection {
+
+    if hprof.Size < HeaderSize {
+        hprof.fail(ErrTruncated, "no room for header in %d bytes", hprof.Size)
+    }
+    in := hprof.MapAt(0)
+    version := string(in.GetRaw(18))
+    in.Skip(1) // trailing NUL
+
+    if version != "JAVA PROFILE 1.0.1" && version != "JAVA PROFILE 1.0.2" {
+        hprof.fail(ErrBadRecord, "unknown heap version %q", version)
+    }
+
     hprof.IdSize = in.GetUInt32()
     if hprof.IdSize != 4 && hprof.IdSize != 8 {
-        log.Fatalf("Unknown reference size %d\n", hprof.IdSize)
+        hprof.fail(ErrBadRecord, "unknown reference size %d", hprof.IdSize)
     }
     hprof.longIds = hprof.IdSize == 8
     in.Skip(8) // skip timestamp
-
-    return hprof.read(in, options)
+    return in
 }
 
-// Complete heap reader in one call.  Most of the error conditions (like
-// unresolvable classes) cause panics BTW.
+// Read one top-level record.
 //
-func (hprof *HProfReader) read(in *MappedSection, options *Options) *Heap {
+func (hprof *HProfReader) readRecord(in *MappedSection) {
 
-    hprof.Heap = NewHeap(hprof.IdSize)
     heap := hprof.Heap
-
     headerSize := uint32(9)
-    numRecords := 0
-    numStrings := 0
+    hprof.numRecords++
+    hprof.limit = hprof.Size
+    hprof.demand(in, 1)
+    tag := in.GetByte()
+    hprof.recordTag = int(tag)
+    hprof.demand(in, headerSize - 1)
+    in.Skip(4) // Skip timestamp
+    length := in.GetUInt32()
 
-    // TODO: keep input struct constant, don't return different one
+    // A lenient read of a record that runs past the end of the file continues
+    // until a sub-record or field does.
+
+    hprof.recordEnd = in.Offset() + uint64(length)
+    if !hprof.Lenient || hprof.recordEnd <= hprof.Size {
+        hprof.need(in, uint64(length))
+        hprof.limit = hprof.recordEnd
+    }
+    // log.Printf("Record type %d len %d at %d\n", tag, length, in.Offset() - uint64(headerSize))
+
+    // A function table would be more efficient but there aren't
+    // that many top-level records compared to instance records.
+
+    switch tag {
+        case 0x01: // UTF8
+            hprof.numStrings++
+            if length < hprof.IdSize {
+                hprof.fail(ErrBadRecord, "UTF8 record of %d bytes", length)
+            }
+            hprof.demand(in, length)
+            hid := hprof.readId(in)
+            str := in.GetString(length - hprof.IdSize)
+            heap.AddString(hid, str)
+
+        case 0x02: // LOAD_CLASS
+            hprof.demand(in, 8 + 2 * hprof.IdSize)
+            classSerial := in.GetUInt32()
+            classHid := hprof.readId(in)
+            in.Skip(4) // skip stackSerial
+            nameHid := hprof.readId(in)
+            heap.AddClassName(classHid, nameHid)
+            heap.AddClassSerial(classSerial, classHid)
+
+        case 0x04: // STACK_FRAME
+            hprof.readStackFrame(in)
+
+        case 0x05: // STACK_TRACE
+            hprof.readStackTrace(in)
+
+        case 0x0a: // START_THREAD
+            hprof.readStartThread(in)
+
+        case 0x0c, 0x1c: // HEAP_DUMP, HEAP_DUMP_SEGMENT
+            log.Printf("Heap dump or segment of %d MB at %x", 
+                       length / 1048576, in.Offset() - uint64(headerSize))
+            hprof.readSegment(in, hprof.recordEnd)
+
+        case 0x03: // UNLOAD_CLASS
+            fallthrough
+        case 0x06: // ALLOC_SITES
+            fallthrough
+        case 0x07: // HEAP_SUMMARY
+            fallthrough
+        case 0x0b: // END_THREAD
+            fallthrough
+        case 0x0e: // CONTROL_SETTINGS
+            fallthrough
+        case 0x2c: // HEAP_DUMP_END
+            in.Skip(length)
+
+        default:
+            hprof.fail(ErrUnknownTag, "unknown record type")
+    }
+}
+
+// Fill in the location of a ReadError raised outside HProfReader.
+//
+func (hprof *HProfReader) locate(err *ReadError) {
+    if err.Tag == NoTag && hprof.recordTag != NoTag {
+        err.Offset, err.Tag = hprof.recordOffset, hprof.recordTag
+    }
+    err.Filename = hprof.Filename
+}
+
+// Raise a ReadError for the record being read.
+//
+func (hprof *HProfReader) fail(err error, format string, args ...interface{}) {
+    panic(&ReadError{
+        Offset: hprof.recordOffset,
+        Tag: hprof.recordTag,
+        Err: err,
+        Detail: fmt.Sprintf(format, args...),
+    })
+}
 
-    for in.Demand(headerSize) {
-
-        numRecords++
-        tag := in.GetByte()
-        in.Skip(4) // Skip timestamp
-        length := in.GetUInt32()
-        // log.Printf("Record type %d len %d at %d\n", tag, length, in.Offset() - uint64(headerSize))
-
-        // A function table would be more efficient but there aren't
-        // that many top-level records compared to instance records.
-
-        switch tag {
-            case 0x01: // UTF8
-                numStrings++
-                hid := hprof.readId(in)
-                str := in.GetString(length - hprof.IdSize)
-                heap.AddString(hid, str)
-
-            case 0x02: // LOAD_CLASS
-                in.Skip(4) // skip classSerial
-                classHid := hprof.readId(in)
-                in.Skip(4) // skip stackSerial
-                nameHid := hprof.readId(in)
-                heap.AddClassName(classHid, nameHid)
-
-            case 0x0c, 0x1c: // HEAP_DUMP, HEAP_DUMP_SEGMENT
-                log.Printf("Heap dump or segment of %d MB at %x", 
-                           length / 1048576, in.Offset() - uint64(headerSize))
-                numRecords += hprof.readSegment(in, length)
-
-            case 0x03: // UNLOAD_CLASS
-                fallthrough
-            case 0x04: // STACK_FRAME
-                fallthrough
-            case 0x05: // STACK_TRACE
-                fallthrough
-            case 0x06: // ALLOC_SITES
-                fallthrough
-            case 0x07: // HEAP_SUMMARY
-                fallthrough
-            case 0x0a: // START_THREAD
-                fallthrough
-            case 0x0b: // END_THREAD
-                fallthrough
-            case 0x0e: // CONTROL_SETTINGS
-                fallthrough
-            case 0x2c: // HEAP_DUMP_END
-                in.Skip(length)
-
-            default:
-                log.Fatalf("Unknown HPROF record type %d at %d\n", tag, in.Offset() - uint64(headerSize))
+// Fail with ErrTruncated unless count more bytes are left in the current record.
+//
+func (hprof *HProfReader) need(in *MappedSection, count uint64) {
+    if in.Offset() + count > hprof.limit {
+        hprof.fail(ErrTruncated, "need %d bytes, only %d left", count, hprof.limit - in.Offset())
+    }
+}
+
+// Same as MappedSection.Demand, but for an exact count that must fit in the
+// current record.
+//
+func (hprof *HProfReader) demand(in *MappedSection, count uint32) {
+    hprof.need(in, uint64(count))
+    in.Demand(count)
+}
+
+// Same as MappedSection.Skip, but the skipped bytes must fit in the current
+// record.
+//
+func (hprof *HProfReader) skip(in *MappedSection, count uint64) {
+    hprof.need(in, count)
+    in.Skip(uint32(count))
+}
+
+// Handle HEAP_DUMP or HEAP_DUMP_SEGMENT record, ending at the given offset.
+//
+func (hprof *HProfReader) readSegment(in *MappedSection, end uint64) {
+    for !hprof.stopped && in.Offset() < end {
+        hprof.recordOffset = in.Offset()
+        hprof.subRecordEnd = 0
+        if err := hprof.try(func() { hprof.readSubRecord(in) }); err != nil {
+            hprof.lose(in, err, hprof.subRecordEnd, end)
         }
     }
+}
 
-    heap.PostProcess(hprof.SegReader)
-    hprof.SegReader = nil // allow GC
-    runtime.GC()
+// Read one sub-record of a heap dump segment.
+//
+func (hprof *HProfReader) readSubRecord(in *MappedSection) {
+    hprof.numRecords++
+    hprof.demand(in, 1)
+    tag := in.GetByte()
+    hprof.recordTag = int(tag)
+    // log.Printf("tag %d\n", tag)
+    switch tag {
+        case 0x21: // INSTANCE_DUMP
+            hprof.readInstance(in)
+        case 0x22: // OBJECT_ARRAY
+            hprof.readArray(in, true)
+        case 0x23: // PRIMITIVE_ARRAY
+            hprof.readArray(in, false)
+        case 0x20: // CLASS_DUMP
+            hprof.readClassDump(in)
+        case 0x01: // ROOT_JNI_GLOBAL
+            hprof.readGCRoot(in, RootJNIGlobal)
+        case 0x02: // ROOT_JNI_LOCAL
+            hprof.readGCRoot(in, RootJNILocal)
+        case 0x03: // ROOT_JAVA_FRAME
+            hprof.readGCRoot(in, RootJavaFrame)
+        case 0x04: // ROOT_NATIVE_STACK
+            hprof.readGCRoot(in, RootNativeStack)
+        case 0x05: // ROOT_STICKY_CLASS
+            hprof.readGCRoot(in, RootStickyClass)
+        case 0x06: // ROOT_THREAD_BLOCK
+            hprof.readGCRoot(in, RootThreadBlock)
+        case 0x07: // ROOT_MONITOR_USED
+            hprof.readGCRoot(in, RootMonitorUsed)
+        case 0x08: // ROOT_THREAD_OBJECT
+            hprof.readGCRoot(in, RootThreadObject)
+        case 0xff: // ROOT_UNKNOWN
+            hprof.readGCRoot(in, RootUnknown)
+        default:
+            hprof.fail(ErrUnknownTag, "unknown heap dump sub-record type")
+    }
+}
 
-    log.Printf("%d records, %d UTF8\n", numRecords, numStrings)
-    log.Printf("%d objects\n", heap.MaxObjectId)
+// In a lenient read, run a record reader and return any ReadError it raises;
+// otherwise just run it.
+//
+func (hprof *HProfReader) try(reader func()) (err *ReadError) {
+    if hprof.Lenient {
+        defer func() {
+            if r := recover(); r != nil {
+                rerr, ok := r.(*ReadError)
+                if !ok {
+                    panic(r)
+                }
+                hprof.locate(rerr)
+                err = rerr
+            }
+        }()
+    }
+    reader()
+    return nil
+}
 
-    return heap
-}
-
-// Handle HEAP_DUMP or HEAP_DUMP_SEGMENT record.
-//
-func (hprof *HProfReader) readSegment(in *MappedSection, length uint32) int {
-    end := in.Offset() + uint64(length)
-    numRecords := 0
-    for in.Offset() < end {
-        numRecords++
-        in.Demand(1)
-        tag := in.GetByte()
-        // log.Printf("tag %d\n", tag)
-        switch tag {
-            case 0x21: // INSTANCE_DUMP
-                hprof.readInstance(in)
-            case 0x22: // OBJECT_ARRAY
-                hprof.readArray(in, true)
-            case 0x23: // PRIMITIVE_ARRAY
-                hprof.readArray(in, false)
-            case 0x20: // CLASS_DUMP
-                hprof.readClassDump(in)
-            case 0x01: // ROOT_JNI_GLOBAL
-                hprof.readGCRoot(in, "JNI global", hprof.IdSize)
-            case 0x02: // ROOT_JNI_LOCAL
-                hprof.readGCRoot(in, "JNI local", 8)
-            case 0x03: // ROOT_JAVA_FRAME
-                hprof.readGCRoot(in, "java frame", 8)
-            case 0x04: // ROOT_NATIVE_STACK
-                hprof.readGCRoot(in, "native stack", 4)
-            case 0x05: // ROOT_STICKY_CLASS
-                hprof.readGCRoot(in, "sticky class", 0)
-            case 0x06: // ROOT_THREAD_BLOCK
-                hprof.readGCRoot(in, "thread block", 4)
-            case 0x07: // ROOT_MONITOR_USED
-                hprof.readGCRoot(in, "monitor used", 0)
-            case 0x08: // ROOT_THREAD_OBJECT
-                hprof.readGCRoot(in, "thread object", 8)
-            case 0xff: // ROOT_UNKNOWN
-                hprof.readGCRoot(in, "unknown root", 0)
-            default:
-                log.Fatalf("Unknown HPROF record type %d at %d\n", tag, in.Offset() - 1)
+// Account for a record or sub-record that a lenient read couldn't handle, and
+// move past it: to the end of the file if that's where it failed, else to its
+// end if known, else to where the next sub-record seems to start before the
+// end of the enclosing record.
+//
+func (hprof *HProfReader) lose(in *MappedSection, err *ReadError, known uint64, end uint64) {
+    var next uint64
+    switch {
+        case err.Err == ErrTruncated && hprof.limit >= hprof.Size:
+            hprof.Heap.Truncated = true
+            next = hprof.Size
+        case known > err.Offset:
+            next = known
+        default:
+            next = hprof.resync(in, err.Offset + 1, end)
+    }
+    if next > hprof.Size {
+        hprof.Heap.Truncated = true
+        next = hprof.Size
+    }
+    log.Printf("Dropping %d bytes: %s\n", next - err.Offset, err)
+    hprof.Heap.SkippedRecords++
+    hprof.Heap.DroppedBytes += next - err.Offset
+    if next == hprof.Size {
+        hprof.stopped = true
+    } else {
+        in.Seek(next)
+    }
+}
+
+// Find the first offset in [start, end) where there are two plausible instance or
+// array sub-records in a row, or that ends at end; return end if there are none.
+//
+func (hprof *HProfReader) resync(in *MappedSection, start uint64, end uint64) uint64 {
+    if end > hprof.Size {
+        end = hprof.Size
+    }
+    for offset := start; offset < end; offset++ {
+        if next := hprof.plausible(in, offset, end); next == end || next != 0 && hprof.plausible(in, next, end) != 0 {
+            return offset
         }
     }
-    return numRecords
+    return end
+}
+
+// Return the offset after an apparent INSTANCE_DUMP, OBJECT_ARRAY or PRIMITIVE_ARRAY
+// of a known class at the given offset, or 0 if it doesn't look like one that
+// ends by the given end.
+//
+func (hprof *HProfReader) plausible(in *MappedSection, offset uint64, end uint64) uint64 {
+
+    id := uint64(hprof.IdSize)
+    in.Seek(offset)
+    in.Demand(uint32(2 * id + 9))
+    tag := in.GetByte()
+    var next uint64
+
+    switch {
+        case tag == 0x21 && offset + 2 * id + 9 <= end: // INSTANCE_DUMP
+            hprof.readId(in)
+            in.Skip(4)
+            class := hprof.HidClass(hprof.readId(in))
+            if class == nil {
+                return 0
+            }
+            next = offset + 2 * id + 9 + uint64(in.GetUInt32())
+
+        case tag == 0x22 && offset + 2 * id + 9 <= end: // OBJECT_ARRAY
+            hprof.readId(in)
+            in.Skip(4)
+            count := in.GetUInt32()
+            if hprof.HidClass(hprof.readId(in)) == nil {
+                return 0
+            }
+            next = offset + 2 * id + 9 + uint64(count) * id
+
+        case tag == 0x23 && offset + id + 10 <= end: // PRIMITIVE_ARRAY
+            hprof.readId(in)
+            in.Skip(4)
+            count := in.GetUInt32()
+            jtag := int(in.GetByte())
+            if jtag >= len(hprof.Jtypes) || hprof.Jtypes[jtag] == nil || hprof.Jtypes[jtag].IsObj {
+                return 0
+            }
+            next = offset + id + 10 + uint64(count) * uint64(hprof.Jtypes[jtag].Size)
+
+        default:
+            return 0
+    }
+
+    if next > end {
+        return 0
+    }
+    return next
+}
+
+// In a lenient read, fail unless the CLASS_DUMPs for all a class's superclasses
+// have been read, since instances can't be laid out without them.  (A strict
+// read fails in ClassDef.Cook.)
+//
+func (hprof *HProfReader) checkSupers(class *ClassDef) {
+    if !hprof.Lenient || hprof.goodClasses[class.Cid] {
+        return
+    }
+    for c := class; !c.IsRoot; {
+        super := hprof.HidClass(c.SuperHid)
+        if super == nil {
+            hprof.missingHids[c.SuperHid] = true
+            hprof.fail(ErrBadRecord, "no CLASS_DUMP for superclass %#x of %s", c.SuperHid, c.Name)
+        }
+        c = super
+    }
+    hprof.goodClasses[class.Cid] = true
+}
+
+// After a lenient read, make classes whose superclasses are missing subclasses of
+// java.lang.Object so they can be cooked, and note all the classes that had a
+// LOAD_CLASS but no CLASS_DUMP.
+//
+func (hprof *HProfReader) repairClasses() {
+    heap := hprof.Heap
+    object := heap.ClassNamed("java.lang.Object")
+    for _, class := range heap.classes[1:] {
+        if !class.IsRoot && heap.HidClass(class.SuperHid) == nil && object != nil {
+            hprof.missingHids[class.SuperHid] = true
+            class.SuperHid = object.Hid
+        }
+    }
+    for hid := range heap.classNames {
+        if heap.HidClass(hid) == nil {
+            hprof.missingHids[hid] = true
+        }
+    }
+    for hid := range hprof.missingHids {
+        name := heap.StringWithId(heap.ClassNameId(hid))
+        if name == "" {
+            name = fmt.Sprintf("%#x", hid)
+        } else {
+            name = Demangle(name)
+        }
+        heap.MissingClasses = append(heap.MissingClasses, name)
+    }
+    sort.Strings(heap.MissingClasses)
 }
 
 // Read a CLASS_DUMP record, which defines the layout of a class in the heap
 //
 func (hprof *HProfReader) readClassDump(in *MappedSection) {
 
+    offset := in.Offset() - 1 // for inspecting statics later
+
     // Header
 
     // header is
@@ -218,18 +638,21 @@ func (hprof *HProfReader) readClassDump(in *MappedSection) {
     // class heap id    HeapId
     // stack serial     uint32      (ignored)
     // superclass id    HeapId
-    // classloader id   HeapId      (ignored)
-    // signer id        HeapId      (ignored)
-    // prot domain id   HeapId      (ignored)
+    // classloader id   HeapId
+    // signer id        HeapId
+    // prot domain id   HeapId
     // reserved 1       HeapId      (ignored)
     // reserved 2       HeapId      (ignored)
     // instance size    uint32      TODO: use this?
 
-    in.Demand(7 * hprof.IdSize + 8)
+    hprof.demand(in, 7 * hprof.IdSize + 8)
     hid := hprof.readId(in) // hid
     in.Skip(4)
     superHid := hprof.readId(in) // superHid
-    in.Skip(5 * hprof.IdSize)
+    loaderHid := hprof.readId(in)
+    signersHid := hprof.readId(in)
+    domainHid := hprof.readId(in)
+    in.Skip(2 * hprof.IdSize)
     in.Skip(4)
 
     // Class name was read earlier as a UTF8 record
@@ -237,75 +660,182 @@ func (hprof *HProfReader) readClassDump(in *MappedSection) {
     heap := hprof.Heap
     nameId := heap.ClassNameId(hid)
     if nameId == 0 {
-        log.Fatalf("Class with hid %d has no name mapping\n", hid)
+        hprof.fail(ErrBadRecord, "class with hid %#x has no LOAD_CLASS record", hid)
     }
 
     name := heap.StringWithId(nameId)
     if name == "" {
-        log.Fatalf("Class name id %d for class hid %d has no mapping\n", hid)
+        hprof.fail(ErrBadRecord, "class name id %#x for class hid %#x has no UTF8 record", nameId, hid)
     }
 
     // Skip over constant pool
 
-    in.Demand(2)
+    hprof.demand(in, 2)
     numConstants := in.GetUInt16()
     in.Demand(11 * uint32(numConstants))
 
     for i := 0; i < int(numConstants); i++ {
-        in.Skip(2)
+        hprof.skip(in, 2)
         jtype := hprof.readJType(in)
-        in.Skip(jtype.Size)
+        hprof.skip(in, uint64(jtype.Size))
     }
 
     // Static fields
 
-    in.Demand(2)
+    hprof.demand(in, 2)
     numStatics := in.GetUInt16()
     in.Demand(11 * uint32(numStatics))
     staticRefs := []HeapId{}
+    staticNames := []string{}
+    staticSize := uint32(0)
 
     for i := 0; i < int(numStatics); i++ {
-        in.Skip(hprof.IdSize) // field name ID
+        hprof.need(in, uint64(hprof.IdSize))
+        nameId := hprof.readId(in)
         jtype := hprof.readJType(in)
+        hprof.need(in, uint64(jtype.Size))
         if jtype.IsObj {
             toHid := hprof.readId(in)
             if toHid != 0 {
                 staticRefs = append(staticRefs, toHid)
+                staticNames = append(staticNames, heap.StringWithId(nameId))
             }
         } else {
             in.Skip(jtype.Size)
         }
+        staticSize += jtype.Size
     }
 
     // Instance fields
 
-    in.Demand(2)
+    hprof.demand(in, 2)
     numFields := in.GetUInt16()
     fieldNames := make([]string, numFields, numFields)
     fieldTypes := make([]*JType, numFields, numFields)
+    hprof.demand(in, uint32(numFields) * (hprof.IdSize + 1))
 
     for i := 0; i < int(numFields); i++ {
         fieldName := heap.StringWithId(hprof.readId(in))
         if fieldName == "" {
-            log.Fatalf("No name for field %d in class with hid %d\n", i, hid)
-            fieldName = "UNKNOWN"
+            hprof.fail(ErrBadRecord, "no name for field %d in class %s", i, name)
         }
         fieldNames[i] = fieldName
         fieldTypes[i] = hprof.readJType(in)
     }
 
-    heap.AddClass(name, hid, superHid, fieldNames, fieldTypes, staticRefs)
+    class := heap.AddClass(name, hid, superHid, fieldNames, fieldTypes, staticRefs, staticNames)
+    class.LoaderHid = loaderHid
+
+    // The class object is a node in the graph too.  There's no instance size for
+    // it in the dump, so count the statics plus an object header.
+
+    oid := heap.AddClassObject(class, staticSize + 2 * hprof.IdSize, offset)
+
+    if hprof.SegReader != nil {
+        refs := &hprof.SegReader.classRefs
+        for i, toHid := range staticRefs {
+            refs.AddReference(oid, toHid, uint32(i))
+        }
+        for _, ref := range []struct{hid HeapId; label uint32} {
+            {superHid, SuperLabel},
+            {loaderHid, LoaderLabel},
+            {signersHid, SignersLabel},
+            {domainHid, DomainLabel},
+        } {
+            if ref.hid != 0 {
+                refs.AddReference(oid, ref.hid, ref.label)
+            }
+        }
+    }
 }
 
-// Read a GC root.  This has the HID at the start followed by some amount
-// of per-root data that we don't use.
+// Read a GC root.  This has the HID at the start followed by per-root data
+// that depends on the kind.
 //
-func (hprof *HProfReader) readGCRoot(in *MappedSection, kind string, skip uint32) {
-    in.Demand(hprof.IdSize + skip)
-    hid := hprof.readId(in)
+func (hprof *HProfReader) readGCRoot(in *MappedSection, kind RootKind) {
+    in.Demand(2 * hprof.IdSize + 8)
+    hprof.need(in, uint64(hprof.IdSize))
+    root := &GCRoot{Kind: kind, Hid: hprof.readId(in)}
+    switch kind {
+        case RootJNIGlobal:
+            hprof.need(in, uint64(hprof.IdSize))
+            root.JNIRef = hprof.readId(in)
+        case RootJNILocal, RootJavaFrame:
+            hprof.need(in, 8)
+            root.ThreadSerial = in.GetUInt32()
+            root.FrameDepth = in.GetInt32()
+        case RootNativeStack, RootThreadBlock:
+            hprof.need(in, 4)
+            root.ThreadSerial = in.GetUInt32()
+        case RootThreadObject:
+            hprof.need(in, 8)
+            root.ThreadSerial = in.GetUInt32()
+            root.StackSerial = in.GetUInt32()
+    }
     // TODO verify gc roots are in heap
-    hprof.Heap.gcRoots = append(hprof.Heap.gcRoots, hid)
-    in.Skip(skip)
+    hprof.Heap.gcRoots = append(hprof.Heap.gcRoots, root)
+}
+
+// Read a STACK_FRAME record.
+//
+func (hprof *HProfReader) readStackFrame(in *MappedSection) {
+
+    // frame id         HeapId
+    // method name id   HeapId
+    // signature id     HeapId
+    // source file id   HeapId      (0 if unknown)
+    // class serial     uint32
+    // line number      int32
+
+    heap := hprof.Heap
+    hprof.demand(in, 4 * hprof.IdSize + 8)
+    frame := &StackFrame{Hid: hprof.readId(in)}
+    frame.Method = heap.StringWithId(hprof.readId(in))
+    frame.Signature = heap.StringWithId(hprof.readId(in))
+    frame.SourceFile = heap.StringWithId(hprof.readId(in))
+    frame.classSerial = in.GetUInt32()
+    frame.Line = in.GetInt32()
+    heap.AddStackFrame(frame)
+}
+
+// Read a STACK_TRACE record.
+//
+func (hprof *HProfReader) readStackTrace(in *MappedSection) {
+
+    // trace serial     uint32
+    // thread serial    uint32
+    // number of frames uint32
+    // frame ids        HeapId * number of frames
+
+    hprof.demand(in, 12)
+    trace := &StackTrace{Serial: in.GetUInt32(), ThreadSerial: in.GetUInt32()}
+    numFrames := in.GetUInt32()
+    hprof.need(in, uint64(numFrames) * uint64(hprof.IdSize))
+    in.Demand(numFrames * hprof.IdSize)
+    trace.frameHids = make([]HeapId, numFrames)
+    for i := range trace.frameHids {
+        trace.frameHids[i] = hprof.readId(in)
+    }
+    hprof.Heap.AddStackTrace(trace)
+}
+
+// Read a START_THREAD record.
+//
+func (hprof *HProfReader) readStartThread(in *MappedSection) {
+
+    // thread serial    uint32
+    // thread object id HeapId
+    // trace serial     uint32
+    // thread name id   HeapId
+    // group name id    HeapId      (ignored)
+    // parent group id  HeapId      (ignored)
+
+    heap := hprof.Heap
+    hprof.demand(in, 4 * hprof.IdSize + 8)
+    thread := &Thread{Serial: in.GetUInt32(), Hid: hprof.readId(in), traceSerial: in.GetUInt32()}
+    thread.Name = heap.StringWithId(hprof.readId(in))
+    in.Skip(2 * hprof.IdSize)
+    heap.AddThread(thread)
 }
 
 // Read header for an object instance, then pass off required info
@@ -323,12 +853,15 @@ func (hprof *HProfReader) readInstance(in *MappedSection) {
     // class id         HeapId
     // length           uint32
 
-    in.Demand(8 + 2 * hprof.IdSize)
+    hprof.demand(in, 8 + 2 * hprof.IdSize)
     hid := hprof.readId(in)
     in.Skip(4) // stack serial
-    class := heap.HidClass(hprof.readId(in))
+    classHid := hprof.readId(in)
     length := in.GetUInt32()
-    oid := heap.AddInstance(hid, class, length + hprof.IdSize) // include object monitor
+    hprof.subRecordEnd = in.Offset() + uint64(length)
+    class := hprof.classWithHid(classHid)
+    hprof.need(in, uint64(length))
+    oid := heap.AddInstance(hid, class, length + hprof.IdSize, offset) // include object monitor
 
     if hprof.SegReader != nil {
         hprof.doInstance(offset, oid, class)
@@ -351,7 +884,7 @@ func (hprof *HProfReader) readArray(in *MappedSection, isObjects bool) {
     // stack serial     uint32      (ignored)
     // # elements       uint32
 
-    in.Demand(hprof.IdSize + 8)
+    hprof.demand(in, hprof.IdSize + 8)
     hid := hprof.readId(in)
     in.Skip(4) // stack serial
     count := in.GetUInt32()
@@ -359,18 +892,24 @@ func (hprof *HProfReader) readArray(in *MappedSection, isObjects bool) {
     // TODO heap.addPrimitiveArray(id, jtype, offset, count * jtype.size + 2 * heap.IdSize)
 
     if isObjects {
-        in.Demand(hprof.IdSize)
-        class := heap.HidClass(hprof.readId(in))
-        oid := heap.AddInstance(hid, class, (count + 2) * hprof.IdSize) // include header size
+        hprof.demand(in, hprof.IdSize)
+        class := hprof.classWithHid(hprof.readId(in))
+        hprof.subRecordEnd = in.Offset() + uint64(count) * uint64(hprof.IdSize)
+        hprof.need(in, uint64(count) * uint64(hprof.IdSize))
+        oid := heap.AddInstance(hid, class, (count + 2) * hprof.IdSize, offset) // include header size
         if hprof.SegReader != nil {
             hprof.doInstance(offset, oid, class)
         }
         in.Skip(count * hprof.IdSize)
     } else {
-        in.Demand(1)
+        hprof.demand(in, 1)
         jtype :=  hprof.readJType(in)
-        heap.AddInstance(hid, jtype.Class, count * jtype.Size + 2 * hprof.IdSize) // include header size
-        in.Skip(count * jtype.Size)
+        hprof.subRecordEnd = in.Offset() + uint64(count) * uint64(jtype.Size)
+        if jtype.Class == nil {
+            hprof.fail(ErrBadRecord, "no CLASS_DUMP for %s", jtype.ArrayClass)
+        }
+        hprof.skip(in, uint64(count) * uint64(jtype.Size))
+        heap.AddInstance(hid, jtype.Class, count * jtype.Size + 2 * hprof.IdSize, offset) // include header size
     }
 
 }
@@ -387,14 +926,26 @@ func (hprof *HProfReader) readId(in *MappedSection) HeapId {
 // Read a "Basic Type" ID from heap data and return the JType
 //
 func (hprof *HProfReader) readJType(in *MappedSection) *JType {
+    hprof.need(in, 1)
     tag := int(in.GetByte())
-    if tag < 0 || tag >= len(hprof.Jtypes) {
-        log.Fatalf("Unknown basic type %d at %d\n", tag, in.Offset() - 1)
+    if tag >= len(hprof.Jtypes) || hprof.Jtypes[tag] == nil {
+        hprof.fail(ErrUnknownTag, "unknown basic type %d at %d", tag, in.Offset() - 1)
     }
-    jtype := hprof.Jtypes[tag]
-    if jtype == nil {
-        log.Fatalf("Unknown basic type %d at %d\n", tag, in.Offset() - 1)
+    return hprof.Jtypes[tag]
+}
+
+// Return the class of an instance, which must have been defined by an earlier
+// CLASS_DUMP.
+//
+func (hprof *HProfReader) classWithHid(hid HeapId) *ClassDef {
+    class := hprof.HidClass(hid)
+    if class == nil {
+        if hprof.Lenient {
+            hprof.missingHids[hid] = true
+        }
+        hprof.fail(ErrBadRecord, "no CLASS_DUMP for class hid %#x", hid)
     }
-    return jtype
+    hprof.checkSupers(class)
+    return class
 }
 
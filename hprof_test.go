@@ -0,0 +1,542 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    . "launchpad.net/gocheck"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// Handcrafted heap dump data with 4-byte ids.
+//
+type dumpBytes struct {
+    bytes.Buffer
+}
+
+func (d *dumpBytes) u1(values ...byte) *dumpBytes {
+    d.Write(values)
+    return d
+}
+
+func (d *dumpBytes) u4(values ...uint32) *dumpBytes {
+    for _, value := range values {
+        binary.Write(d, binary.BigEndian, value)
+    }
+    return d
+}
+
+// Append a top-level record.
+//
+func (d *dumpBytes) record(tag byte, body *dumpBytes) *dumpBytes {
+    d.u1(tag).u4(0, uint32(body.Len()))
+    d.Write(body.Bytes())
+    return d
+}
+
+// Append a CLASS_DUMP sub-record for a class with no constants, statics or fields.
+//
+func (d *dumpBytes) classDump(hid, superHid uint32) *dumpBytes {
+    return d.u1(0x20).u4(hid, 0, superHid, 0, 0, 0, 0, 0, 0).u1(0, 0, 0, 0, 0, 0)
+}
+
+// Return a dump defining java.lang.Object (class hid 100) in a heap dump segment
+// followed by the given sub-records, which start at offset 137.
+//
+func testDump(subRecords *dumpBytes) *dumpBytes {
+    d := &dumpBytes{}
+    d.WriteString("JAVA PROFILE 1.0.2\x00")
+    d.u4(4, 0, 0)
+    name := &dumpBytes{}
+    name.u4(1).WriteString("java/lang/Object")
+    d.record(0x01, name)                                 // UTF8 at 31
+    d.record(0x02, (&dumpBytes{}).u4(1, 100, 0, 1))      // LOAD_CLASS at 60
+    segment := (&dumpBytes{}).classDump(100, 0)
+    segment.Write(subRecords.Bytes())
+    return d.record(0x1c, segment)                       // HEAP_DUMP_SEGMENT at 85
+}
+
+func readTestDump(t *testing.T, d *dumpBytes, needRefs bool) (*Heap, error) {
+    dir, err := ioutil.TempDir("", "helmet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "test.hprof")
+    if err := ioutil.WriteFile(filename, d.Bytes(), 0644); err != nil {
+        t.Fatal(err)
+    }
+    return ReadHeapDump(filename, &Options{NeedRefs: needRefs, NoIndex: true})
+}
+
+func TestReadDump(t *testing.T) {
+    instance := (&dumpBytes{}).u1(0x21).u4(200, 0, 100, 0)
+    root := (&dumpBytes{}).u1(0x05).u4(200)
+    instance.Write(root.Bytes())
+    heap, err := readTestDump(t, testDump(instance), true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if heap.MaxObjectId != 2 || len(heap.roots) != 1 {
+        t.Errorf("Wanted 2 objects & 1 root, got %d & %d\n", heap.MaxObjectId, len(heap.roots))
+    }
+}
+
+// Check each kind of ReadError and where it's reported.
+//
+func TestReadErrors(t *testing.T) {
+
+    sub := func() *dumpBytes { return &dumpBytes{} }
+    good := testDump(sub())
+    truncated := testDump(sub())
+    truncated.Truncate(truncated.Len() - 3)
+    badVersion := testDump(sub())
+    copy(badVersion.Bytes(), "JAVA PROFILE 9.9.9")
+    unknownRecord := testDump(sub())
+    unknownRecord.record(0x99, sub())
+
+    cases := []struct {
+        name string
+        dump *dumpBytes
+        err error
+        tag int
+        offset uint64
+    }{
+        {"truncated segment", truncated, ErrTruncated, 0x1c, 85},
+        {"truncated header", testDump(sub()).u1(0x01, 0, 0), ErrTruncated, 0x01, uint64(good.Len())},
+        {"truncated instance", testDump(sub().u1(0x21).u4(200, 0, 100, 50)), ErrTruncated, 0x21, 137},
+        {"truncated field list", testDump(sub().u1(0x20).u4(100, 0, 0, 0, 0, 0, 0, 0, 0).u1(0, 0, 0, 0, 0, 3)),
+            ErrTruncated, 0x20, 137},
+        {"unknown record", unknownRecord, ErrUnknownTag, 0x99, uint64(good.Len())},
+        {"unknown sub-record", testDump(sub().u1(0x42)), ErrUnknownTag, 0x42, 137},
+        {"unknown basic type", testDump(sub().u1(0x23).u4(200, 0, 1).u1(3, 0)), ErrUnknownTag, 0x23, 137},
+        {"duplicate class", testDump(sub().classDump(100, 0)), ErrDuplicateClass, 0x20, 137},
+        {"bad version", badVersion, ErrBadRecord, NoTag, 0},
+        {"undefined class", testDump(sub().u1(0x21).u4(200, 0, 101, 0)), ErrBadRecord, 0x21, 137},
+        {"unnamed class", testDump(sub().classDump(101, 100)), ErrBadRecord, 0x20, 137},
+    }
+
+    for _, tc := range cases {
+        for _, needRefs := range []bool{false, true} {
+            heap, err := readTestDump(t, tc.dump, needRefs)
+            rerr, ok := err.(*ReadError)
+            switch {
+                case heap != nil || !ok:
+                    t.Errorf("%s: wanted a ReadError, got %v\n", tc.name, err)
+                case rerr.Err != tc.err || rerr.Tag != tc.tag || rerr.Offset != tc.offset:
+                    t.Errorf("%s: wanted %v in tag %d at %d, got %v\n", tc.name, tc.err, tc.tag, tc.offset, err)
+                case !strings.Contains(err.Error(), "test.hprof: " + tc.err.Error()):
+                    t.Errorf("%s: bad message %s\n", tc.name, err)
+            }
+        }
+    }
+}
+
+// Check what a lenient read keeps & reports of damaged dumps.
+//
+func TestLenientRead(t *testing.T) {
+
+    sub := func() *dumpBytes { return &dumpBytes{} }
+    instance := func(d *dumpBytes, hid uint32) *dumpBytes { return d.u1(0x21).u4(hid, 0, 100, 0) }
+
+    truncated := testDump(instance(instance(sub(), 200), 201))
+    truncated.Truncate(truncated.Len() - 2)
+    unknownRecord := testDump(instance(sub(), 200)).record(0x99, sub().u4(0))
+    unknownRecord.record(0x1c, instance(sub(), 201))
+
+    cases := []struct {
+        name string
+        dump *dumpBytes
+        numObjects ObjectId
+        losses Losses
+    }{
+        {"truncated", truncated, 2, Losses{Truncated: true, SkippedRecords: 1, DroppedBytes: 15}},
+        {"unknown sub-record", testDump(instance(instance(instance(sub(), 200).u1(0x42, 1, 2, 3, 4), 201), 202)),
+            4, Losses{SkippedRecords: 1, DroppedBytes: 5}},
+        {"unknown record", unknownRecord, 3, Losses{SkippedRecords: 1, DroppedBytes: 13}},
+        {"undefined class", testDump(instance(instance(sub(), 200).u1(0x21).u4(201, 0, 101, 0), 202)),
+            3, Losses{SkippedRecords: 1, DroppedBytes: 17, MissingClasses: []string{"0x65"}}},
+        {"dangling", testDump(sub().u1(0x22).u4(300, 0, 1, 100, 999)), 2, Losses{DanglingRefs: 1}},
+    }
+
+    for _, tc := range cases {
+        dir, err := ioutil.TempDir("", "helmet")
+        if err != nil {
+            t.Fatal(err)
+        }
+        filename := filepath.Join(dir, "test.hprof")
+        ioutil.WriteFile(filename, tc.dump.Bytes(), 0644)
+        heap, err := ReadHeapDump(filename, &Options{NeedRefs: true, NoIndex: true, Lenient: true})
+        os.RemoveAll(dir)
+        switch {
+            case err != nil:
+                t.Errorf("%s: %s\n", tc.name, err)
+            case heap.MaxObjectId != tc.numObjects || heap.Graph == nil:
+                t.Errorf("%s: wanted %d objects & a graph, got %d\n", tc.name, tc.numObjects, heap.MaxObjectId)
+            case !reflect.DeepEqual(heap.Losses, tc.losses):
+                t.Errorf("%s: wanted losses %+v, got %+v\n", tc.name, tc.losses, heap.Losses)
+        }
+    }
+}
+
+// Read the test heap cut off at various points, as from a JVM killed while
+// dumping; a lenient read should keep everything before the cut.
+//
+func (s *SearchSuite) TestLenientTruncated(c *C) {
+
+    LogTestOutput()
+    data, err := ioutil.ReadFile(testHeapFile(c))
+    c.Assert(err, IsNil)
+    dir := c.MkDir()
+    objects := ObjectId(0)
+
+    for _, percent := range []int{30, 60, 90, 99} {
+        filename := fmt.Sprintf("%s/cut%d.hprof", dir, percent)
+        c.Assert(ioutil.WriteFile(filename, data[:len(data) * percent / 100], 0644), IsNil)
+        _, err := ReadHeapDump(filename, &Options{NeedRefs: true, NoIndex: true})
+        c.Check(err, NotNil)
+        heap, err := ReadHeapDump(filename, &Options{NeedRefs: true, NoIndex: true, Lenient: true})
+        c.Assert(err, IsNil)
+        c.Check(heap.Truncated, Equals, true)
+        c.Check(heap.Graph, NotNil)
+        c.Check(heap.MaxObjectId > objects, Equals, true)
+        c.Check(heap.MaxObjectId < getHeap(c).MaxObjectId, Equals, true)
+        heap.ClassHisto()
+        objects = heap.MaxObjectId
+    }
+}
+
+// Check that references to objects not in the dump are left out of the graph
+// and reported.
+//
+func TestDangling(t *testing.T) {
+
+    dump := testDump(&dumpBytes{})
+    name := (&dumpBytes{}).u4(2)
+    name.WriteString("[Ljava/lang/Object;")
+    dump.record(0x01, name)
+    dump.record(0x02, (&dumpBytes{}).u4(2, 101, 0, 2))
+    segment := (&dumpBytes{}).classDump(101, 100)
+    segment.u1(0x22).u4(300, 0, 3, 101, 999, 200, 998)
+    segment.u1(0x21).u4(200, 0, 100, 0)
+    dump.record(0x1c, segment)
+
+    heap, err := readTestDump(t, dump, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if heap.DanglingRefs != 2 {
+        t.Errorf("Wanted 2 dangling references, got %d\n", heap.DanglingRefs)
+    }
+    var dsts []ObjectId
+    for dst, pos := heap.OutEdges(3); pos != 0; dst, pos = heap.NextOutEdge(pos) {
+        dsts = append(dsts, dst)
+    }
+    if !reflect.DeepEqual(dsts, []ObjectId{4}) || heap.MaxNode != 4 {
+        t.Errorf("Wanted only edge 3 -> 4, got %v max %d\n", dsts, heap.MaxNode)
+    }
+
+    var out bytes.Buffer
+    report := NewTextReport(&out)
+    heap.PrintDangling(report)
+    heap.PrintDanglingByClass(report)
+    wanted := "         3 java.lang.Object[] [0] -> 0x3e7\n" +
+              "         3 java.lang.Object[] [2] -> 0x3e6\n" +
+              "\n" +
+              "         2 java.lang.Object[]\n" +
+              "         2 total\n"
+    if out.String() != wanted {
+        t.Errorf("Wanted report\n%s\ngot\n%s\n", wanted, out.String())
+    }
+}
+
+// Read back a dump from HProfWriter.
+//
+func TestHProfWriter(t *testing.T) {
+    w := NewHProfWriter(4)
+    point := w.DefineClass("com.myco.Point", nil, WField{"x", "int"}, WField{"label", "java.lang.String"})
+    p := w.AddInstance(point, map[string]interface{}{"x": int32(7), "label": w.AddString("origin")})
+    w.AddObjectArray("com.myco.Point", []HeapId{p, 0})
+    w.AddRoot(0x01, p)
+
+    dump := &dumpBytes{}
+    if err := w.WriteDump(dump); err != nil {
+        t.Fatal(err)
+    }
+    heap, err := readTestDump(t, dump, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(heap.roots) != 1 || heap.DanglingRefs != 0 {
+        t.Fatalf("Wanted 1 root & no dangling refs, got %d & %d\n", len(heap.roots), heap.DanglingRefs)
+    }
+
+    oid := heap.roots[0]
+    class := heap.ClassOf(oid)
+    x, _ := heap.intField(heap.seekObject(oid), oid, class, "x")
+    label, _ := heap.StringValue(heap.refField(oid, class, "label"))
+    if class.Name != "com.myco.Point" || x != 7 || label != "origin" {
+        t.Errorf("Wanted com.myco.Point 7 origin, got %s %d %s\n", class.Name, x, label)
+    }
+
+    src, pos := heap.InEdges(oid)
+    if pos == 0 || heap.ClassOf(src).Name != "com.myco.Point[]" || heap.EdgeName(src, heap.InLabel(pos)) != "[0]" {
+        t.Errorf("Wanted reference from com.myco.Point[] element 0\n")
+    }
+}
+
+// HProfWriter panics on values of the wrong type, naming what was wrong, and
+// writes strings as UTF-16.
+//
+func TestHProfWriterChecks(t *testing.T) {
+    w := NewHProfWriter(8)
+    point := w.DefineClass("com.myco.Point", nil, WField{"x", "int"}, WField{"label", "java.lang.String"})
+    try := func(wanted string, add func()) {
+        defer func() {
+            if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), wanted) {
+                t.Errorf("Wanted panic with %q, got %v\n", wanted, r)
+            }
+        }()
+        add()
+    }
+    try("field int x is int64", func() { w.AddInstance(point, map[string]interface{}{"x": int64(7)}) })
+    try("field java.lang.String label is string", func() {
+        w.AddInstance(point, map[string]interface{}{"label": "origin"})
+    })
+    try("field long total is int32", func() { w.AddStatic(point, "total", "long", int32(1)) })
+    try("Point[], com.myco.Point isn't a primitive", func() { w.AddPrimitiveArray("com.myco.Point", []int32{1}) })
+    try("contents for int[] are []int64", func() { w.AddPrimitiveArray("int", []int64{1}) })
+
+    text := "caf\u00e9 \U0001f600"
+    w.AddRoot(0x01, w.AddString(text))
+    dump := &dumpBytes{}
+    if err := w.WriteDump(dump); err != nil {
+        t.Fatal(err)
+    }
+    heap, err := readTestDump(t, dump, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if value, _ := heap.StringValue(heap.roots[0]); value != text {
+        t.Errorf("Wanted %q, got %q\n", text, value)
+    }
+}
+
+// Threads known only from ROOT_THREAD_OBJECT, as in jmap dumps, are named from
+// their Thread objects, whether the name is a String or a char array.
+//
+func TestThreadNames(t *testing.T) {
+    w := NewHProfWriter(8)
+    thread := w.DefineClass("java.lang.Thread", nil, WField{"name", "java.lang.String"})
+    oldThread := w.DefineClass("com.myco.OldThread", nil, WField{"name", "char[]"})
+    w.AddRoot(0x08, w.AddInstance(thread, map[string]interface{}{"name": w.AddString("worker-1")}), 1, 0)
+    chars := w.AddPrimitiveArray("char", []uint16{'o', 'l', 'd'})
+    w.AddRoot(0x08, w.AddInstance(oldThread, map[string]interface{}{"name": chars}), 2, 0)
+    w.AddRoot(0x08, w.AddInstance(thread, nil), 3, 0)
+
+    dump := &dumpBytes{}
+    if err := w.WriteDump(dump); err != nil {
+        t.Fatal(err)
+    }
+    heap, err := readTestDump(t, dump, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    names := []string{}
+    for _, thread := range heap.Threads() {
+        names = append(names, thread.Name)
+    }
+    if !reflect.DeepEqual(names, []string{"worker-1", "old", ""}) {
+        t.Errorf("Wrong thread names %q\n", names)
+    }
+}
+
+// Arrays with the same hash are only duplicates if their contents match.
+//
+func TestSameContents(t *testing.T) {
+    w := NewHProfWriter(8)
+    for _, values := range [][]int32{{1, 2, 3}, {1, 2, 4}, {1, 2, 3}} {
+        w.AddRoot(0x01, w.AddPrimitiveArray("int", values))
+    }
+    dump := &dumpBytes{}
+    if err := w.WriteDump(dump); err != nil {
+        t.Fatal(err)
+    }
+    heap, err := readTestDump(t, dump, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    roots := heap.roots
+    sets := heap.sameContents(heap.seekObject(roots[0]), roots)
+    if !reflect.DeepEqual(sets, [][]ObjectId{{roots[0], roots[2]}, {roots[1]}}) {
+        t.Errorf("Wrong sets %v for %v\n", sets, roots)
+    }
+}
+
+// Referrers of duplicates, which follow each group as notes, appear in JSON
+// output.
+//
+func TestDupReferrersJSON(t *testing.T) {
+    w := NewHProfWriter(8)
+    holder := w.DefineClass("com.myco.Holder", nil, WField{"values", "int[]"})
+    for i := 0; i < 2; i++ {
+        w.AddRoot(0x01, w.AddInstance(holder, map[string]interface{}{
+            "values": w.AddPrimitiveArray("int", []int32{1, 2, 3})}))
+    }
+    dump := &dumpBytes{}
+    if err := w.WriteDump(dump); err != nil {
+        t.Fatal(err)
+    }
+    heap, err := readTestDump(t, dump, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    groups, err := heap.FindDuplicates()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var buf bytes.Buffer
+    heap.PrintDuplicates(NewJSONReport(&buf), groups, DefaultDupGroups)
+    for _, oid := range heap.roots {
+        note := fmt.Sprintf(`{"report":"dups","note":"\u003c- %d com.myco.Holder via values"}`, oid)
+        if !strings.Contains(buf.String(), note + "\n") {
+            t.Errorf("Wanted %s in\n%s\n", note, buf.String())
+        }
+    }
+}
+
+// Commands that print text rather than a table, show and path of an unreachable
+// object, still write JSON or CSV when asked.
+//
+func TestTextCommandFormats(t *testing.T) {
+    w := NewHProfWriter(8)
+    holder := w.DefineClass("com.myco.Holder", nil, WField{"count", "int"})
+    w.AddRoot(0x01, w.AddInstance(holder, map[string]interface{}{"count": int32(42)}))
+    w.AddInstance(holder, nil)
+    dump := &dumpBytes{}
+    if err := w.WriteDump(dump); err != nil {
+        t.Fatal(err)
+    }
+    heap, err := readTestDump(t, dump, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var unreachable ObjectId
+    for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+        if heap.ClassOf(oid) == heap.ClassNamed("com.myco.Holder") && oid != heap.roots[0] {
+            unreachable = oid
+        }
+    }
+
+    var buf bytes.Buffer
+    session := &Session{Heap: heap, Settings: DefaultSettings(), Out: &buf}
+    for _, command := range []string{fmt.Sprintf("show %d", heap.roots[0]), fmt.Sprintf("path %d", unreachable)} {
+        buf.Reset()
+        if !session.run("set format json") || !session.run(command) {
+            t.Fatalf("%s failed: %v\n", command, session.Err)
+        }
+        notes := []string{}
+        for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+            var record map[string]interface{}
+            if err := json.Unmarshal([]byte(line), &record); err != nil || record["note"] == nil {
+                t.Errorf("%s: wanted a JSON note, got %s\n", command, line)
+            }
+            notes = append(notes, fmt.Sprint(record["note"]))
+        }
+        if strings.HasPrefix(command, "show") && !strings.Contains(strings.Join(notes, "\n"), "count = 42") {
+            t.Errorf("Wanted the field value in %q\n", notes)
+        }
+        buf.Reset()
+        if !session.run("set format csv") || !session.run(command) {
+            t.Fatalf("%s failed: %v\n", command, session.Err)
+        }
+        records, err := csv.NewReader(&buf).ReadAll()
+        if err != nil || len(records) < 2 || records[0][0] != "text" {
+            t.Errorf("%s: wanted CSV with a text column, got %q, %v\n", command, records, err)
+        }
+    }
+}
+
+// Objects that can't be read fail the commands that read them rather than
+// panicking, e.g. in a damaged dump whose object offsets run past the end.
+//
+func TestDamagedObjects(t *testing.T) {
+    w := NewHProfWriter(8)
+    holder := w.DefineClass("com.myco.Holder", nil, WField{"name", "java.lang.String"})
+    for i := 0; i < 2; i++ {
+        w.AddRoot(0x01, w.AddInstance(holder, map[string]interface{}{"name": w.AddString("hello")}))
+    }
+    dump := &dumpBytes{}
+    if err := w.WriteDump(dump); err != nil {
+        t.Fatal(err)
+    }
+    heap, err := readTestDump(t, dump, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var str ObjectId
+    for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+        if heap.ClassOf(oid).Name == "java.lang.String" {
+            str = oid
+        }
+        heap.objectOffsets[oid] = heap.file.Size + 1 << 20
+    }
+
+    if text, ok := heap.StringValue(str); ok {
+        t.Errorf("Wanted no string value, got %q\n", text)
+    }
+    if err := heap.ShowObject(ioutil.Discard, str); err == nil {
+        t.Errorf("Wanted an error showing %d\n", str)
+    }
+    session := &Session{Heap: heap, Settings: DefaultSettings(), Out: ioutil.Discard}
+    for _, command := range []string{fmt.Sprintf("show %d", str), "dups"} {
+        if session.run(command) {
+            t.Errorf("Wanted %s to fail\n", command)
+        } else if _, ok := session.Err.(*ReadError); !ok {
+            t.Errorf("Wanted a ReadError from %s, got %v\n", command, session.Err)
+        }
+    }
+
+    server := httptest.NewServer(NewServer(heap))
+    defer server.Close()
+    resp, err := http.Get(fmt.Sprintf("%s/object?oid=%d", server.URL, str))
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusInternalServerError {
+        t.Errorf("Wanted status %d for /object, got %d\n", http.StatusInternalServerError, resp.StatusCode)
+    }
+}
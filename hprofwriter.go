@@ -0,0 +1,504 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "os"
+    "reflect"
+    "strings"
+    "unicode/utf16"
+)
+
+// Builds a synthetic HPROF 1.0.2 heap dump in memory, so tests can run without
+// a JVM.  Typical use:
+//
+//     w := NewHProfWriter(8)
+//     thing := w.DefineClass("com.myco.Thing", nil, WField{"value", "int"})
+//     t := w.AddInstance(thing, map[string]interface{}{"value": int32(42)})
+//     w.AddRoot(0x01, t)
+//     w.WriteFile("test.hprof")
+//
+// The standard classes the reader relies on (java.lang.Object, java.lang.Class,
+// java.lang.String and the primitive array classes) are defined automatically.
+//
+type HProfWriter struct {
+    // native identifier size, 4 or 8
+    IdSize uint32
+    // last heap id handed out
+    lastId HeapId
+    // UTF8 string ids by value
+    strings map[string]HeapId
+    // order strings were added, for deterministic output
+    stringOrder []string
+    // class definitions, in definition order
+    classes []*WClass
+    // same, by dotted name
+    classesByName map[string]*WClass
+    // STACK_FRAME, STACK_TRACE and START_THREAD records
+    stacks bytes.Buffer
+    // HEAP_DUMP_SEGMENT sub-records for roots, instances and arrays
+    objects bytes.Buffer
+}
+
+// A class defined with HProfWriter.DefineClass.
+//
+type WClass struct {
+    // heap id of the class object
+    Hid HeapId
+    // dotted name, or JVM name for arrays e.g. "[I"
+    Name string
+    // superclass, nil only for java.lang.Object
+    Super *WClass
+    // instance fields declared by this class
+    Fields []WField
+    // static fields declared by this class
+    Statics []WStatic
+    // class serial number from LOAD_CLASS
+    serial uint32
+}
+
+// An instance field in a WClass.  Type is a Java primitive name ("int",
+// "boolean" etc) or anything else for an object reference.
+//
+type WField struct {
+    Name string
+    Type string
+}
+
+// A static field in a WClass, with its value.
+//
+type WStatic struct {
+    WField
+    Value interface{}
+}
+
+// HPROF "basic type" tags by Java primitive name
+//
+var wtypes = map[string]byte{
+    "boolean": 4, "char": 5, "float": 6, "double": 7,
+    "byte": 8, "short": 9, "int": 10, "long": 11,
+}
+
+// Sizes of same, by tag
+//
+var wsizes = map[byte]int{4: 1, 5: 2, 6: 4, 7: 8, 8: 1, 9: 2, 10: 4, 11: 8}
+
+// Go types of same, by tag, for field values and array contents
+//
+var wgotypes = map[byte]reflect.Type{
+    4: reflect.TypeOf(false), 5: reflect.TypeOf(uint16(0)), 6: reflect.TypeOf(float32(0)),
+    7: reflect.TypeOf(float64(0)), 8: reflect.TypeOf(int8(0)), 9: reflect.TypeOf(int16(0)),
+    10: reflect.TypeOf(int32(0)), 11: reflect.TypeOf(int64(0)),
+}
+
+// Create a writer with the standard classes predefined.
+//
+func NewHProfWriter(idSize uint32) *HProfWriter {
+    w := &HProfWriter{
+        IdSize: idSize,
+        lastId: 0x1000,
+        strings: make(map[string]HeapId),
+        classesByName: make(map[string]*WClass),
+    }
+    object := w.DefineClass("java.lang.Object", nil)
+    w.DefineClass("java.lang.Class", object)
+    w.DefineClass("java.lang.String", object,
+                  WField{"value", "char[]"}, WField{"hash", "int"})
+    for _, name := range []string{"[Z", "[C", "[F", "[D", "[B", "[S", "[I", "[J"} {
+        w.DefineClass(name, object)
+    }
+    return w
+}
+
+// Allocate a new heap id.  Ids are spaced like real object addresses.
+//
+func (w *HProfWriter) newId() HeapId {
+    w.lastId += 0x10
+    return w.lastId
+}
+
+// Return the id of a UTF8 record, adding it if needed.
+//
+func (w *HProfWriter) stringId(str string) HeapId {
+    hid, ok := w.strings[str]
+    if !ok {
+        hid = w.newId()
+        w.strings[str] = hid
+        w.stringOrder = append(w.stringOrder, str)
+    }
+    return hid
+}
+
+// Define a class.  Super may be nil for classes other than java.lang.Object,
+// meaning java.lang.Object.
+//
+func (w *HProfWriter) DefineClass(name string, super *WClass, fields ...WField) *WClass {
+    if super == nil && name != "java.lang.Object" {
+        super = w.classesByName["java.lang.Object"]
+    }
+    class := &WClass{
+        Hid: w.newId(),
+        Name: name,
+        Super: super,
+        Fields: fields,
+        serial: uint32(len(w.classes) + 1),
+    }
+    w.classes = append(w.classes, class)
+    w.classesByName[name] = class
+    return class
+}
+
+// Return a class defined earlier, or nil.
+//
+func (w *HProfWriter) ClassNamed(name string) *WClass {
+    return w.classesByName[name]
+}
+
+// Add a static field to a class.  Value is a HeapId for object fields, else
+// a value of the matching Go type (int32 for int, etc.); panics if not.
+//
+func (w *HProfWriter) AddStatic(class *WClass, name string, jtype string, value interface{}) {
+    field := WField{name, jtype}
+    w.putValue(&bytes.Buffer{}, field, value) // check the type now rather than when writing
+    class.Statics = append(class.Statics, WStatic{field, value})
+}
+
+// Add an instance of a class.  Values are keyed by field name and typed as for
+// AddStatic; fields not given are zero / null.  Superclass fields are included,
+// but a field name hidden by a subclass can only be set in the subclass.
+//
+func (w *HProfWriter) AddInstance(class *WClass, values map[string]interface{}) HeapId {
+    hid := w.newId()
+    w.AddInstanceAt(hid, class, values)
+    return hid
+}
+
+// Allocate a heap id for an instance added later with AddInstanceAt, so objects
+// can refer to each other in cycles.
+//
+func (w *HProfWriter) ReserveId() HeapId {
+    return w.newId()
+}
+
+// Same as AddInstance, with a heap id from ReserveId.
+//
+func (w *HProfWriter) AddInstanceAt(hid HeapId, class *WClass, values map[string]interface{}) {
+    var data bytes.Buffer
+    seen := make(map[string]bool)
+    for c := class; c != nil; c = c.Super {
+        for _, field := range c.Fields {
+            if seen[field.Name] {
+                w.putValue(&data, field, nil)
+            } else {
+                w.putValue(&data, field, values[field.Name])
+                seen[field.Name] = true
+            }
+        }
+    }
+    w.objects.WriteByte(0x21)
+    w.putId(&w.objects, hid)
+    w.putU4(&w.objects, 0)
+    w.putId(&w.objects, class.Hid)
+    w.putU4(&w.objects, uint32(data.Len()))
+    w.objects.Write(data.Bytes())
+}
+
+// Add an object array with the given element class name e.g. "java.lang.Object"
+// and contents.
+//
+func (w *HProfWriter) AddObjectArray(elementClass string, elements []HeapId) HeapId {
+    name := "[L" + strings.Replace(elementClass, ".", "/", -1) + ";"
+    class := w.classesByName[name]
+    if class == nil {
+        class = w.DefineClass(name, nil)
+    }
+    hid := w.newId()
+    w.objects.WriteByte(0x22)
+    w.putId(&w.objects, hid)
+    w.putU4(&w.objects, 0)
+    w.putU4(&w.objects, uint32(len(elements)))
+    w.putId(&w.objects, class.Hid)
+    for _, element := range elements {
+        w.putId(&w.objects, element)
+    }
+    return hid
+}
+
+// Add a primitive array.  Contents must be a slice of the matching Go type
+// e.g. []uint16 for char[], []int32 for int[]; panics if not.
+//
+func (w *HProfWriter) AddPrimitiveArray(jtype string, contents interface{}) HeapId {
+    tag, ok := wtypes[jtype]
+    if !ok {
+        panic(fmt.Sprintf("can't add a %s[], %s isn't a primitive type", jtype, jtype))
+    }
+    if wanted := reflect.SliceOf(wgotypes[tag]); reflect.TypeOf(contents) != wanted {
+        panic(fmt.Sprintf("contents for %s[] are %T, not %s", jtype, contents, wanted))
+    }
+    var data bytes.Buffer
+    binary.Write(&data, binary.BigEndian, contents)
+    size := wsizes[tag]
+    hid := w.newId()
+    w.objects.WriteByte(0x23)
+    w.putId(&w.objects, hid)
+    w.putU4(&w.objects, 0)
+    w.putU4(&w.objects, uint32(data.Len() / size))
+    w.objects.WriteByte(tag)
+    w.objects.Write(data.Bytes())
+    return hid
+}
+
+// Add a java.lang.String with UTF-16 contents.
+//
+func (w *HProfWriter) AddString(value string) HeapId {
+    array := w.AddPrimitiveArray("char", utf16.Encode([]rune(value)))
+    return w.AddInstance(w.classesByName["java.lang.String"],
+                         map[string]interface{}{"value": array})
+}
+
+// Add a GC root of the given HPROF sub-record tag e.g. 0x01 for JNI global.
+// Extra per-root data (thread serial, frame number) is written as zeroes unless
+// given.
+//
+func (w *HProfWriter) AddRoot(tag byte, hid HeapId, extra ...uint32) {
+    w.objects.WriteByte(tag)
+    w.putId(&w.objects, hid)
+    words := map[byte]int{0x01: 0, 0x02: 2, 0x03: 2, 0x04: 1, 0x05: 0,
+                          0x06: 1, 0x07: 0, 0x08: 2, 0xff: 0}[tag]
+    if tag == 0x01 {
+        w.putId(&w.objects, 0) // JNI global ref id
+    }
+    for i := 0; i < words; i++ {
+        if i < len(extra) {
+            w.putU4(&w.objects, extra[i])
+        } else {
+            w.putU4(&w.objects, 0)
+        }
+    }
+}
+
+// Add a STACK_FRAME record for a method in a class, returning the frame id.
+// Line is the line number, or -1 for unknown, -3 for a native method.
+//
+func (w *HProfWriter) AddStackFrame(class *WClass, method string, source string, line int32) HeapId {
+    hid := w.newId()
+    var body bytes.Buffer
+    w.putId(&body, hid)
+    w.putId(&body, w.stringId(method))
+    w.putId(&body, w.stringId("()V"))
+    if source == "" {
+        w.putId(&body, 0)
+    } else {
+        w.putId(&body, w.stringId(source))
+    }
+    w.putU4(&body, class.serial)
+    w.putU4(&body, uint32(line))
+    w.putRecord(&w.stacks, 0x04, body.Bytes())
+    return hid
+}
+
+// Add a STACK_TRACE record with the given frames, innermost first.
+//
+func (w *HProfWriter) AddStackTrace(serial uint32, threadSerial uint32, frames ...HeapId) {
+    var body bytes.Buffer
+    w.putU4(&body, serial)
+    w.putU4(&body, threadSerial)
+    w.putU4(&body, uint32(len(frames)))
+    for _, frame := range frames {
+        w.putId(&body, frame)
+    }
+    w.putRecord(&w.stacks, 0x05, body.Bytes())
+}
+
+// Add a START_THREAD record.
+//
+func (w *HProfWriter) AddThread(serial uint32, thread HeapId, traceSerial uint32, name string) {
+    var body bytes.Buffer
+    w.putU4(&body, serial)
+    w.putId(&body, thread)
+    w.putU4(&body, traceSerial)
+    w.putId(&body, w.stringId(name))
+    w.putId(&body, 0)
+    w.putId(&body, 0)
+    w.putRecord(&w.stacks, 0x0a, body.Bytes())
+}
+
+// Write the dump to a file.
+//
+func (w *HProfWriter) WriteFile(filename string) error {
+    file, err := os.Create(filename)
+    if err != nil {
+        return err
+    }
+    if err = w.WriteDump(file); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+// Write the dump: header, UTF8 and LOAD_CLASS records, then a single heap dump
+// segment with class dumps ahead of everything else.
+//
+func (w *HProfWriter) WriteDump(out io.Writer) error {
+
+    // Class dumps first, since they reference field name strings.
+
+    var classDumps bytes.Buffer
+    for _, class := range w.classes {
+        w.putClassDump(&classDumps, class)
+    }
+    for _, class := range w.classes {
+        w.stringId(w.jvmName(class))
+    }
+
+    var buf bytes.Buffer
+    buf.WriteString("JAVA PROFILE 1.0.2")
+    buf.WriteByte(0)
+    w.putU4(&buf, w.IdSize)
+    w.putU4(&buf, 0)
+    w.putU4(&buf, 0)
+
+    for _, str := range w.stringOrder {
+        var body bytes.Buffer
+        w.putId(&body, w.strings[str])
+        body.WriteString(str)
+        w.putRecord(&buf, 0x01, body.Bytes())
+    }
+
+    for _, class := range w.classes {
+        var body bytes.Buffer
+        w.putU4(&body, class.serial)
+        w.putId(&body, class.Hid)
+        w.putU4(&body, 0)
+        w.putId(&body, w.strings[w.jvmName(class)])
+        w.putRecord(&buf, 0x02, body.Bytes())
+    }
+
+    buf.Write(w.stacks.Bytes())
+
+    segment := append(classDumps.Bytes(), w.objects.Bytes()...)
+    w.putRecord(&buf, 0x1c, segment)
+    w.putRecord(&buf, 0x2c, nil)
+
+    _, err := out.Write(buf.Bytes())
+    return err
+}
+
+// Return the slash-separated name for a class as found in LOAD_CLASS.
+//
+func (w *HProfWriter) jvmName(class *WClass) string {
+    return strings.Replace(class.Name, ".", "/", -1)
+}
+
+// Write a CLASS_DUMP sub-record.
+//
+func (w *HProfWriter) putClassDump(buf *bytes.Buffer, class *WClass) {
+    buf.WriteByte(0x20)
+    w.putId(buf, class.Hid)
+    w.putU4(buf, 0)
+    if class.Super != nil {
+        w.putId(buf, class.Super.Hid)
+    } else {
+        w.putId(buf, 0)
+    }
+    for i := 0; i < 5; i++ {
+        w.putId(buf, 0) // loader, signers, domain, reserved x2
+    }
+    w.putU4(buf, 0) // instance size
+    w.putU2(buf, 0) // constant pool
+    w.putU2(buf, uint16(len(class.Statics)))
+    for _, static := range class.Statics {
+        w.putId(buf, w.stringId(static.Name))
+        buf.WriteByte(w.typeTag(static.Type))
+        w.putValue(buf, static.WField, static.Value)
+    }
+    w.putU2(buf, uint16(len(class.Fields)))
+    for _, field := range class.Fields {
+        w.putId(buf, w.stringId(field.Name))
+        buf.WriteByte(w.typeTag(field.Type))
+    }
+}
+
+// Return the basic type tag for a field type, 2 for object references.
+//
+func (w *HProfWriter) typeTag(jtype string) byte {
+    tag, ok := wtypes[jtype]
+    if ok {
+        return tag
+    }
+    return 2
+}
+
+// Write a field value; nil means zero / null.  Panics if the value isn't a
+// HeapId for an object field or the matching Go type for a primitive one.
+//
+func (w *HProfWriter) putValue(buf *bytes.Buffer, field WField, value interface{}) {
+    tag := w.typeTag(field.Type)
+    if tag == 2 {
+        hid, ok := value.(HeapId)
+        if !ok && value != nil {
+            panic(fmt.Sprintf("value %v for field %s %s is %T, not HeapId", value, field.Type, field.Name, value))
+        }
+        w.putId(buf, hid)
+        return
+    }
+    if value == nil {
+        buf.Write(make([]byte, wsizes[tag]))
+        return
+    }
+    if reflect.TypeOf(value) != wgotypes[tag] {
+        panic(fmt.Sprintf("value %v for field %s %s is %T, not %s", value, field.Type, field.Name, value,
+                          wgotypes[tag]))
+    }
+    binary.Write(buf, binary.BigEndian, value)
+}
+
+// Write a top-level record with a zero timestamp.
+//
+func (w *HProfWriter) putRecord(buf *bytes.Buffer, tag byte, body []byte) {
+    buf.WriteByte(tag)
+    w.putU4(buf, 0)
+    w.putU4(buf, uint32(len(body)))
+    buf.Write(body)
+}
+
+func (w *HProfWriter) putId(buf *bytes.Buffer, hid HeapId) {
+    if w.IdSize == 8 {
+        binary.Write(buf, binary.BigEndian, uint64(hid))
+    } else {
+        binary.Write(buf, binary.BigEndian, uint32(hid))
+    }
+}
+
+func (w *HProfWriter) putU4(buf *bytes.Buffer, val uint32) {
+    binary.Write(buf, binary.BigEndian, val)
+}
+
+func (w *HProfWriter) putU2(buf *bytes.Buffer, val uint16) {
+    binary.Write(buf, binary.BigEndian, val)
+}
@@ -0,0 +1,473 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "encoding/gob"
+    "fmt"
+    "hash/crc32"
+    "math"
+    "os"
+    "unsafe"
+)
+
+// A sidecar index next to a heap dump holds everything ReadHeapDump builds, so
+// the dump need only be parsed once.  The layout is a fixed header, a gob-encoded
+// section for the small stuff (strings, classes, roots, threads), then the big
+// per-object & per-edge arrays in native byte order, each aligned to 8 bytes so
+// they can be used in place after mapping with MappedFile.  Every section has a
+// CRC, so a damaged or partly written index is rejected rather than giving wrong
+// graphs.  The index is valid only for a dump of the same size & modification
+// time.
+//
+const (
+    IndexMagic = "HELMETIX"
+    IndexVersion = 3
+    IndexSuffix = ".idx"
+)
+
+// Order of the arrays in an index
+//
+const (
+    indexObjectCids = iota
+    indexObjectSizes
+    indexObjectOffsets
+    indexOutEdges
+    indexOutOffsets
+    indexOutStarts
+    indexOutLabels
+    indexInEdges
+    indexInOffsets
+    indexInStarts
+    indexInLabels
+    indexObjectHids
+    numIndexArrays
+)
+
+// Sections up to this size are mapped and used in place.  Bigger ones, as for
+// the object & edge arrays of a large dump, don't fit in one mapped section and
+// are read into memory a section at a time.  A variable so tests can lower it.
+//
+var maxIndexSection = uint64(math.MaxInt32 - 8192)
+
+type indexHeader struct {
+    Magic [8]byte
+    Version uint32
+    // 1 if the arrays are little-endian
+    LittleEndian uint32
+    // size & modification time of the heap dump, in nanoseconds
+    DumpSize uint64
+    DumpTime int64
+    IdSize uint32
+    // 1 if the arrays include the reference graph
+    HasGraph uint32
+    MetaOffset uint64
+    MetaLength uint64
+    MetaCRC uint32
+    // 1 if the arrays include object heap ids
+    HasHids uint32
+    // offset & length in bytes of each array
+    Arrays [numIndexArrays][2]uint64
+    ArrayCRCs [numIndexArrays]uint32
+}
+
+// Everything other than the big arrays.  ClassDefs and the Graph are rebuilt
+// from their parts.
+//
+type indexMeta struct {
+    Strings map[HeapId]string
+    ClassNames map[HeapId]HeapId
+    Classes []indexClass
+    GCRoots []*GCRoot
+    Roots []ObjectId
+    Threads []*Thread
+    MaxObjectId ObjectId
+    MaxNode ObjectId
+    Dangling []DanglingRef
+}
+
+type indexClass struct {
+    // name as found in the heap dump, so AddClass can recognize primitive arrays
+    RawName string
+    Hid HeapId
+    SuperHid HeapId
+    LoaderHid HeapId
+    Loader ObjectId
+    Oid ObjectId
+    FieldNames []string
+    // index of each field's JType in Heap.Jtypes
+    FieldTypes []int
+    StaticRefs []HeapId
+    StaticNames []string
+}
+
+// Return the index filename for a heap dump.
+//
+func IndexName(filename string) string {
+    return filename + IndexSuffix
+}
+
+// Write an index for a heap that was read from the given dump.
+//
+func WriteIndex(heap *Heap, dump *MappedFile, indexName string) error {
+
+    info, err := dump.file.Stat()
+    if err != nil {
+        return err
+    }
+
+    meta := &indexMeta{
+        Strings: heap.strings,
+        ClassNames: heap.classNames,
+        GCRoots: heap.gcRoots,
+        Roots: heap.roots,
+        Threads: heap.threads,
+        MaxObjectId: heap.MaxObjectId,
+        Dangling: heap.dangling,
+    }
+
+    jtypeIndex := make(map[*JType]int)
+    for i, jtype := range heap.Jtypes {
+        jtypeIndex[jtype] = i
+    }
+    for _, class := range heap.classes[1:] {
+        iclass := indexClass{
+            RawName: heap.StringWithId(heap.classNames[class.Hid]),
+            Hid: class.Hid,
+            SuperHid: class.SuperHid,
+            LoaderHid: class.LoaderHid,
+            Loader: class.Loader,
+            Oid: class.Oid,
+            StaticRefs: class.staticRefs,
+            StaticNames: class.staticNames,
+        }
+        if iclass.RawName == "" {
+            iclass.RawName = class.Name // synthesized by PostProcess
+        }
+        for _, field := range class.fields {
+            iclass.FieldNames = append(iclass.FieldNames, field.Name)
+            iclass.FieldTypes = append(iclass.FieldTypes, jtypeIndex[field.JType])
+        }
+        meta.Classes = append(meta.Classes, iclass)
+    }
+
+    header := &indexHeader{
+        Version: IndexVersion,
+        DumpSize: uint64(info.Size()),
+        DumpTime: info.ModTime().UnixNano(),
+        IdSize: heap.IdSize,
+    }
+    copy(header.Magic[:], IndexMagic)
+    if isLittleEndian() {
+        header.LittleEndian = 1
+    }
+
+    arrays := make([][]byte, numIndexArrays)
+    arrays[indexObjectCids] = rawBytes(unsafe.Pointer(&heap.objectCids[0]), len(heap.objectCids) * 4)
+    arrays[indexObjectSizes] = rawBytes(unsafe.Pointer(&heap.objectSizes[0]), len(heap.objectSizes) * 4)
+    arrays[indexObjectOffsets] = rawBytes(unsafe.Pointer(&heap.objectOffsets[0]), len(heap.objectOffsets) * 8)
+    if heap.objectHids != nil {
+        arrays[indexObjectHids] = rawBytes(unsafe.Pointer(&heap.objectHids[0]), len(heap.objectHids) * 8)
+        header.HasHids = 1
+    }
+
+    if heap.Graph != nil {
+        if unsafe.Sizeof(int(0)) != 8 {
+            return fmt.Errorf("Can't index the graph on a 32-bit platform")
+        }
+        meta.MaxNode = heap.Graph.MaxNode
+        header.HasGraph = 1
+        for i, edges := range []*EdgeSet{heap.Graph.outs, heap.Graph.ins} {
+            base := indexOutEdges + i * (indexInEdges - indexOutEdges)
+            arrays[base] = edgeBytes(edges.edges)
+            arrays[base+1] = rawBytes(unsafe.Pointer(&edges.offsets[0]), len(edges.offsets) * 8)
+            arrays[base+2] = rawBytes(unsafe.Pointer(&edges.isStart[0]), len(edges.isStart))
+            if len(edges.labels) > 0 {
+                arrays[base+3] = rawBytes(unsafe.Pointer(&edges.labels[0]), len(edges.labels) * 4)
+            }
+        }
+    }
+
+    var metaBuf bytes.Buffer
+    if err := gob.NewEncoder(&metaBuf).Encode(meta); err != nil {
+        return err
+    }
+
+    // Lay out the sections after the header.
+
+    align := func(offset uint64) uint64 {
+        return (offset + 7) &^ 7
+    }
+    offset := align(uint64(binary.Size(header)))
+    header.MetaOffset = offset
+    header.MetaLength = uint64(metaBuf.Len())
+    header.MetaCRC = crc32.ChecksumIEEE(metaBuf.Bytes())
+    offset = align(offset + header.MetaLength)
+    for i, array := range arrays {
+        header.Arrays[i] = [2]uint64{offset, uint64(len(array))}
+        header.ArrayCRCs[i] = crc32.ChecksumIEEE(array)
+        offset = align(offset + uint64(len(array)))
+    }
+
+    file, err := os.Create(indexName)
+    if err != nil {
+        return err
+    }
+    out := bufio.NewWriter(file)
+    written := uint64(0)
+    write := func(data []byte) {
+        if err == nil {
+            padding := align(written) - written
+            _, err = out.Write(make([]byte, padding))
+            if err == nil {
+                _, err = out.Write(data)
+            }
+            written += padding + uint64(len(data))
+        }
+    }
+
+    var headerBuf bytes.Buffer
+    binary.Write(&headerBuf, binary.LittleEndian, header)
+    write(headerBuf.Bytes())
+    write(metaBuf.Bytes())
+    for _, array := range arrays {
+        write(array)
+    }
+    if err == nil {
+        err = out.Flush()
+    }
+    if err != nil {
+        file.Close()
+        os.Remove(indexName)
+        return err
+    }
+    return file.Close()
+}
+
+// Read the index for a heap dump.  Returns an error if there is none, or it's
+// out of date or damaged, or it lacks the reference graph or heap ids and options
+// call for them.
+//
+func ReadIndex(dump *MappedFile, indexName string, options *Options) (heap *Heap, err error) {
+
+    defer recoverReadError(&err) // from AddClass or Cook if the index is bad
+
+    info, err := dump.file.Stat()
+    if err != nil {
+        return nil, err
+    }
+    index, err := MapFile(indexName)
+    if err != nil {
+        return nil, err
+    }
+    defer index.Close() // mapped sections remain valid
+
+    header := &indexHeader{}
+    size := uint32(binary.Size(header))
+    if index.Size < uint64(size) {
+        return nil, fmt.Errorf("Index %s is truncated", indexName)
+    }
+    in := index.MapAt(0)
+    binary.Read(bytes.NewReader(in.GetRaw(size)), binary.LittleEndian, header)
+    in.unmap()
+
+    switch {
+        case string(header.Magic[:]) != IndexMagic:
+            return nil, fmt.Errorf("%s is not an index", indexName)
+        case header.Version != IndexVersion:
+            return nil, fmt.Errorf("Index %s is version %d, not %d", indexName, header.Version, IndexVersion)
+        case (header.LittleEndian == 1) != isLittleEndian():
+            return nil, fmt.Errorf("Index %s has the wrong byte order", indexName)
+        case header.DumpSize != uint64(info.Size()) || header.DumpTime != info.ModTime().UnixNano():
+            return nil, fmt.Errorf("Index %s is out of date", indexName)
+        case options.NeedRefs && header.HasGraph == 0:
+            return nil, fmt.Errorf("Index %s has no reference graph", indexName)
+        case options.NeedHids && header.HasHids == 0:
+            return nil, fmt.Errorf("Index %s has no heap ids", indexName)
+    }
+
+    // Map each section in place if it fits.  Sections stay mapped as long as the
+    // heap is in use.
+
+    section := func(offset, length uint64) ([]byte, error) {
+        if length == 0 {
+            return nil, nil
+        }
+        if offset + length > index.Size {
+            return nil, fmt.Errorf("Index %s has a bad section at %d", indexName, offset)
+        }
+        in := index.MapAt(offset)
+        if length <= maxIndexSection {
+            return in.GetRaw(uint32(length)), nil
+        }
+        data := make([]byte, length)
+        for done := uint64(0); done < length; {
+            chunk := length - done
+            if chunk > maxIndexSection {
+                chunk = maxIndexSection
+            }
+            in.Seek(offset + done)
+            in.Demand(uint32(chunk))
+            copy(data[done:], in.GetRaw(uint32(chunk)))
+            done += chunk
+        }
+        in.unmap()
+        return data, nil
+    }
+
+    metaBytes, err := section(header.MetaOffset, header.MetaLength)
+    if err != nil {
+        return nil, err
+    }
+    if crc32.ChecksumIEEE(metaBytes) != header.MetaCRC {
+        return nil, fmt.Errorf("Index %s is corrupt", indexName)
+    }
+    meta := &indexMeta{}
+    if err := gob.NewDecoder(bytes.NewReader(metaBytes)).Decode(meta); err != nil {
+        return nil, err
+    }
+
+    arrays := make([][]byte, numIndexArrays)
+    for i := range arrays {
+        arrays[i], err = section(header.Arrays[i][0], header.Arrays[i][1])
+        if err != nil {
+            return nil, err
+        }
+        if crc32.ChecksumIEEE(arrays[i]) != header.ArrayCRCs[i] {
+            return nil, fmt.Errorf("Index %s is corrupt", indexName)
+        }
+    }
+
+    // The CRCs don't catch a header that's consistent but wrong, so check the
+    // array lengths against the object & node counts too.
+
+    numObjects := int(meta.MaxObjectId) + 1
+    numEdges := len(arrays[indexOutEdges]) / 4
+    wanted := [numIndexArrays]int{
+        indexObjectCids: numObjects * 4,
+        indexObjectSizes: numObjects * 4,
+        indexObjectOffsets: numObjects * 8,
+    }
+    if header.HasGraph == 1 {
+        for _, base := range []int{indexOutEdges, indexInEdges} {
+            wanted[base] = numEdges * 4
+            wanted[base+1] = (int(meta.MaxNode) + 1) * 8
+            wanted[base+2] = numEdges + 1
+            if len(arrays[base+3]) > 0 {
+                wanted[base+3] = numEdges * 4
+            }
+        }
+    }
+    if header.HasHids == 1 {
+        wanted[indexObjectHids] = numObjects * 8
+    }
+    for i, length := range wanted {
+        if len(arrays[i]) != length {
+            return nil, fmt.Errorf("Index %s has %d bytes in array %d, not %d", indexName, len(arrays[i]), i, length)
+        }
+    }
+
+    // Rebuild the heap the way HProfReader would.
+
+    heap = NewHeap(header.IdSize)
+    heap.strings = meta.Strings
+    heap.classNames = meta.ClassNames
+    for _, iclass := range meta.Classes {
+        types := make([]*JType, len(iclass.FieldTypes))
+        for i, t := range iclass.FieldTypes {
+            types[i] = heap.Jtypes[t]
+        }
+        class := heap.AddClass(iclass.RawName, iclass.Hid, iclass.SuperHid, iclass.FieldNames, types,
+                               iclass.StaticRefs, iclass.StaticNames)
+        class.LoaderHid = iclass.LoaderHid
+        class.Loader = iclass.Loader
+        class.Oid = iclass.Oid
+        if class.Oid != 0 {
+            heap.classesByOid[class.Oid] = class
+        }
+    }
+    for _, class := range heap.classes[1:] {
+        class.Cook()
+    }
+
+    heap.gcRoots = meta.GCRoots
+    heap.roots = meta.Roots
+    heap.threads = meta.Threads
+    heap.MaxObjectId = meta.MaxObjectId
+    heap.dangling = meta.Dangling
+    heap.DanglingRefs = len(meta.Dangling)
+    heap.objectMap = nil
+
+    heap.objectCids = unsafe.Slice((*ClassId)(unsafe.Pointer(&arrays[indexObjectCids][0])), numObjects)
+    heap.objectSizes = unsafe.Slice((*uint32)(unsafe.Pointer(&arrays[indexObjectSizes][0])), numObjects)
+    heap.objectOffsets = unsafe.Slice((*uint64)(unsafe.Pointer(&arrays[indexObjectOffsets][0])), numObjects)
+    if header.HasHids == 1 {
+        heap.objectHids = unsafe.Slice((*HeapId)(unsafe.Pointer(&arrays[indexObjectHids][0])), numObjects)
+    }
+
+    if header.HasGraph == 1 {
+        heap.Graph = &Graph{MaxNode: meta.MaxNode}
+        edgeSet := func(base int) *EdgeSet {
+            e := &EdgeSet{}
+            if numEdges > 0 {
+                e.edges = unsafe.Slice((*ObjectId)(unsafe.Pointer(&arrays[base][0])), numEdges)
+            }
+            e.offsets = unsafe.Slice((*int)(unsafe.Pointer(&arrays[base+1][0])), meta.MaxNode + 1)
+            e.isStart = unsafe.Slice((*bool)(unsafe.Pointer(&arrays[base+2][0])), numEdges + 1)
+            if len(arrays[base+3]) > 0 {
+                e.labels = unsafe.Slice((*uint32)(unsafe.Pointer(&arrays[base+3][0])), numEdges)
+            }
+            return e
+        }
+        heap.Graph.outs = edgeSet(indexOutEdges)
+        heap.Graph.ins = edgeSet(indexInEdges)
+    }
+
+    return heap, nil
+}
+
+// View the memory behind a slice as bytes.
+//
+func rawBytes(ptr unsafe.Pointer, length int) []byte {
+    if length == 0 {
+        return nil
+    }
+    return (*[1 << 40]byte)(ptr)[:length:length]
+}
+
+// Same, for an edge list, which may be empty.
+//
+func edgeBytes(edges []ObjectId) []byte {
+    if len(edges) == 0 {
+        return nil
+    }
+    return rawBytes(unsafe.Pointer(&edges[0]), len(edges) * 4)
+}
+
+func isLittleEndian() bool {
+    x := uint16(1)
+    return *(*byte)(unsafe.Pointer(&x)) == 1
+}
@@ -0,0 +1,125 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "bytes"
+    "io/ioutil"
+    . "launchpad.net/gocheck"
+    "os"
+)
+
+// Verify a heap read from an index matches the one read from the dump.
+//
+func (s *SearchSuite) TestIndex(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+    indexName := c.MkDir() + "/genheap.hprof.idx"
+
+    c.Assert(WriteIndex(heap, heap.file, indexName), IsNil)
+    indexed, err := ReadIndex(heap.file, indexName, &Options{NeedRefs: true})
+    c.Assert(err, IsNil)
+    indexed.file = heap.file
+
+    c.Check(indexed.MaxObjectId, Equals, heap.MaxObjectId)
+    c.Check(indexed.MaxClassId, Equals, heap.MaxClassId)
+    c.Check(indexed.Graph.MaxNode, Equals, heap.Graph.MaxNode)
+    c.Check(indexed.roots, DeepEquals, heap.roots)
+    for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+        c.Assert(indexed.ClassOf(oid).Name, Equals, heap.ClassOf(oid).Name)
+        c.Assert(indexed.SizeOf(oid), Equals, heap.SizeOf(oid))
+        dst, pos := heap.OutEdges(oid)
+        idst, ipos := indexed.OutEdges(oid)
+        for pos != 0 {
+            c.Assert(idst, Equals, dst)
+            c.Assert(indexed.OutLabel(ipos), Equals, heap.OutLabel(pos))
+            dst, pos = heap.NextOutEdge(pos)
+            idst, ipos = indexed.NextOutEdge(ipos)
+        }
+        c.Assert(ipos, Equals, 0)
+    }
+    c.Check(indexed.Dominators().ReachableSize(), Equals, heap.Dominators().ReachableSize())
+
+    var expected, actual bytes.Buffer
+    heap.ShowObject(&expected, heap.roots[0])
+    indexed.ShowObject(&actual, indexed.roots[0])
+    c.Check(actual.String(), Equals, expected.String())
+
+    // Sections too big to map in one piece are read in chunks.
+
+    saved := maxIndexSection
+    maxIndexSection = 1000
+    chunked, err := ReadIndex(heap.file, indexName, &Options{NeedRefs: true})
+    maxIndexSection = saved
+    c.Assert(err, IsNil)
+    c.Check(chunked.Graph.MaxNode, Equals, heap.Graph.MaxNode)
+    for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+        c.Assert(chunked.ClassOf(oid).Name, Equals, heap.ClassOf(oid).Name)
+        c.Assert(chunked.objectOffsets[oid], Equals, heap.objectOffsets[oid])
+    }
+    c.Check(chunked.Dominators().ReachableSize(), Equals, heap.Dominators().ReachableSize())
+
+    // An index for some other dump is rejected.
+
+    other, err := MapFile(indexName)
+    c.Assert(err, IsNil)
+    defer other.Close()
+    _, err = ReadIndex(other, indexName, &Options{NeedRefs: true})
+    c.Check(err, ErrorMatches, ".* is out of date")
+
+    // So is one without heap ids when they're needed, or with damaged arrays.
+
+    _, err = ReadIndex(heap.file, indexName, &Options{NeedRefs: true, NeedHids: true})
+    c.Check(err, ErrorMatches, ".* has no heap ids")
+
+    data, err := ioutil.ReadFile(indexName)
+    c.Assert(err, IsNil)
+    data[len(data) - 1] ^= 1
+    damaged := c.MkDir() + "/damaged.idx"
+    c.Assert(ioutil.WriteFile(damaged, data, 0644), IsNil)
+    _, err = ReadIndex(heap.file, damaged, &Options{NeedRefs: true})
+    c.Check(err, ErrorMatches, ".* is corrupt")
+}
+
+// Check that only reads with the reference graph write an index, and that one
+// written with heap ids gives them back.
+//
+func (s *SearchSuite) TestIndexWrites(c *C) {
+
+    LogTestOutput()
+    filename := c.MkDir() + "/small.hprof"
+    c.Assert(BuildGenHeap(100).WriteFile(filename), IsNil)
+
+    _, err := ReadHeapDump(filename, &Options{})
+    c.Assert(err, IsNil)
+    _, err = os.Stat(IndexName(filename))
+    c.Check(os.IsNotExist(err), Equals, true)
+
+    options := &Options{NeedRefs: true, NeedHids: true}
+    parsed, err := ReadHeapDump(filename, options)
+    c.Assert(err, IsNil)
+    indexed, err := ReadIndex(parsed.file, IndexName(filename), options)
+    c.Assert(err, IsNil)
+    c.Check(indexed.objectHids, DeepEquals, parsed.objectHids)
+}
@@ -0,0 +1,253 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "fmt"
+    "io"
+    "math"
+    "strconv"
+)
+
+// Show no more than this many array elements
+//
+const MaxShowElements = 100
+
+// Show no more than this much of a referenced string
+//
+const MaxShowText = 80
+
+// Print an object's contents, decoded from the heap dump: every field for an
+// instance, superclass fields included; the elements of an array; or the static
+// fields of a class object.  References are shown as object id and class, plus
+// the text for strings, if the reference graph was loaded, else as native heap ids.
+// Returns a *ReadError if the object can't be read, as in a damaged dump.
+//
+func (heap *Heap) ShowObject(out io.Writer, oid ObjectId) (err error) {
+
+    defer recoverReadError(&err)
+
+    class := heap.ClassOf(oid)
+    name := class.Name
+    if def := heap.ClassForObject(oid); def != nil {
+        name = "class " + def.Name
+    }
+    if heap.Graph != nil {
+        fmt.Fprintf(out, "%10d %s (%d bytes, retained %d)\n", oid, name, 
+                    heap.objectSizes[oid], heap.RetainedSizeOf(oid))
+    } else {
+        fmt.Fprintf(out, "%10d %s (%d bytes)\n", oid, name, heap.objectSizes[oid])
+    }
+    if text, ok := heap.StringValue(oid); ok {
+        fmt.Fprintf(out, "%10s %s\n", "", strconv.Quote(text))
+    }
+
+    // Find where each reference leads from the out edges, since the mapping
+    // from heap ids is gone.  See SegWorker for how the edges are labeled.
+
+    targets := make(map[uint32]ObjectId)
+    if heap.Graph != nil {
+        for dst, pos := heap.OutEdges(oid); pos != 0; dst, pos = heap.NextOutEdge(pos) {
+            targets[heap.OutLabel(pos)] = dst
+        }
+    }
+
+    in := heap.file.MapAt(heap.objectOffsets[oid])
+    defer in.unmap()
+    in.Demand(1)
+
+    switch tag := in.GetByte(); tag {
+        case 0x20: // CLASS_DUMP
+            heap.showStatics(out, in, targets)
+        case 0x21: // INSTANCE_DUMP
+            heap.showInstance(out, in, class, targets)
+        case 0x22, 0x23: // OBJECT_ARRAY, PRIMITIVE_ARRAY
+            heap.showArray(out, in, tag == 0x22, targets)
+        default:
+            fmt.Fprintf(out, "Unknown HPROF record type %d at %d\n", tag, heap.objectOffsets[oid])
+    }
+    return nil
+}
+
+// Print the fields of an INSTANCE_DUMP record.
+//
+func (heap *Heap) showInstance(out io.Writer, in *MappedSection, class *ClassDef, targets map[uint32]ObjectId) {
+
+    in.Skip(4 + 2 * heap.IdSize)
+    in.Demand(4)
+    in.Demand(in.GetUInt32())
+    start := in.Offset()
+
+    fields, offsets := class.Layout()
+    label := uint32(0)
+    for i, field := range fields {
+        in.Skip(uint32(start + uint64(offsets[i]) - in.Offset()))
+        var value string
+        if field.JType.IsObj {
+            value = heap.formatRef(heap.getId(in), targets, label)
+            label++
+        } else {
+            value = heap.formatValue(in, field.JType)
+        }
+        fmt.Fprintf(out, "%10s %s = %s\n", "", field.Name, value)
+    }
+}
+
+// Print the elements of an OBJECT_ARRAY or PRIMITIVE_ARRAY record, up to
+// MaxShowElements.
+//
+func (heap *Heap) showArray(out io.Writer, in *MappedSection, isObjects bool, targets map[uint32]ObjectId) {
+
+    in.Demand(heap.IdSize + 9)
+    in.Skip(heap.IdSize + 4)
+    count := in.GetUInt32()
+
+    var jtype *JType
+    if isObjects {
+        in.Skip(heap.IdSize)
+        jtype = heap.Jtypes[2]
+    } else {
+        jtype = heap.getJType(in)
+    }
+
+    shown := count
+    if shown > MaxShowElements {
+        shown = MaxShowElements
+    }
+    in.Demand(shown * jtype.Size)
+    for i := uint32(0); i < shown; i++ {
+        var value string
+        if isObjects {
+            value = heap.formatRef(heap.getId(in), targets, i)
+        } else {
+            value = heap.formatValue(in, jtype)
+        }
+        fmt.Fprintf(out, "%10s [%d] = %s\n", "", i, value)
+    }
+    if shown < count {
+        fmt.Fprintf(out, "%10s ... %d more\n", "", count - shown)
+    }
+}
+
+// Print the static fields of a CLASS_DUMP record.
+//
+func (heap *Heap) showStatics(out io.Writer, in *MappedSection, targets map[uint32]ObjectId) {
+
+    // Skip header & constant pool; see HProfReader.readClassDump
+
+    in.Demand(7 * heap.IdSize + 10)
+    in.Skip(7 * heap.IdSize + 8)
+    numConstants := in.GetUInt16()
+    in.Demand(11 * uint32(numConstants) + 2)
+    for i := 0; i < int(numConstants); i++ {
+        in.Skip(2)
+        in.Skip(heap.getJType(in).Size)
+    }
+
+    // Static references are labeled by their index among the non-null ones.
+
+    numStatics := in.GetUInt16()
+    in.Demand((heap.IdSize + 9) * uint32(numStatics))
+    label := uint32(0)
+    for i := 0; i < int(numStatics); i++ {
+        name := heap.StringWithId(heap.getId(in))
+        jtype := heap.getJType(in)
+        var value string
+        if jtype.IsObj {
+            hid := heap.getId(in)
+            value = heap.formatRef(hid, targets, label)
+            if hid != 0 {
+                label++
+            }
+        } else {
+            value = heap.formatValue(in, jtype)
+        }
+        fmt.Fprintf(out, "%10s static %s = %s\n", "", name, value)
+    }
+}
+
+// Format a reference found in an object, given the object's out edges by label.
+//
+func (heap *Heap) formatRef(hid HeapId, targets map[uint32]ObjectId, label uint32) string {
+    if hid == 0 {
+        return "null"
+    }
+    if oid := targets[label]; oid != 0 {
+        if text, ok := heap.StringValue(oid); ok {
+            if runes := []rune(text); len(runes) > MaxShowText {
+                text = string(runes[:MaxShowText]) + "..."
+            }
+            return fmt.Sprintf("%d (%s %s)", oid, heap.ClassOf(oid).Name, strconv.Quote(text))
+        }
+        return fmt.Sprintf("%d (%s)", oid, heap.ClassOf(oid).Name)
+    }
+    if heap.Graph == nil {
+        return fmt.Sprintf("0x%x", hid)
+    }
+    return fmt.Sprintf("0x%x (not in heap)", hid)
+}
+
+// Read a primitive value of the given type and format it the way Java would.
+//
+func (heap *Heap) formatValue(in *MappedSection, jtype *JType) string {
+    switch jtype.ArrayClass {
+        case "[Z":
+            return strconv.FormatBool(in.GetByte() != 0)
+        case "[C":
+            return strconv.QuoteRune(rune(in.GetUInt16()))
+        case "[F":
+            return strconv.FormatFloat(float64(math.Float32frombits(in.GetUInt32())), 'g', -1, 32)
+        case "[D":
+            return strconv.FormatFloat(math.Float64frombits(in.GetUInt64()), 'g', -1, 64)
+        case "[B":
+            return strconv.Itoa(int(int8(in.GetByte())))
+        case "[S":
+            return strconv.Itoa(int(int16(in.GetUInt16())))
+        case "[I":
+            return strconv.Itoa(int(in.GetInt32()))
+        case "[J":
+            return strconv.FormatInt(int64(in.GetUInt64()), 10)
+    }
+    in.Skip(jtype.Size)
+    return "?"
+}
+
+// Read a native ID from heap data; same as HProfReader.readId.
+//
+func (heap *Heap) getId(in *MappedSection) HeapId {
+    if heap.IdSize == 8 {
+        return HeapId(in.GetUInt64())
+    }
+    return HeapId(in.GetUInt32())
+}
+
+// Read a "Basic Type" ID from heap data and return the JType.  The parser only
+// checks the tags in records it reads, so a damaged dump can still have bad ones.
+//
+func (heap *Heap) getJType(in *MappedSection) *JType {
+    tag := int(in.GetByte())
+    if tag >= len(heap.Jtypes) || heap.Jtypes[tag] == nil {
+        panic(newReadError(ErrBadRecord, "unknown basic type %d at %d", tag, in.Offset() - 1))
+    }
+    return heap.Jtypes[tag]
+}
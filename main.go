@@ -25,9 +25,12 @@ package main
 import (
     "flag"
     "log"
+    "net/http"
     "os"
+    "path/filepath"
     "runtime"
     "runtime/pprof"
+    "strings"
 )
 
 // Processing options.
@@ -36,6 +39,12 @@ import (
 type Options struct {
     // do we need the reference graph
     NeedRefs bool
+    // don't read or write the sidecar index; see index.go
+    NoIndex bool
+    // keep the heap id of each object, for matching objects across heaps
+    NeedHids bool
+    // read what we can of a truncated or corrupt dump; see Heap.Losses
+    Lenient bool
 }
 
 func main() {
@@ -43,8 +52,34 @@ func main() {
     runtime.GOMAXPROCS(runtime.NumCPU())
     // runtime.GOMAXPROCS(1)
 
+    if len(os.Args) > 1 {
+        switch os.Args[1] {
+            case "diff":
+                diffMain(os.Args[2:])
+                return
+            case "serve":
+                serveMain(os.Args[2:], false)
+                return
+            case "web":
+                serveMain(os.Args[2:], true)
+                return
+            case "redact":
+                redactMain(os.Args[2:])
+                return
+        }
+    }
+
     cpuProfile := flag.String("cpuprofile", "", "write cpu profile to file")
     doHisto := flag.Bool("histo", false, "generate class histogram & exit")
+    doRetained := flag.Bool("retained", false, "generate class histogram with retained sizes & exit")
+    noIndex := flag.Bool("noindex", false, "don't read or write an index file next to the heap dump")
+    lenient := flag.Bool("lenient", false, "read what's there of a truncated or corrupt heap dump")
+    var commands commandList
+    flag.Var(&commands, "e", "run a command & exit; may be repeated")
+    scriptFile := flag.String("f", "", "run commands from file (- for stdin) & exit")
+    outFile := flag.String("o", "", "write command output to file")
+    format := flag.String("format", "", "output format: text, json or csv; overrides ~/.helmetrc")
+    noRC := flag.Bool("norc", false, "don't run commands from ~/.helmetrc")
     flag.Parse()
     args := flag.Args()
 
@@ -62,28 +97,159 @@ func main() {
             log.Fatal("Missing heap filename")
         case len(args) > 1:
             log.Fatal("Extra args following heap filename")
+        case *format != "" && reportFormats[*format] == nil:
+            log.Fatalf("Unknown output format %s", *format)
     }
 
     options := &Options{
-        NeedRefs: ! *doHisto,
+        NeedRefs: ! *doHisto || *doRetained,
+        NoIndex: *noIndex,
+        Lenient: *lenient,
     }
 
-    heap := ReadHeapDump(flag.Arg(0), options)
+    out := os.Stdout
+    if *outFile != "" {
+        f, err := os.Create(*outFile)
+        if err != nil {
+            log.Fatal(err)
+        }
+        out = f
+    }
+
+    heap := mustReadHeapDump(flag.Arg(0), options)
     session := &Session{
         Heap: heap,
         Settings: DefaultSettings(),
+        Out: out,
+    }
+    if home := os.Getenv("HOME"); home != "" && ! *noRC {
+        session.loadRC(filepath.Join(home, ".helmetrc"))
+    }
+    if *format != "" {
+        session.Settings["format"].StringValue = *format
+    }
+
+    // -histo and -retained list every class, as they always have, so scripts
+    // reading them see the same rows whatever ~/.helmetrc sets.
+
+    if *doHisto || *doRetained {
+        session.Settings["mingroupsize"].IntValue = 0
+        session.Settings["maxrows"].IntValue = 0
     }
 
-    if *doHisto {
-        // TODO rewrite using session.run()
-        histo := heap.NewHisto()
-        for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
-            class := heap.ClassOf(oid)
-            histo.Add(oid, class, heap.SizeOf(oid))
+    ok := true
+    switch {
+        case *doRetained:
+            ok = session.run("histo retained")
+        case *doHisto:
+            ok = session.run("histo")
+        case len(commands) > 0 || *scriptFile != "":
+            ok = session.runBatch(commands, *scriptFile)
+        default:
+            session.interact()
+    }
+
+    if out != os.Stdout {
+        if err := out.Close(); err != nil {
+            log.Fatal(err)
         }
-        histo.Print(os.Stdout)
-    } else {
-        session.interact()
     }
+    if ! ok {
+        pprof.StopCPUProfile()
+        os.Exit(1)
+    }
+}
+
+// Read a heap dump for one of the commands here, exiting if it can't be read.
+//
+func mustReadHeapDump(filename string, options *Options) *Heap {
+    heap, err := ReadHeapDump(filename, options)
+    if err != nil {
+        log.Fatal(err)
+    }
+    return heap
+}
+
+// Flag value for commands given with repeated -e options
+//
+type commandList []string
+
+func (list *commandList) String() string {
+    return strings.Join(*list, "; ")
 }
 
+func (list *commandList) Set(command string) error {
+    *list = append(*list, command)
+    return nil
+}
+
+
+// Compare two heap dumps, e.g. "helmet diff before.hprof after.hprof"
+//
+func diffMain(argv []string) {
+
+    flags := flag.NewFlagSet("diff", flag.ExitOnError)
+    doObjects := flags.Bool("objects", true, "match objects by heap id to find survivors")
+    format := flags.String("format", "text", "output format: text, json or csv")
+    lenient := flags.Bool("lenient", false, "read what's there of truncated or corrupt heap dumps")
+    flags.Parse(argv)
+    if flags.NArg() != 2 {
+        log.Fatal("Usage: helmet diff [-objects=false] [-format f] [-lenient] before.hprof after.hprof")
+    }
+    report := NewReportWriter(*format, os.Stdout)
+    if report == nil {
+        log.Fatalf("Unknown output format %s", *format)
+    }
+
+    options := &Options{NeedRefs: true, NeedHids: *doObjects, Lenient: *lenient}
+    before := mustReadHeapDump(flags.Arg(0), options)
+    after := mustReadHeapDump(flags.Arg(1), options)
+
+    PrintDiff(report, DiffHeaps(before, after))
+    if *doObjects {
+        counts, moved := MatchObjects(before, after)
+        PrintSurvivors(report, counts, moved)
+    }
+}
+
+// Serve one heap dump over HTTP, e.g. "helmet serve -listen :8080 dump.hprof",
+// optionally with the web UI, as for "helmet web".
+//
+func serveMain(argv []string, withUI bool) {
+
+    flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+    listen := flags.String("listen", ":8080", "address to listen on")
+    noIndex := flags.Bool("noindex", false, "don't read or write an index file next to the heap dump")
+    lenient := flags.Bool("lenient", false, "read what's there of a truncated or corrupt heap dump")
+    flags.Parse(argv)
+    if flags.NArg() != 1 {
+        log.Fatalf("Usage: helmet %s [-listen addr] [-lenient] dump.hprof", os.Args[1])
+    }
+
+    heap := mustReadHeapDump(flags.Arg(0), &Options{NeedRefs: true, NoIndex: *noIndex, Lenient: *lenient})
+    server := NewServer(heap)
+    if withUI {
+        server.AddWebUI()
+    }
+    log.Printf("Serving %s on %s\n", flags.Arg(0), *listen)
+    log.Fatal(http.ListenAndServe(*listen, server))
+}
+
+// Write a copy of a heap dump without application data, e.g. "helmet redact
+// -names mapping.txt customer.hprof safe.hprof"; see Redactor.
+//
+func redactMain(argv []string) {
+
+    flags := flag.NewFlagSet("redact", flag.ExitOnError)
+    hash := flags.Bool("hash", false, "fill arrays & fields from a hash of their contents, so equal values stay equal")
+    mappingFile := flags.String("names", "", "rename application classes, fields & methods, writing the mapping to this file")
+    flags.Parse(argv)
+    if flags.NArg() != 2 {
+        log.Fatal("Usage: helmet redact [-hash] [-names mapping.txt] in.hprof out.hprof")
+    }
+
+    options := &RedactOptions{Hash: *hash, MappingFile: *mappingFile}
+    if err := Redact(flags.Arg(0), flags.Arg(1), options); err != nil {
+        log.Fatal(err)
+    }
+}
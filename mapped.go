@@ -23,6 +23,7 @@
 package main
 
 import (
+    "fmt"
     "log"
     "math"
     "os"
@@ -78,7 +79,7 @@ func MapFile(filename string) (mf *MappedFile, err error) {
 }
 
 // Map the largest possible section starting at a given offset.  Normally this is called 
-// automatically by Demand().  Panics on failure since there is no recovery.
+// automatically by Demand().  Panics with a *ReadError on failure; see recoverReadError.
 //
 func (mf *MappedFile) MapAt(offset uint64) *MappedSection {
     ms := &MappedSection{MappedFile: mf}
@@ -100,6 +101,10 @@ func (ms *MappedSection) remapAt(offset uint64) {
     if ms.base != nil {
         ms.unmap()
     }
+    if offset > ms.Size {
+        panic(&ReadError{Filename: ms.Filename, Offset: offset, Tag: NoTag, Err: ErrTruncated,
+                         Detail: fmt.Sprintf("file is only %d bytes", ms.Size)})
+    }
     skew := offset % 8192
     offset = offset - skew
     length := ms.Size - offset
@@ -109,7 +114,8 @@ func (ms *MappedSection) remapAt(offset uint64) {
     bytes, err := syscall.Mmap(int(ms.file.Fd()), int64(offset), int(length),
                                syscall.PROT_READ, syscall.MAP_SHARED)
     if err != nil {
-        log.Fatalf("Can't map %s %d bytes at %d: %s\n", ms.Filename, length, offset, err)
+        panic(&ReadError{Filename: ms.Filename, Offset: offset, Tag: NoTag, Err: err,
+                         Detail: fmt.Sprintf("can't map %d bytes", length)})
     }
     ms.base = bytes
     ms.size = uint32(length)
@@ -196,7 +202,7 @@ func (ms *MappedSection) GetUInt32() uint32 {
 //
 func (ms *MappedSection) GetUInt64() uint64 {
     buf := ms.base[ms.localOffset:]
-    bits := uint64(buf[0]) << 54 |
+    bits := uint64(buf[0]) << 56 |
             uint64(buf[1]) << 48 |
             uint64(buf[2]) << 40 |
             uint64(buf[3]) << 32 |
@@ -238,6 +244,16 @@ func (ms *MappedSection) Skip(count uint32) {
     */
 }
 
+// Move to a global file offset, remapping only if it's outside the section.
+//
+func (ms *MappedSection) Seek(offset uint64) {
+    if offset >= ms.baseOffset && offset < ms.baseOffset + uint64(ms.size) {
+        ms.localOffset = uint32(offset - ms.baseOffset)
+    } else {
+        ms.remapAt(offset)
+    }
+}
+
 // Return the global file offset
 //
 func (ms *MappedSection) Offset() uint64 {
@@ -23,6 +23,8 @@
 package main
 
 import (
+    "bytes"
+    "encoding/binary"
     "math/rand"
     "testing"
 )
@@ -39,6 +41,49 @@ func TestDemangle(t *testing.T) {
     try("com/foo/Bar", "com.foo.Bar")
 }
 
+func TestDecodeText(t *testing.T) {
+    try := func(result, wanted string) {
+        if result != wanted {
+            t.Errorf("Wanted %q but got %q\n", wanted, result)
+        }
+    }
+    try(decodeLatin1([]byte{'c', 'a', 'f', 0xe9}), "caf\u00e9")
+    try(decodeUTF16([]byte{0, 'h', 0, 'i', 0x20, 0xac}, binary.BigEndian), "hi\u20ac")
+    try(decodeUTF16([]byte{'h', 0, 'i', 0, 0x3d, 0xd8, 0x00, 0xde}, binary.LittleEndian), "hi\U0001f600")
+}
+
+func TestReportWriters(t *testing.T) {
+    try := func(format, wanted string) {
+        var buf bytes.Buffer
+        out := NewReportWriter(format, &buf)
+        out.Begin("histo", Column{"count", "%10v"}, Column{"class", "%v"}, Column{"note", "(%v)"})
+        out.Row(3, "java.lang.String", "")
+        out.Note("%21s detail", "")
+        out.Row(nil, "x,\"y\"", "new")
+        out.Total(3, "total", "")
+        if buf.String() != wanted {
+            t.Errorf("For %s wanted\n%s\nbut got\n%s\n", format, wanted, buf.String())
+        }
+    }
+    try("text", "         3 java.lang.String\n" +
+                "                      detail\n" +
+                "         - x,\"y\" (new)\n" +
+                "         3 total\n")
+    try("json", `{"report":"histo","count":3,"class":"java.lang.String","note":""}` + "\n" +
+                `{"report":"histo","note":"detail"}` + "\n" +
+                `{"report":"histo","count":null,"class":"x,\"y\"","note":"new"}` + "\n" +
+                `{"report":"histo","count":3,"class":"total","note":"","total":true}` + "\n")
+    try("csv", "count,class,note\n3,java.lang.String,\n,,detail\n,\"x,\"\"y\"\"\",new\n3,total,\n")
+    var buf bytes.Buffer
+    NewCSVReport(&buf).Note("%s", "early")
+    if buf.String() != "early\n" {
+        t.Errorf("Wanted a one-column note before Begin, got %q\n", buf.String())
+    }
+    if NewReportWriter("xml", nil) != nil {
+        t.Errorf("Wanted no writer for unknown format\n")
+    }
+}
+
 func TestBitSet(t *testing.T) {
     var flags [1000000]bool
     bits := NewBitSet(uint32(len(flags)))
@@ -23,7 +23,6 @@
 package main
 
 import (
-    "log"
     "sync"
 )
 
@@ -48,7 +47,7 @@ type omSlot struct {
 
 func (m *ObjectMap) Add(hid HeapId, oid ObjectId) {
     if hid > MaxHeapId {
-        log.Fatalf("Heap ID %x too big\n", hid)
+        panic(newReadError(ErrBadRecord, "heap id %#x too big", hid))
     }
     index := hid >> 16
     slot := m[index]
@@ -26,6 +26,9 @@ import (
     "fmt"
     . "github.com/jonross/peggy"
     "reflect"
+    "regexp"
+    "strconv"
+    "strings"
 )
 
 // Represents a function call in a query.  This is a temporary artifact of the
@@ -36,6 +39,23 @@ type QFun struct {
     fnArgs []string
 }
 
+// Represents a "where" clause on a query step.  This is a temporary artifact of
+// the parsing code, like QFun; the Predicate is what's used during searches.
+//
+type WhereClause struct {
+    varName string
+    Predicate
+    err error
+}
+
+// Represents a field-qualified arrow in a query path, e.g. -[value]->; another
+// temporary artifact of the parsing code.
+//
+type fieldArrow struct {
+    to bool
+    field string
+}
+
 // Several nodes from the PEG grammar are returned by NewParsers so it's easy
 // to test each individually.
 //
@@ -44,6 +64,16 @@ type Parsers struct {
     Step *Parser
     Path *Parser
     Search *Parser
+    Histo *Parser
+    RootPath *Parser
+    Skip *Parser
+    RootsByKind *Parser
+    Roots *Parser
+    Threads *Parser
+    Show *Parser
+    Dups *Parser
+    Collections *Parser
+    Dangling *Parser
     Setting *Parser
     Command *Parser
 }
@@ -55,31 +85,99 @@ func NewParsers() *Parsers {
 
     letter := AnyOf("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz_$")
     digit := AnyOf("0123456789")
+    quotable := ""
+    for c := ' '; c <= '~'; c++ {
+        if c != '"' {
+            quotable += string(c)
+        }
+    }
     identifier := Sequence(letter, ZeroOrMoreOf(OneOf(letter, digit))).Adjacent().As(String)
+    number := OneOrMoreOf(digit).Adjacent().As(Int)
 
     // Match e.g. Integer, com.myco.*, long[][]
     className := Sequence(identifier, ZeroOrMoreOf(Sequence(".", identifier)), 
                           Optional(OneOf(".*", OneOrMoreOf("[]")))).Adjacent().As(String)
 
-    // Match classname followed by optional step var name, and generate a Step
-    step := Sequence(className, Optional(identifier)).
+    // Match e.g. "jdbc:.*" including the quotes
+    quoted := Sequence("\"", ZeroOrMoreOf(AnyOf(quotable)), "\"").Adjacent().As(String)
+
+    // Match e.g. root:javaframe
+    rootKind := Sequence(RootStepPrefix, identifier).Adjacent().As(String)
+
+    // Match e.g. where s =~ "jdbc:.*"; errors are reported by validateSearch
+    stringWhere := Sequence("where", identifier, "=~", quoted).
+        Handle(func (s *State) interface{} {
+            text := s.Get(4).String()
+            pattern, err := regexp.Compile(text[1:len(text)-1])
+            if err != nil {
+                err = fmt.Errorf("Bad pattern in where clause: %s", err)
+            }
+            return &WhereClause{s.Get(2).String(), &StringMatch{pattern}, err}
+        })
+
+    // Match e.g. m.size, s.value.length
+    fieldPath := Sequence(identifier, OneOrMoreOf(Sequence(".", identifier))).Adjacent().As(String)
+    literal := Sequence(Optional("-"), OneOrMoreOf(digit)).Adjacent().As(String)
+    comparison := OneOf("==", "!=", "<=", ">=", "<", ">")
+
+    // Match e.g. where m.size > 1000, where t.value == null
+    fieldWhere := Sequence("where", fieldPath, comparison, OneOf("null", literal)).
+        Handle(func (s *State) interface{} {
+            path := strings.Split(s.Get(2).String(), ".")
+            pred := &FieldCompare{Path: path[1:], Op: s.Get(3).String()}
+            var err error
+            if value := s.Get(4).String(); value == "null" {
+                pred.Null = true
+                if pred.Op != "==" && pred.Op != "!=" {
+                    err = fmt.Errorf("Only == and != can compare with null")
+                }
+            } else {
+                pred.Value, _ = strconv.ParseFloat(value, 64)
+            }
+            return &WhereClause{path[0], pred, err}
+        })
+
+    where := OneOf(stringWhere, fieldWhere)
+
+    // Match classname or root kind followed by optional step var name and where
+    // clause, and generate a Step
+    step := Sequence(OneOf(rootKind, className), Optional(identifier), Optional(where)).
         Handle(func (s *State) interface{} {
             cname := s.Get(1).String()
             vname := ""
             if s.Get(2).Kind() == reflect.String {
                 vname = s.Get(2).String()
             }
-            return &Step{cname, vname, true, false}
+            var where *WhereClause
+            if s.Get(3).IsValid() {
+                where = s.Get(3).Interface().(*WhereClause)
+            }
+            return &Step{cname, vname, true, false, where, ""}
+        })
+
+    // Match e.g. -[value]-> or <-[3]- for refs from one field or array index
+    fieldName := OneOf(identifier, OneOrMoreOf(digit).Adjacent().As(String))
+    viaArrow := OneOf(Sequence("-[", fieldName, "]->").Adjacent(), Sequence("<-[", fieldName, "]-").Adjacent()).
+        Handle(func (s *State) interface{} {
+            return &fieldArrow{s.Get(1).String() == "-[", s.Get(2).String()}
         })
 
-    // Modify outbound / skip settings of a chain of Steps
-    arrow := OneOf("<<-", "<-", "->>", "->")
+    // Modify outbound / skip / field settings of a chain of Steps
+    arrow := OneOf(viaArrow, "<<-", "<-", "->>", "->")
     path := Sequence(step, ZeroOrMoreOf(Sequence(arrow, step))).Flatten(2).
         Handle(func (s *State) interface{} {
             steps := []*Step{s.Get(1).Interface().(*Step)}
             for i := 2; i <= s.Len(); i += 2 {
-                arrow := s.Get(i).String()
                 step := s.Get(i+1).Interface().(*Step)
+                if s.Get(i).Kind() != reflect.String {
+                    arrow := s.Get(i).Interface().(*fieldArrow)
+                    step.to = arrow.to
+                    step.skip = false
+                    step.via = arrow.field
+                    steps = append(steps, step)
+                    continue
+                }
+                arrow := s.Get(i).String()
                 switch arrow {
                     case "<<-": 
                         step.to = false
@@ -99,8 +197,9 @@ func NewParsers() *Parsers {
             return steps
         })
 
-    // Match e.g. "histo(x, y)"
-    funargs := Sequence(identifier, ZeroOrMoreOf(Sequence(",", identifier).Pick(2))).Flatten(1).As(Strings)
+    // Match e.g. "histo(x, y)", "top(10, x)"
+    funarg := OneOf(identifier, OneOrMoreOf(digit).Adjacent().As(String))
+    funargs := Sequence(funarg, ZeroOrMoreOf(Sequence(",", funarg).Pick(2))).Flatten(1).As(Strings)
     funcall := Sequence(identifier, "(", funargs, ")").
         Handle(func (s *State) interface{} {
             fnName := s.Get(1).String()
@@ -120,15 +219,95 @@ func NewParsers() *Parsers {
             }
         })
 
+    // Match "histo" or "histo retained" for a whole-heap histogram
+    histo := Sequence("histo", Optional("retained")).
+        Handle(func (s *State) interface{} {
+            return HistoAction{s.Get(2).Kind() == reflect.String}
+        })
+
+    // Match "path [all] <oid>" to show why an object is alive
+    rootPath := Sequence("path", Optional("all"), number).
+        Handle(func (s *State) interface{} {
+            return PathAction{ObjectId(s.Get(3).Int()), s.Get(2).Kind() == reflect.String}
+        })
+
+    // Match "skip <class>" to add to the skipped classes
+    skip := Sequence("skip", className).
+        Handle(func (s *State) interface{} {
+            return SkipAction{s.Get(2).String()}
+        })
+
+    // Match "roots by kind", "roots" or "roots <kind>"
+    rootsByKind := Sequence("roots", "by", "kind").
+        Handle(func (s *State) interface{} {
+            return RootsAction{"", true}
+        })
+
+    roots := Sequence("roots", Optional(identifier)).
+        Handle(func (s *State) interface{} {
+            if s.Get(2).Kind() != reflect.String {
+                return RootsAction{"", false}
+            }
+            kind := s.Get(2).String()
+            if _, ok := RootKindNamed(kind); !ok {
+                return ErrorAction{fmt.Errorf("Unknown root kind %s", kind)}
+            }
+            return RootsAction{kind, false}
+        })
+
+    // Match "threads" to show thread stacks and the objects each frame holds
+    threads := Sequence("threads").
+        Handle(func (s *State) interface{} {
+            return ThreadsAction{}
+        })
+
+    // Match "show <oid>" to decode an object's fields
+    show := Sequence("show", number).
+        Handle(func (s *State) interface{} {
+            return ShowAction{ObjectId(s.Get(2).Int())}
+        })
+
+    // Match "dups [<limit>]" to report duplicate strings & arrays
+    dups := Sequence("dups", Optional(number)).
+        Handle(func (s *State) interface{} {
+            if s.Get(2).IsValid() {
+                return DupsAction{int(s.Get(2).Int())}
+            }
+            return DupsAction{DefaultDupGroups}
+        })
+
+    // Match "collections" to report collection fill ratios
+    collections := Sequence("collections").
+        Handle(func (s *State) interface{} {
+            return CollectionsAction{}
+        })
+
+    // Match "dangling [by class]" to report references to objects not in the dump
+    dangling := Sequence("dangling", Optional(Sequence("by", "class"))).
+        Handle(func (s *State) interface{} {
+            return DanglingAction{s.Get(2).IsValid()}
+        })
+
     setting := newSettingsParser()
 
-    command := OneOf(search, setting)
+    command := OneOf(search, histo, rootPath, skip, rootsByKind, roots, threads, setting, show, dups, 
+                     collections, dangling)
 
     return &Parsers{
         ClassName: className,
         Step: step,
         Path: path,
         Search: search,
+        Histo: histo,
+        RootPath: rootPath,
+        Skip: skip,
+        RootsByKind: rootsByKind,
+        Roots: roots,
+        Threads: threads,
+        Show: show,
+        Dups: dups,
+        Collections: collections,
+        Dangling: dangling,
         Setting: setting,
         Command: command,
     }
@@ -138,39 +317,77 @@ func NewParsers() *Parsers {
 //
 func newSettingsParser() *Parser {
 
-    number := OneOrMoreOf(AnyOf("0123456789")).Adjacent().As(Int)
-    size := Sequence(number, OneOf("k", "m", "g")).
-        Handle(func (s *State) interface{} {
-            value := s.Get(1).Int()
-            switch s.Get(2).String() {
-                case "k": value *= 1 << 10
-                case "m": value *= 1 << 20
-                case "g": value *= 1 << 30
-            }
-            return value
-        })
+    // Match "set <name> <value>"; the value is checked by Setting.Set, so this
+    // only needs to accept sizes, numbers and words.
+    name := OneOrMoreOf(AnyOf("abcdefghijklmnopqrstuvwxyz")).Adjacent().As(String)
+    value := OneOrMoreOf(AnyOf("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_.")).
+                Adjacent().As(String)
 
-    sizeSetting := OneOf("mingroupsize")
-
-    setting := Sequence("set", sizeSetting, size).Flatten(1).
+    set := Sequence("set", name, value).
         Handle(func(s *State) interface{} {
             sname := s.Get(2).String()
-            sval := int(s.Get(3).Int())
+            sval := s.Get(3).String()
+            if err := DefaultSettings()[sname].check(sname, sval); err != nil {
+                return ErrorAction{err}
+            }
             return SettingsAction{sname, sval}
         })
 
-    return setting
+    // Match "show settings"
+    show := Sequence("show", "settings").
+        Handle(func(s *State) interface{} {
+            return ShowSettingsAction{}
+        })
+
+    return OneOf(set, show)
 }
 
 // Validate search parameters; ensure all function params are defined
 // in the path, and return a fully composed Query.
 //
 func validateSearch(fn *QFun, steps []*Step) (*Query, error) {
+    for _, step := range steps {
+        if step.where != nil {
+            if step.where.err != nil {
+                return nil, step.where.err
+            }
+            if step.where.varName != step.varName {
+                return nil, fmt.Errorf("Where clause variable %s is not the step variable", step.where.varName)
+            }
+        }
+        if strings.HasPrefix(step.types, RootStepPrefix) {
+            kind := step.types[len(RootStepPrefix):]
+            if _, ok := RootKindNamed(kind); !ok && kind != "any" {
+                return nil, fmt.Errorf("Unknown root kind %s", kind)
+            }
+        }
+    }
+    function := searchFunctions[fn.fnName]
+    if function == nil {
+        return nil, fmt.Errorf("Unknown function %s", fn.fnName)
+    }
+    args := fn.fnArgs
+    limit := 0
+    if function.HasLimit {
+        var err error
+        if len(args) > 0 {
+            limit, err = strconv.Atoi(args[0])
+            args = args[1:]
+        }
+        if len(args) == len(fn.fnArgs) || err != nil {
+            return nil, fmt.Errorf("Usage: %s", function.Usage)
+        }
+    }
+    if len(args) != function.NumVars {
+        return nil, fmt.Errorf("Usage: %s", function.Usage)
+    }
     query := &Query {
         steps,
-        make([]int, len(fn.fnArgs)),
+        make([]int, len(args)),
+        fn.fnName,
+        limit,
     }
-    for i, arg := range fn.fnArgs {
+    for i, arg := range args {
         found := false
         for j, step := range steps {
             if arg == step.varName {
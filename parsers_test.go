@@ -52,34 +52,49 @@ func (s *ParserSuite) TestQueries(c *C) {
     c.Check(result, Equals, "int[][]")
 
     _, _, result = parsers.Step.Parse("Object")
-    c.Check(result, DeepEquals, &Step{"Object", "", true, false})
+    c.Check(result, DeepEquals, &Step{"Object", "", true, false, nil, ""})
 
     _, _, result = parsers.Step.Parse("Object x")
-    c.Check(result, DeepEquals, &Step{"Object", "x", true, false})
+    c.Check(result, DeepEquals, &Step{"Object", "x", true, false, nil, ""})
 
     _, _, result = parsers.Path.Parse("Map y ->> Integer x")
     c.Check(result, DeepEquals, []*Step {
-        &Step{"Map", "y", true, false},
-        &Step{"Integer", "x", true, true},
+        &Step{"Map", "y", true, false, nil, ""},
+        &Step{"Integer", "x", true, true, nil, ""},
     })
 
     _, _, result = parsers.Path.Parse("Integer x <<- Map y")
     c.Check(result, DeepEquals, []*Step {
-        &Step{"Integer", "x", true, false},
-        &Step{"Map", "y", false, true},
+        &Step{"Integer", "x", true, false, nil, ""},
+        &Step{"Map", "y", false, true, nil, ""},
     })
 
     _, _, result = parsers.Command.Parse("run histo(x, y) from Map x -> Integer y")
     c.Check(result, DeepEquals, SearchAction{
         &Query {
             []*Step {
-                &Step{"Map", "x", true, false},
-                &Step{"Integer", "y", true, false},
+                &Step{"Map", "x", true, false, nil, ""},
+                &Step{"Integer", "y", true, false, nil, ""},
             },
             []int{0, 1},
+            "histo",
+            0,
         },
     })
 
+    _, _, result = parsers.Command.Parse("run top(10, x) from Map x")
+    c.Check(result.(SearchAction).Query.limit, Equals, 10)
+    c.Check(result.(SearchAction).Query.argIndices, DeepEquals, []int{0})
+
+    _, _, result = parsers.Command.Parse("run bogus(x) from Map x")
+    c.Check(result, DeepEquals, ErrorAction{fmt.Errorf("Unknown function bogus")})
+
+    _, _, result = parsers.Command.Parse("run histo(x) from Map x")
+    c.Check(result, DeepEquals, ErrorAction{fmt.Errorf("Usage: histo(x, y)")})
+
+    _, _, result = parsers.Command.Parse("run top(x) from Map x")
+    c.Check(result, DeepEquals, ErrorAction{fmt.Errorf("Usage: top(n, x)")})
+
     _, _, result = parsers.Command.Parse("run histo(x, y) from Map x -> Integer z")
     c.Check(result, DeepEquals, ErrorAction{
         fmt.Errorf("Function variable y is not defined in path"),
@@ -88,6 +103,104 @@ func (s *ParserSuite) TestQueries(c *C) {
     log.Print("")
 }
 
+// Verify commands other than searches and settings.
+//
+func (s *ParserSuite) TestCommands(c *C) {
+
+    parsers := NewParsers()
+
+    _, _, result := parsers.Command.Parse("histo")
+    c.Check(result, DeepEquals, HistoAction{false})
+
+    _, _, result = parsers.Command.Parse("histo retained")
+    c.Check(result, DeepEquals, HistoAction{true})
+
+    _, _, result = parsers.Command.Parse("path 1234")
+    c.Check(result, DeepEquals, PathAction{1234, false})
+
+    _, _, result = parsers.Command.Parse("path all 5")
+    c.Check(result, DeepEquals, PathAction{5, true})
+
+    _, _, result = parsers.Command.Parse("skip java.util.HashMap$Entry[]")
+    c.Check(result, DeepEquals, SkipAction{"java.util.HashMap$Entry[]"})
+
+    _, _, result = parsers.Command.Parse("roots")
+    c.Check(result, DeepEquals, RootsAction{"", false})
+
+    _, _, result = parsers.Command.Parse("roots by kind")
+    c.Check(result, DeepEquals, RootsAction{"", true})
+
+    _, _, result = parsers.Command.Parse("roots javaframe")
+    c.Check(result, DeepEquals, RootsAction{"javaframe", false})
+
+    _, _, result = parsers.Command.Parse("roots bogus")
+    c.Check(result, DeepEquals, ErrorAction{fmt.Errorf("Unknown root kind bogus")})
+
+    _, _, result = parsers.Command.Parse("threads")
+    c.Check(result, DeepEquals, ThreadsAction{})
+
+    _, _, result = parsers.Command.Parse("dangling")
+    c.Check(result, DeepEquals, DanglingAction{false})
+
+    _, _, result = parsers.Command.Parse("dangling by class")
+    c.Check(result, DeepEquals, DanglingAction{true})
+
+    _, _, result = parsers.Command.Parse("show 42")
+    c.Check(result, DeepEquals, ShowAction{42})
+
+    _, _, result = parsers.Command.Parse("dups")
+    c.Check(result, DeepEquals, DupsAction{DefaultDupGroups})
+
+    _, _, result = parsers.Command.Parse("dups 5")
+    c.Check(result, DeepEquals, DupsAction{5})
+
+    _, _, result = parsers.Command.Parse("collections")
+    c.Check(result, DeepEquals, CollectionsAction{})
+
+    _, _, result = parsers.Path.Parse("root:javaframe x -> Object y")
+    c.Check(result, DeepEquals, []*Step {
+        &Step{"root:javaframe", "x", true, false, nil, ""},
+        &Step{"Object", "y", true, false, nil, ""},
+    })
+
+    _, _, result = parsers.Command.Parse("run histo(x) from root:bogus x")
+    c.Check(result, DeepEquals, ErrorAction{fmt.Errorf("Unknown root kind bogus")})
+
+    _, _, result = parsers.Step.Parse(`String s where s =~ "jdbc:.*"`)
+    step := result.(*Step)
+    c.Check(step.varName, Equals, "s")
+    c.Assert(step.where, NotNil)
+    c.Check(step.where.varName, Equals, "s")
+    c.Check(step.where.Predicate.(*StringMatch).Pattern.String(), Equals, "jdbc:.*")
+
+    _, _, result = parsers.Command.Parse(`run histo(s) from String s where t =~ "x"`)
+    c.Check(result, DeepEquals, ErrorAction{fmt.Errorf("Where clause variable t is not the step variable")})
+
+    _, _, result = parsers.Command.Parse(`run histo(s) from String s where s =~ "("`)
+    _, isError := result.(ErrorAction)
+    c.Check(isError, Equals, true)
+
+    _, _, result = parsers.Path.Parse("HashMap m -[table]-> Object[] <-[3]- Foo ->> Bar")
+    c.Check(result, DeepEquals, []*Step {
+        &Step{"HashMap", "m", true, false, nil, ""},
+        &Step{"Object[]", "", true, false, nil, "table"},
+        &Step{"Foo", "", false, false, nil, "3"},
+        &Step{"Bar", "", true, true, nil, ""},
+    })
+
+    _, _, result = parsers.Step.Parse(`String s where s.value.length >= -10`)
+    step = result.(*Step)
+    c.Assert(step.where, NotNil)
+    c.Check(step.where.varName, Equals, "s")
+    c.Check(step.where.Predicate, DeepEquals, &FieldCompare{[]string{"value", "length"}, ">=", false, -10})
+
+    _, _, result = parsers.Step.Parse(`Thing t where t.value == null`)
+    c.Check(result.(*Step).where.Predicate, DeepEquals, &FieldCompare{[]string{"value"}, "==", true, 0})
+
+    _, _, result = parsers.Command.Parse(`run histo(t) from Thing t where t.value < null`)
+    c.Check(result, DeepEquals, ErrorAction{fmt.Errorf("Only == and != can compare with null")})
+}
+
 // Verify all the "set" actions.
 //
 func (s *ParserSuite) TestSettings(c *C) {
@@ -107,5 +220,28 @@ func (s *ParserSuite) TestSettings(c *C) {
 
     session.run("set mingroupsize 1g")
     c.Check(1 << 30, Equals, sval("mingroupsize").IntValue)
+
+    c.Check("text", Equals, sval("format").StringValue)
+    session.run("set format json")
+    c.Check("json", Equals, sval("format").StringValue)
+    c.Check(false, Equals, session.run("set format xml"))
+    c.Check("json", Equals, sval("format").StringValue)
+
+    c.Check(true, Equals, session.run("set sort count"))
+    c.Check("count", Equals, sval("sort").StringValue)
+    c.Check(false, Equals, session.run("set sort color"))
+    c.Check(true, Equals, session.run("set maxrows 20"))
+    c.Check(20, Equals, sval("maxrows").IntValue)
+    c.Check(false, Equals, session.run("set maxrows lots"))
+    c.Check(false, Equals, session.run("set maxrows 1k"))
+
+    c.Check(false, Equals, sval("retained").BoolValue)
+    c.Check(true, Equals, session.run("set retained on"))
+    c.Check(true, Equals, sval("retained").BoolValue)
+    c.Check(false, Equals, session.run("set retained maybe"))
+    c.Check(false, Equals, session.run("set colour blue"))
+
+    result, _ := parseCommand("show settings")
+    c.Check(result, DeepEquals, ShowSettingsAction{})
 }
 
@@ -0,0 +1,120 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+// Reference classes whose referents don't keep an object alive
+//
+var weakReferenceClasses = []string{
+    "java.lang.ref.WeakReference",
+    "java.lang.ref.SoftReference",
+    "java.lang.ref.PhantomReference",
+}
+
+// Find a shortest path from any GC root to an object, by a breadth-first search
+// over the in edges.  Returns the path root first, or nil if the object isn't
+// reachable.  If strong is true, the search won't follow the referents of weak,
+// soft or phantom references, or pass through instances of skipped classes (see
+// Heap.AddSkip.)
+//
+func (heap *Heap) PathFromRoot(oid ObjectId, strong bool) []ObjectId {
+
+    isRoot := NewBitSet(uint32(heap.MaxObjectId) + 1)
+    for _, root := range heap.roots {
+        isRoot.Set(uint32(root))
+    }
+
+    weak := NewBitSet(heap.MaxClassId + 1)
+    if strong {
+        for _, name := range weakReferenceClasses {
+            heap.WithClassesMatching(name, func(class *ClassDef) {
+                addSubclassCids(class, weak)
+            })
+        }
+        if heap.skipNames != nil && heap.skipIds == nil {
+            heap.ProcessSkips()
+        }
+    }
+
+    // via[x] is the next object on the path from x to the target, or 0 if x
+    // hasn't been seen.
+
+    via := make([]ObjectId, heap.MaxObjectId + 1)
+    via[oid] = oid
+    queue := []ObjectId{oid}
+
+    for head := 0; head < len(queue); head++ {
+        node := queue[head]
+        if isRoot.Has(uint32(node)) {
+            path := []ObjectId{node}
+            for node != oid {
+                node = via[node]
+                path = append(path, node)
+            }
+            return path
+        }
+        for src, pos := heap.InEdges(node); pos != 0; src, pos = heap.NextInEdge(pos) {
+            if via[src] != 0 {
+                continue
+            }
+            if strong {
+                class := heap.ClassOf(src)
+                if class.Skip {
+                    continue
+                }
+                if weak.Has(uint32(class.Cid)) && heap.EdgeName(src, heap.InLabel(pos)) == "referent" {
+                    continue
+                }
+            }
+            via[src] = node
+            queue = append(queue, src)
+        }
+    }
+
+    return nil
+}
+
+// Print a path as returned by PathFromRoot, one object per line with the name
+// of the reference that leads to it.
+//
+func (heap *Heap) PrintPath(out ReportWriter, path []ObjectId) {
+    out.Begin("path", Column{"oid", "%10v"}, Column{"class", "%v"}, Column{"via", "via %v"})
+    for i, oid := range path {
+        via := "(GC root)"
+        if i > 0 {
+            via = heap.refName(path[i-1], oid)
+        }
+        out.Row(oid, heap.ClassOf(oid).Name, via)
+    }
+}
+
+// Return the name of a reference from one object to another, or "?" if there
+// is none.
+//
+func (heap *Heap) refName(from ObjectId, to ObjectId) string {
+    for dst, pos := heap.OutEdges(from); pos != 0; dst, pos = heap.NextOutEdge(pos) {
+        if dst == to {
+            return heap.EdgeName(from, heap.OutLabel(pos))
+        }
+    }
+    return "?"
+}
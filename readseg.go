@@ -23,7 +23,6 @@
 package main
 
 import (
-    "log"
     "runtime"
 )
 
@@ -42,6 +41,8 @@ type SegReader struct {
     active *SegWorker
     // How large does the queue get before we process it
     batchSize int
+    // References from class objects, found by the HProfReader itself
+    classRefs RefBag
 }
 
 type SegWorker struct {
@@ -59,6 +60,9 @@ type SegWorker struct {
     count int
     // references found
     refs RefBag
+    // offset of the record being read, and first error found
+    offset uint64
+    err *ReadError
 }
 
 // Create a segment reader with one worker per CPU.
@@ -126,10 +130,16 @@ func (reader *SegReader) proceed(more bool) {
 // that SegReader.doInstance() hands off to us.
 //
 func (worker *SegWorker) process() {
+    defer func() {
+        worker.count = 0
+        worker.avail <- worker
+    }()
+    defer worker.recoverError()
     if worker.count > 0 {
         start := worker.offsets[0]
         in := worker.MappedFile.MapAt(start)
         for i := 0; i < worker.count; i++ {
+            worker.offset = worker.offsets[i]
             in.Skip(uint32(worker.offsets[i] - in.Offset()))
             tag := in.GetByte()
             switch tag {
@@ -138,25 +148,48 @@ func (worker *SegWorker) process() {
                 case 0x22: // OBJECT_ARRAY
                     worker.readArray(in, worker.oids[i], worker.classes[i])
                 default:
-                    log.Fatalf("Unhandled record type %d in worker\n", tag)
+                    panic(&ReadError{Offset: worker.offset, Tag: int(tag), Err: ErrUnknownTag,
+                                     Detail: "unhandled record type in segment worker"})
             }
         }
-        worker.count = 0
     }
-    worker.avail <- worker
+}
+
+// Keep the first *ReadError panic from process() for close() to return; it
+// can't propagate to the HProfReader from the worker goroutine.
+//
+func (worker *SegWorker) recoverError() {
+    if r := recover(); r != nil {
+        err, ok := r.(*ReadError)
+        if !ok {
+            panic(r)
+        }
+        if err.Tag == NoTag {
+            err.Offset = worker.offset
+        }
+        if worker.err == nil {
+            worker.err = err
+        }
+    }
 }
 
 // Shut down all segment workers, allowing them to be garbage collected, by launching
 // the current active one (even if empty) then draining the "available" channel.
+// Returns all the references found, including those from class objects, and the
+// first error any worker ran into.
 //
-func (reader *SegReader) close() []*RefBag {
+func (reader *SegReader) close() ([]*RefBag, error) {
     reader.proceed(false)
-    bags := []*RefBag{}
+    bags := []*RefBag{&reader.classRefs}
+    var err error
     for i := 0; i < runtime.NumCPU(); i++ {
         worker := <-reader.avail
         bags = append(bags, &worker.refs)
+        if worker.err != nil && err == nil {
+            err = worker.err
+        }
     }
-    return bags
+    return bags, err
 }
 
 // The busy side of Heap.readInstance; record the instance data + references
@@ -176,13 +209,13 @@ func (worker *SegWorker) readInstance(in *MappedSection, oid ObjectId, class *Cl
     in.Demand(in.GetUInt32())
     cursor := uint32(0)
 
-    for _, offset := range class.RefOffsets() {
+    for i, offset := range class.RefOffsets() {
         skip := offset - cursor
         in.Skip(skip)
         toHid := worker.readId(in)
         if toHid != 0 {
             // log.Printf("in readInst %d cid=%d a %s -> %x\n", oid, class.Cid, class.Name, toHid)
-            worker.refs.AddReference(oid, toHid)
+            worker.refs.AddReference(oid, toHid, uint32(i))
         }
         cursor += skip + worker.IdSize
     }
@@ -209,7 +242,7 @@ func (worker *SegWorker) readArray(in *MappedSection, oid ObjectId, class *Class
         toHid := worker.readId(in)
         if toHid != 0 {
             // log.Printf("in readArray %d cid=%d a %s -> %x\n", oid, class.Cid, class.Name, toHid)
-            worker.refs.AddReference(oid, toHid)
+            worker.refs.AddReference(oid, toHid, i)
         }
     }
 }
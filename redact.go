@@ -0,0 +1,677 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+
+package main
+
+import (
+    "bufio"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+)
+
+// Options for Redact
+//
+type RedactOptions struct {
+    // fill primitive arrays & values from a salted hash of their contents
+    // instead of zeroes, so those that were equal stay equal
+    Hash bool
+    // if set, rename application classes, their fields and the methods & source
+    // files in their stack frames, and write the mapping from old names to new here
+    MappingFile string
+}
+
+// Classes in these packages keep their names, so JDK classes like String and
+// HashMap are still recognizable.
+//
+var keptPackages = []string{"java.", "javax.", "sun.", "com.sun.", "jdk."}
+
+// Primitive fields of JDK classes that are kept because they describe structure,
+// not data: String offset, count & coder, and collection sizes.  Without them
+// Strings and collections couldn't be decoded.
+//
+var keptJDKFields = map[string]bool{"offset": true, "count": true, "coder": true, "size": true,
+                                    "baseCount": true}
+
+// Return true if a class keeps its name, given its JVM name.
+//
+func keptClass(name string) bool {
+    name = Demangle(name)
+    for _, prefix := range keptPackages {
+        if strings.HasPrefix(name, prefix) {
+            return true
+        }
+    }
+    return !strings.ContainsAny(name, "./") && strings.HasSuffix(name, "[]") // primitive array
+}
+
+// Copies a heap dump, blanking the contents of primitive arrays, which hold
+// the text of Strings and most other application data, and the values of
+// primitive fields, statics and constants, except those in keptJDKFields.
+// Object ids, sizes and references are untouched, so histograms, paths and
+// retained sizes are the same as for the original.  UTF8 records for stack
+// frames and thread names are copied as is, unless renaming.
+//
+type Redactor struct {
+    // for reading records & sub-records
+    *HProfReader
+    *RedactOptions
+    out *bufio.Writer
+    // text of each UTF8 record
+    names map[HeapId]string
+    // class name ids by class heap id, from LOAD_CLASS, in file order
+    classNames map[HeapId]HeapId
+    classHids []HeapId
+    // class heap ids by class serial, from LOAD_CLASS
+    classSerials map[uint32]HeapId
+    // field & static name ids by class heap id, from CLASS_DUMP
+    fieldNames map[HeapId][]HeapId
+    // superclass heap ids and instance fields by class heap id, from CLASS_DUMP
+    supers map[HeapId]HeapId
+    fields map[HeapId][]redactField
+    // primitive fields to blank in instances by class heap id; see blankFields
+    blanks map[HeapId][]redactField
+    // from STACK_FRAME records
+    frames []redactFrame
+    // new text for renamed UTF8 records
+    renames map[HeapId]string
+    // fresh for each run, so hashed arrays can't be matched across dumps
+    salt []byte
+}
+
+// An instance field: its name id and type, and in blankFields its offset in the
+// instance data.
+//
+type redactField struct {
+    name HeapId
+    jtype *JType
+    offset uint32
+}
+
+// The UTF8 ids in a STACK_FRAME, and the serial number of the frame's class
+//
+type redactFrame struct {
+    method, signature, source HeapId
+    classSerial uint32
+}
+
+// Size of each GC root sub-record following the tag & heap id, in ids and bytes
+//
+var rootSizes = map[byte]struct{ids, bytes uint32}{
+    0x01: {1, 0}, 0x02: {0, 8}, 0x03: {0, 8}, 0x04: {0, 4}, 0x05: {0, 0},
+    0x06: {0, 4}, 0x07: {0, 0}, 0x08: {0, 8}, 0xff: {0, 0},
+}
+
+// Write a redacted copy of a heap dump.  Errors in the input are returned as a
+// *ReadError; on any error the output file is removed.
+//
+func Redact(inName string, outName string, options *RedactOptions) (err error) {
+
+    mappedFile, err := MapFile(inName)
+    if err != nil {
+        return err
+    }
+    defer mappedFile.Close()
+
+    r := &Redactor{
+        HProfReader: &HProfReader{Options: &Options{}, Filename: inName, MappedFile: mappedFile},
+        RedactOptions: options,
+        names: make(map[HeapId]string),
+        classNames: make(map[HeapId]HeapId),
+        classSerials: make(map[uint32]HeapId),
+        fieldNames: make(map[HeapId][]HeapId),
+        supers: make(map[HeapId]HeapId),
+        fields: make(map[HeapId][]redactField),
+        blanks: make(map[HeapId][]redactField),
+        renames: make(map[HeapId]string),
+    }
+    if options.Hash {
+        r.salt = make([]byte, 16)
+        if _, err := rand.Read(r.salt); err != nil {
+            return err
+        }
+    }
+
+    file, err := os.Create(outName)
+    if err != nil {
+        return err
+    }
+    defer func() {
+        if err != nil {
+            file.Close()
+            os.Remove(outName)
+        }
+    }()
+    defer recoverReadError(&err)
+
+    r.recordTag = NoTag
+    r.limit = r.Size
+    r.readHeader()
+    r.Heap = NewHeap(r.IdSize) // for readJType
+
+    r.scan()
+    if options.MappingFile != "" {
+        if err := r.rename(); err != nil {
+            return err
+        }
+    }
+
+    r.out = bufio.NewWriterSize(file, 1 << 20)
+    r.write()
+    if err := r.out.Flush(); err != nil {
+        return err
+    }
+    return file.Close()
+}
+
+// First pass: collect names, class layouts and stack frames.
+//
+func (r *Redactor) scan() {
+    in := r.MapAt(HeaderSize)
+    for in.Offset() < r.Size {
+        tag, end := r.nextRecord(in)
+        switch tag {
+            case 0x01: // UTF8
+                if end - in.Offset() < uint64(r.IdSize) {
+                    r.fail(ErrBadRecord, "UTF8 record of %d bytes", end - in.Offset())
+                }
+                r.demand(in, uint32(end - in.Offset()))
+                hid := r.readId(in)
+                r.names[hid] = in.GetString(uint32(end - in.Offset()))
+            case 0x02: // LOAD_CLASS
+                r.demand(in, 8 + 2 * r.IdSize)
+                serial := in.GetUInt32()
+                classHid := r.readId(in)
+                in.Skip(4) // stack serial
+                r.classNames[classHid] = r.readId(in)
+                r.classHids = append(r.classHids, classHid)
+                r.classSerials[serial] = classHid
+            case 0x04: // STACK_FRAME
+                r.demand(in, 4 * r.IdSize + 8)
+                r.readId(in) // frame id
+                method, signature, source := r.readId(in), r.readId(in), r.readId(in)
+                r.frames = append(r.frames, redactFrame{method, signature, source, in.GetUInt32()})
+            case 0x0c, 0x1c: // HEAP_DUMP, HEAP_DUMP_SEGMENT
+                for in.Offset() < end {
+                    r.recordOffset = in.Offset()
+                    r.demand(in, 1)
+                    r.recordTag = int(in.GetByte())
+                    r.skipSubRecord(in, byte(r.recordTag))
+                }
+        }
+        in.Seek(end)
+    }
+}
+
+// Read a record header, returning the tag and the end of the record.
+//
+func (r *Redactor) nextRecord(in *MappedSection) (byte, uint64) {
+    r.recordOffset = in.Offset()
+    r.recordTag = NoTag
+    r.limit = r.Size
+    r.demand(in, 9)
+    tag := in.GetByte()
+    r.recordTag = int(tag)
+    in.Skip(4) // timestamp
+    length := uint64(in.GetUInt32())
+    r.need(in, length)
+    r.limit = in.Offset() + length
+    return tag, r.limit
+}
+
+// Move past a sub-record, given its tag.  CLASS_DUMPs are scanned on the way.
+//
+func (r *Redactor) skipSubRecord(in *MappedSection, tag byte) {
+    id := uint64(r.IdSize)
+    switch tag {
+        case 0x20: // CLASS_DUMP
+            r.scanClassDump(in)
+        case 0x21: // INSTANCE_DUMP
+            r.demand(in, 2 * r.IdSize + 8)
+            in.Skip(2 * r.IdSize + 4)
+            r.seek(in, uint64(in.GetUInt32()))
+        case 0x22: // OBJECT_ARRAY
+            r.demand(in, 2 * r.IdSize + 8)
+            in.Skip(r.IdSize + 4)
+            count := uint64(in.GetUInt32())
+            r.seek(in, id + count * id)
+        case 0x23: // PRIMITIVE_ARRAY
+            r.demand(in, r.IdSize + 9)
+            in.Skip(r.IdSize + 4)
+            count := uint64(in.GetUInt32())
+            jtype := r.readJType(in)
+            r.seek(in, count * uint64(jtype.Size))
+        default:
+            size, ok := rootSizes[tag]
+            if !ok {
+                r.fail(ErrUnknownTag, "unknown heap dump sub-record type")
+            }
+            r.seek(in, uint64(size.ids + 1) * id + uint64(size.bytes))
+    }
+}
+
+// Move ahead some number of bytes, which must be in the current record.  Unlike
+// MappedSection.Skip this is safe for arrays bigger than the mapped section.
+//
+func (r *Redactor) seek(in *MappedSection, count uint64) {
+    r.need(in, count)
+    in.Seek(in.Offset() + count)
+}
+
+// Read a CLASS_DUMP, noting its superclass and fields.  See also
+// HProfReader.readClassDump.
+//
+func (r *Redactor) scanClassDump(in *MappedSection) {
+
+    r.demand(in, 7 * r.IdSize + 8)
+    hid := r.readId(in)
+    in.Skip(4) // stack serial
+    r.supers[hid] = r.readId(in)
+    in.Skip(5 * r.IdSize + 4)
+    names := []HeapId{}
+
+    r.demand(in, 2)
+    numConstants := in.GetUInt16()
+    for i := 0; i < int(numConstants); i++ {
+        r.demand(in, 3)
+        in.Skip(2) // constant pool index
+        r.seek(in, uint64(r.readJType(in).Size))
+    }
+
+    r.demand(in, 2)
+    numStatics := in.GetUInt16()
+    for i := 0; i < int(numStatics); i++ {
+        r.demand(in, r.IdSize + 1)
+        names = append(names, r.readId(in))
+        r.seek(in, uint64(r.readJType(in).Size))
+    }
+
+    r.demand(in, 2)
+    numFields := in.GetUInt16()
+    fields := []redactField{}
+    for i := 0; i < int(numFields); i++ {
+        r.demand(in, r.IdSize + 1)
+        nameId := r.readId(in)
+        names = append(names, nameId)
+        fields = append(fields, redactField{name: nameId, jtype: r.readJType(in)})
+    }
+
+    r.fieldNames[hid] = names
+    r.fields[hid] = fields
+}
+
+// Return the primitive fields to blank in instances of a class, with their
+// offsets in the instance data, which holds the class's own fields followed by
+// its superclass's and so on.
+//
+func (r *Redactor) blankFields(classHid HeapId) []redactField {
+    if blanks, ok := r.blanks[classHid]; ok {
+        return blanks
+    }
+    blanks := []redactField{}
+    offset := uint32(0)
+    for hid := classHid; hid != 0; hid = r.supers[hid] {
+        kept := keptClass(r.names[r.classNames[hid]])
+        for _, field := range r.fields[hid] {
+            if !field.jtype.IsObj && !(kept && keptJDKFields[r.names[field.name]]) {
+                field.offset = offset
+                blanks = append(blanks, field)
+            }
+            offset += field.jtype.Size
+        }
+    }
+    r.blanks[classHid] = blanks
+    return blanks
+}
+
+// Decide on new names for application classes, the fields only they use and
+// the methods & source files in their stack frames, and write the mapping file.
+//
+func (r *Redactor) rename() error {
+
+    // A name is a single UTF8 record no matter how many classes use it, so it
+    // can only be renamed if no kept class does.
+
+    keptNames := make(map[HeapId]bool)
+    for _, classHid := range r.classHids {
+        if keptClass(r.names[r.classNames[classHid]]) {
+            for _, nameId := range r.fieldNames[classHid] {
+                keptNames[nameId] = true
+            }
+        }
+    }
+    frameKept := func(frame redactFrame) bool {
+        return keptClass(r.names[r.classNames[r.classSerials[frame.classSerial]]])
+    }
+    for _, frame := range r.frames {
+        if frameKept(frame) {
+            keptNames[frame.method], keptNames[frame.signature], keptNames[frame.source] = true, true, true
+        }
+    }
+
+    // Array classes are renamed along with their element classes.
+
+    newNames := make(map[string]string)
+    mapping := []string{}
+    for _, classHid := range r.classHids {
+        nameId := r.classNames[classHid]
+        name := r.names[nameId]
+        if keptClass(name) {
+            continue
+        }
+        dimen := strings.LastIndex(name, "[") + 1
+        element := name[dimen:]
+        if dimen > 0 {
+            element = element[1:len(element)-1] // strip L & ;
+        }
+        newName, ok := newNames[element]
+        if !ok {
+            newName = fmt.Sprintf("redacted/Class%d", len(newNames) + 1)
+            newNames[element] = newName
+            mapping = append(mapping, fmt.Sprintf("class %s %s", Demangle(newName), Demangle(element)))
+        }
+        if dimen > 0 {
+            newName = name[:dimen] + "L" + newName + ";"
+        }
+        r.renames[nameId] = newName
+    }
+
+    fields := make(map[HeapId]bool)
+    for _, classHid := range r.classHids {
+        for _, nameId := range r.fieldNames[classHid] {
+            if !keptNames[nameId] && !fields[nameId] && r.renames[r.classNames[classHid]] != "" {
+                fields[nameId] = true
+                newName := fmt.Sprintf("field%d", len(fields))
+                r.renames[nameId] = newName
+                mapping = append(mapping, fmt.Sprintf("field %s %s", newName, r.names[nameId]))
+            }
+        }
+    }
+
+    counts := make(map[string]int)
+    renameFrame := func(nameId HeapId, kind string, format string) {
+        if _, renamed := r.renames[nameId]; nameId == 0 || renamed || keptNames[nameId] {
+            return
+        }
+        counts[kind]++
+        newName := fmt.Sprintf(format, counts[kind])
+        r.renames[nameId] = newName
+        mapping = append(mapping, fmt.Sprintf("%s %s %s", kind, newName, r.names[nameId]))
+    }
+    for _, frame := range r.frames {
+        if !frameKept(frame) {
+            renameFrame(frame.method, "method", "method%d")
+            renameFrame(frame.signature, "signature", "signature%d")
+            renameFrame(frame.source, "source", "Source%d.java")
+        }
+    }
+
+    sort.Strings(mapping)
+    file, err := os.Create(r.MappingFile)
+    if err != nil {
+        return err
+    }
+    for _, line := range mapping {
+        fmt.Fprintln(file, line)
+    }
+    return file.Close()
+}
+
+// Second pass: copy everything, redacting as we go.
+//
+func (r *Redactor) write() {
+
+    in := r.MapAt(0)
+    r.copy(in, HeaderSize)
+
+    for in.Offset() < r.Size {
+        start := in.Offset()
+        tag, end := r.nextRecord(in)
+        body := in.Offset()
+
+        if tag == 0x01 && end - body >= uint64(r.IdSize) { // UTF8
+            r.demand(in, r.IdSize)
+            if newName, ok := r.renames[r.readId(in)]; ok {
+                r.putHeader(tag, uint32(r.IdSize) + uint32(len(newName)))
+                in.Seek(body)
+                r.copy(in, uint64(r.IdSize))
+                r.out.WriteString(newName)
+                in.Seek(end)
+                continue
+            }
+        }
+
+        in.Seek(start)
+        if tag != 0x0c && tag != 0x1c {
+            r.copy(in, end - start)
+            continue
+        }
+
+        r.copy(in, body - start)
+        for in.Offset() < end {
+            r.recordOffset = in.Offset()
+            r.demand(in, 1)
+            r.recordTag = int(in.GetByte())
+            r.writeSubRecord(in, byte(r.recordTag))
+        }
+    }
+}
+
+// Copy one sub-record, given its tag, redacting primitive arrays and primitive
+// fields, statics & constants.
+//
+func (r *Redactor) writeSubRecord(in *MappedSection, tag byte) {
+
+    start := in.Offset() - 1
+
+    switch tag {
+        case 0x20: // CLASS_DUMP
+            in.Seek(start)
+            r.copy(in, uint64(7 * r.IdSize + 9))
+            r.copyClassValues(in, 2)        // constant pool, by index
+            r.copyClassValues(in, r.IdSize) // statics, by name id
+            r.demand(in, 2)
+            numFields := uint64(in.GetUInt16())
+            in.Seek(in.Offset() - 2)
+            length := 2 + numFields * uint64(r.IdSize + 1)
+            r.need(in, length)
+            r.copy(in, length)
+            return
+
+        case 0x21: // INSTANCE_DUMP
+            r.demand(in, 2 * r.IdSize + 8)
+            in.Skip(r.IdSize + 4)
+            blanks := r.blankFields(r.readId(in))
+            length := in.GetUInt32()
+            if len(blanks) > 0 {
+                r.need(in, uint64(length))
+                in.Seek(start)
+                r.copy(in, uint64(2 * r.IdSize + 9))
+                r.demand(in, length)
+                data := append([]byte{}, in.GetRaw(length)...)
+                for _, field := range blanks {
+                    if end := field.offset + field.jtype.Size; end <= length {
+                        r.redactValue(field.jtype, data[field.offset:end])
+                    }
+                }
+                r.out.Write(data)
+                return
+            }
+            r.seek(in, uint64(length))
+
+        case 0x23: // PRIMITIVE_ARRAY
+            r.demand(in, r.IdSize + 9)
+            in.Skip(r.IdSize + 4)
+            count := uint64(in.GetUInt32())
+            jtype := r.readJType(in)
+            length := count * uint64(jtype.Size)
+            r.need(in, length)
+            in.Seek(start)
+            r.copy(in, uint64(r.IdSize + 10))
+            r.redactArray(in, jtype, length)
+            return
+
+        default:
+            r.skipSubRecord(in, tag)
+    }
+
+    end := in.Offset()
+    in.Seek(start)
+    r.copy(in, end - start)
+}
+
+// Copy the constant pool or statics of a CLASS_DUMP, redacting primitive values:
+// a count, then for each a key of the given size, a basic type and a value.
+//
+func (r *Redactor) copyClassValues(in *MappedSection, keySize uint32) {
+    r.demand(in, 2)
+    r.copy(in, 2)
+    in.Seek(in.Offset() - 2)
+    count := in.GetUInt16()
+    for i := 0; i < int(count); i++ {
+        r.demand(in, keySize + 1)
+        r.copy(in, uint64(keySize + 1))
+        in.Seek(in.Offset() - 1)
+        jtype := r.readJType(in)
+        r.need(in, uint64(jtype.Size))
+        r.demand(in, jtype.Size)
+        if jtype.IsObj {
+            r.copy(in, uint64(jtype.Size))
+        } else {
+            data := append([]byte{}, in.GetRaw(jtype.Size)...)
+            r.redactValue(jtype, data)
+            r.out.Write(data)
+        }
+    }
+}
+
+// Replace a primitive value with zeroes, or with bytes from a salted hash of it,
+// so values that were equal stay equal.
+//
+func (r *Redactor) redactValue(jtype *JType, data []byte) {
+    if !r.Hash {
+        for i := range data {
+            data[i] = 0
+        }
+        return
+    }
+    sum := sha256.Sum256(append(append([]byte{}, r.salt...), data...))
+    copy(data, sum[:])
+    if jtype.ArrayClass == "[Z" {
+        data[0] &= 1
+    }
+}
+
+// Replace the contents of a primitive array with zeroes, or with bytes from a
+// salted hash of the contents.  Hashed char and byte arrays come out as lower
+// case letters so redacted Strings are still readable.
+//
+func (r *Redactor) redactArray(in *MappedSection, jtype *JType, length uint64) {
+
+    const chunkSize = 1 << 20
+    var seed []byte
+    if r.Hash {
+        h := sha256.New()
+        h.Write(r.salt)
+        for n := length; n > 0; {
+            chunk := uint32(chunkSize)
+            if n < chunkSize {
+                chunk = uint32(n)
+            }
+            in.Demand(chunk)
+            h.Write(in.GetRaw(chunk))
+            n -= uint64(chunk)
+        }
+        seed = h.Sum(nil)
+    } else {
+        in.Seek(in.Offset() + length)
+    }
+
+    buf := make([]byte, chunkSize)
+    block := make([]byte, len(seed) + 8)
+    copy(block, seed)
+    counter := uint64(0)
+
+    for n := length; n > 0; {
+        chunk := buf
+        if n < chunkSize {
+            chunk = buf[:n]
+        }
+        n -= uint64(len(chunk))
+        if !r.Hash {
+            for i := range chunk {
+                chunk[i] = 0
+            }
+            r.out.Write(chunk)
+            continue
+        }
+        for i := 0; i < len(chunk); i += sha256.Size {
+            binary.BigEndian.PutUint64(block[len(seed):], counter)
+            counter++
+            sum := sha256.Sum256(block)
+            copy(chunk[i:], sum[:])
+        }
+        switch jtype.ArrayClass {
+            case "[C":
+                for i := 0; i + 1 < len(chunk); i += 2 {
+                    chunk[i], chunk[i+1] = 0, 'a' + chunk[i+1] % 26
+                }
+            case "[B":
+                for i := range chunk {
+                    chunk[i] = 'a' + chunk[i] % 26
+                }
+            case "[Z":
+                for i := range chunk {
+                    chunk[i] &= 1
+                }
+        }
+        r.out.Write(chunk)
+    }
+}
+
+// Copy bytes from the input to the output.
+//
+func (r *Redactor) copy(in *MappedSection, count uint64) {
+    for count > 0 {
+        chunk := uint32(1 << 20)
+        if count < uint64(chunk) {
+            chunk = uint32(count)
+        }
+        in.Demand(chunk)
+        r.out.Write(in.GetRaw(chunk))
+        count -= uint64(chunk)
+    }
+}
+
+// Write a record header with a zero timestamp.
+//
+func (r *Redactor) putHeader(tag byte, length uint32) {
+    var header [9]byte
+    header[0] = tag
+    binary.BigEndian.PutUint32(header[5:], length)
+    r.out.Write(header[:])
+}
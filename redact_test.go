@@ -0,0 +1,230 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "unicode/utf16"
+)
+
+// Redact a small version of the test heap, plus some strings held by JNI, and
+// check that the structure is the same but the String contents aren't.
+//
+func TestRedact(t *testing.T) {
+
+    dir, err := ioutil.TempDir("", "helmet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    original := filepath.Join(dir, "genheap.hprof")
+    w := BuildGenHeap(1000)
+    for _, text := range []string{"jdbc:foo", "jdbc:bar", "jdbc:foo"} {
+        w.AddRoot(0x01, w.AddString(text))
+    }
+    if err := w.WriteFile(original); err != nil {
+        t.Fatal(err)
+    }
+
+    // Return a heap with its histogram & number of references.
+    read := func(filename string) (*Heap, string, int) {
+        heap, err := ReadHeapDump(filename, &Options{NeedRefs: true, NoIndex: true})
+        if err != nil {
+            t.Fatal(err)
+        }
+        var out bytes.Buffer
+        heap.ClassHisto().Print(NewTextReport(&out))
+        edges := 0
+        for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+            for _, pos := heap.OutEdges(oid); pos != 0; _, pos = heap.NextOutEdge(pos) {
+                edges++
+            }
+        }
+        return heap, out.String(), edges
+    }
+
+    strs := func(heap *Heap) []string {
+        values := []string{}
+        for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+            if value, ok := heap.StringValue(oid); ok {
+                values = append(values, value)
+            }
+        }
+        return values
+    }
+
+    before, histo, edges := read(original)
+    originals := strs(before)
+    if !strings.Contains(strings.Join(originals, ","), "jdbc:foo,jdbc:bar,jdbc:foo") {
+        t.Fatalf("Wrong strings before redacting: %q\n", originals)
+    }
+
+    redacted := filepath.Join(dir, "redacted.hprof")
+    if err := Redact(original, redacted, &RedactOptions{}); err != nil {
+        t.Fatal(err)
+    }
+    after, afterHisto, afterEdges := read(redacted)
+    if afterHisto != histo || afterEdges != edges {
+        t.Errorf("Histogram or graph changed:\n%s\n%s\n", histo, afterHisto)
+    }
+    values := strs(after)
+    if len(values) != len(originals) {
+        t.Fatalf("Wanted %d strings, got %d\n", len(originals), len(values))
+    }
+    for i, value := range values {
+        if value != strings.Repeat("\x00", len(utf16.Encode([]rune(originals[i])))) {
+            t.Errorf("String %q not zeroed: %q\n", originals[i], value)
+        }
+    }
+
+    // Hashed strings stay equal if they were equal before.
+
+    if err := Redact(original, redacted, &RedactOptions{Hash: true}); err != nil {
+        t.Fatal(err)
+    }
+    after, _, _ = read(redacted)
+    values = strs(after)
+    for i, value := range values {
+        if value == originals[i] || strings.Trim(value, "abcdefghijklmnopqrstuvwxyz") != "" {
+            t.Errorf("String %q hashed to %q\n", originals[i], value)
+        }
+        for j, other := range values {
+            if (value == other) != (originals[i] == originals[j]) {
+                t.Errorf("Hashes %q and %q of %q and %q\n", value, other, originals[i], originals[j])
+            }
+        }
+    }
+
+    // Renamed application classes & fields, but not JDK ones
+
+    mapping := filepath.Join(dir, "mapping.txt")
+    if err := Redact(original, redacted, &RedactOptions{MappingFile: mapping}); err != nil {
+        t.Fatal(err)
+    }
+    after, afterHisto, _ = read(redacted)
+    if after.ClassNamed("com.myco.GenHeap$Thing") != nil || after.ClassNamed("java.util.HashMap") == nil {
+        t.Errorf("Wrong classes renamed:\n%s\n", afterHisto)
+    }
+    if len(strings.Split(afterHisto, "\n")) != len(strings.Split(histo, "\n")) {
+        t.Errorf("Histogram changed:\n%s\n%s\n", histo, afterHisto)
+    }
+    text, err := ioutil.ReadFile(mapping)
+    if err != nil {
+        t.Fatal(err)
+    }
+    wantedMapping := "class redacted.Class1 com.myco.GenHeap\n" +
+                     "class redacted.Class2 com.myco.GenHeap$Thing\n" +
+                     "field field1 m\n" +
+                     "field field2 passes\n" +
+                     "field field3 this$0\n" +
+                     "method method1 gen\n" +
+                     "method method2 main\n" +
+                     "source Source1.java GenHeap.java\n"
+    if string(text) != wantedMapping {
+        t.Errorf("Wanted mapping\n%s\ngot\n%s\n", wantedMapping, text)
+    }
+    frames := []string{}
+    for _, frame := range after.Threads()[0].Trace.Frames {
+        frames = append(frames, frame.Method + " " + frame.SourceFile)
+    }
+    if strings.Join(frames, ",") != "sleep ,method1 Source1.java,method2 Source1.java" {
+        t.Errorf("Wrong stack frames %q\n", frames)
+    }
+}
+
+// Primitive fields, statics and constants are redacted along with arrays, except
+// for the JDK fields needed to decode Strings & collections.
+//
+func TestRedactFields(t *testing.T) {
+
+    dir, err := ioutil.TempDir("", "helmet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    const pin, key = int32(0x5ec2e7), int64(0x5ec2e7c0ffee)
+    w := NewHProfWriter(8)
+    account := w.DefineClass("com.myco.Account", nil, WField{"pin", "int"}, WField{"owner", "java.lang.String"})
+    w.AddStatic(account, "KEY", "long", key)
+    list := w.DefineClass("java.util.ArrayList", nil, WField{"size", "int"})
+    w.AddRoot(0x01, w.AddInstance(account, map[string]interface{}{"pin": pin, "owner": w.AddString("alice")}))
+    w.AddRoot(0x01, w.AddInstance(list, map[string]interface{}{"size": int32(3)}))
+    original := filepath.Join(dir, "original.hprof")
+    if err := w.WriteFile(original); err != nil {
+        t.Fatal(err)
+    }
+
+    var pinBytes, keyBytes bytes.Buffer
+    binary.Write(&pinBytes, binary.BigEndian, pin)
+    binary.Write(&keyBytes, binary.BigEndian, key)
+    if data, err := ioutil.ReadFile(original); err != nil {
+        t.Fatal(err)
+    } else if !bytes.Contains(data, pinBytes.Bytes()) || !bytes.Contains(data, keyBytes.Bytes()) {
+        t.Fatalf("Field or static value missing before redacting\n")
+    }
+
+    for _, options := range []*RedactOptions{{}, {Hash: true}} {
+        redacted := filepath.Join(dir, "redacted.hprof")
+        if err := Redact(original, redacted, options); err != nil {
+            t.Fatal(err)
+        }
+        data, err := ioutil.ReadFile(redacted)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if bytes.Contains(data, pinBytes.Bytes()) || bytes.Contains(data, keyBytes.Bytes()) {
+            t.Errorf("Field or static value not redacted with %+v\n", options)
+        }
+
+        heap, err := ReadHeapDump(redacted, &Options{NeedRefs: true, NoIndex: true})
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, oid := range heap.roots {
+            class := heap.ClassOf(oid)
+            switch class.Name {
+                case "com.myco.Account":
+                    value, _ := heap.intField(heap.seekObject(oid), oid, class, "pin")
+                    if !options.Hash && value != 0 {
+                        t.Errorf("Wanted pin 0, got %d\n", value)
+                    }
+                    owner, ok := heap.StringValue(heap.refField(oid, class, "owner"))
+                    if !ok || len(owner) != len("alice") {
+                        t.Errorf("Wanted a 5-character owner, got %q\n", owner)
+                    }
+                case "java.util.ArrayList":
+                    if size, _ := heap.intField(heap.seekObject(oid), oid, class, "size"); size != 3 {
+                        t.Errorf("Wanted size 3 kept, got %d\n", size)
+                    }
+            }
+        }
+    }
+}
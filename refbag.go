@@ -28,61 +28,104 @@ import (
 
 // For accumulating a list of references from an instance or array dump.  We know 
 // the object ID of the source but not that of the target, because we don't 
-// build the HID->OID mapping until after all the object IDs are known.
+// build the HID->OID mapping until after all the object IDs are known.  Each
+// reference also has a label saying where in the source it was found; see
+// Heap.EdgeName.
 //
 type RefBag struct {
     from [][]ObjectId
     to [][]HeapId
+    labels [][]uint32
 }
 
 // Add a reference.
 //
-func (refs *RefBag) AddReference(from ObjectId, to HeapId) {
+func (refs *RefBag) AddReference(from ObjectId, to HeapId, label uint32) {
     if refs.from == nil {
         refs.from = [][]ObjectId{make([]ObjectId, 0, 100000)}
         refs.to = [][]HeapId{make([]HeapId, 0, 100000)}
+        refs.labels = [][]uint32{make([]uint32, 0, 100000)}
     }
     refs.from = AppendOid(refs.from, from)
     refs.to = AppendHid(refs.to, to)
+    refs.labels = Append32(refs.labels, label)
 }
 
-// Combine and resolve a list of RefBags into separate referrer / referee arrays,
-// using a resolution function to turn referee heap IDs into object IDs.  The bags
-// should be discarded afterward to save memory.
+// A reference to a heap ID that the resolver passed to MergeBags couldn't map
+// to an object, usually because the dump is incomplete.
 //
-func MergeBags(bags []*RefBag, resolver func(HeapId) ObjectId) ([]ObjectId, []ObjectId){
+type DanglingRef struct {
+    From ObjectId
+    To HeapId
+    Label uint32
+}
+
+// Combine and resolve a list of RefBags into separate referrer / referee / label
+// arrays, using a resolution function to turn referee heap IDs into object IDs.
+// References the resolver maps to 0 are returned separately as dangling.  The
+// bags should be discarded afterward to save memory.
+//
+func MergeBags(bags []*RefBag, resolver func(HeapId) ObjectId) ([]ObjectId, []ObjectId, []uint32, []DanglingRef) {
 
     count := 0
+    numLists := 0
     for _, bag := range bags {
         for _, list := range bag.from {
             count += len(list)
         }
+        numLists += len(bag.from)
     }
 
     var wg sync.WaitGroup
     newFrom := make([]ObjectId, count)
     newTo := make([]ObjectId, count)
+    newLabels := make([]uint32, count)
     offset := 0
 
     // Crank a separate goroutine for each sublist in each bag, giving it a partition
-    // in newFrom/newTo to write reference data.
+    // in newFrom/newTo to write reference data and a list for dangling references.
 
+    danglers := make([][]DanglingRef, numLists)
+    list := 0
     for _, bag := range bags {
         wg.Add(len(bag.from))
         for i, _ := range bag.from {
-            go func(from []ObjectId, to []HeapId, offset int) {
+            go func(from []ObjectId, to []HeapId, labels []uint32, offset int, dangling *[]DanglingRef) {
                 for j, oid := range from {
                     newFrom[offset+j] = oid
                     newTo[offset+j] = resolver(to[j])
+                    newLabels[offset+j] = labels[j]
+                    if newTo[offset+j] == 0 {
+                        *dangling = append(*dangling, DanglingRef{oid, to[j], labels[j]})
+                    }
                 }
                 wg.Done()
-            }(bag.from[i], bag.to[i], offset)
+            }(bag.from[i], bag.to[i], bag.labels[i], offset, &danglers[list])
             offset += len(bag.from[i])
+            list++
         }
     }
 
     wg.Wait()
-    return newFrom, newTo // TODO: include # of unmappable references
+
+    // Squeeze out the dangling references, if any.
+
+    dangling := []DanglingRef{}
+    for _, refs := range danglers {
+        dangling = append(dangling, refs...)
+    }
+    if len(dangling) > 0 {
+        n := 0
+        for i, oid := range newTo {
+            if oid != 0 {
+                newFrom[n], newTo[n], newLabels[n] = newFrom[i], oid, newLabels[i]
+                n++
+            }
+        }
+        newFrom, newTo, newLabels = newFrom[:n], newTo[:n], newLabels[:n]
+    }
+
+    return newFrom, newTo, newLabels, dangling
 }
 
 
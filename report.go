@@ -0,0 +1,256 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "bytes"
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "io"
+    "strings"
+)
+
+// Renders tabular reports -- histograms, roots, paths &c -- as text, JSON lines
+// or CSV.  A report is a named list of columns followed by rows of values, one
+// per column, and optionally a summary row.
+//
+type ReportWriter interface {
+    // Start a report; may be called more than once for e.g. "histo retained"
+    Begin(name string, columns ...Column)
+    // Add a row of values, one per column
+    Row(values ...interface{})
+    // Add a summary row
+    Total(values ...interface{})
+    // Add a line of detail following a row, e.g. a stack frame
+    Note(format string, args ...interface{})
+}
+
+// One report column.  Format is the Printf format for text output, e.g. "%10v";
+// in text, empty string values and their columns are omitted, and nil values
+// are shown as "-".
+//
+type Column struct {
+    Name string
+    Format string
+}
+
+// Report writers by format name, for "set format" and -format
+//
+var reportFormats = map[string]func(io.Writer) ReportWriter {
+    "text": NewTextReport,
+    "json": NewJSONReport,
+    "csv": NewCSVReport,
+}
+
+// Return a report writer for a format name, or nil if the format is unknown.
+//
+func NewReportWriter(format string, out io.Writer) ReportWriter {
+    if create, ok := reportFormats[format]; ok {
+        return create(out)
+    }
+    return nil
+}
+
+// Wrap a report writer to drop rows after the first max in each report, noting
+// how many were dropped before the summary row.
+//
+func LimitRows(out ReportWriter, max int) ReportWriter {
+    return &limitedReport{ReportWriter: out, max: max}
+}
+
+type limitedReport struct {
+    ReportWriter
+    max int
+    rows int
+}
+
+func (r *limitedReport) Begin(name string, columns ...Column) {
+    r.rows = 0
+    r.ReportWriter.Begin(name, columns...)
+}
+
+func (r *limitedReport) Row(values ...interface{}) {
+    r.rows++
+    if r.rows <= r.max {
+        r.ReportWriter.Row(values...)
+    }
+}
+
+func (r *limitedReport) Total(values ...interface{}) {
+    if r.rows > r.max {
+        r.ReportWriter.Note("%21s (%d more not shown, see maxrows)", "", r.rows - r.max)
+    }
+    r.ReportWriter.Total(values...)
+}
+
+func (r *limitedReport) Note(format string, args ...interface{}) {
+    if r.rows <= r.max {
+        r.ReportWriter.Note(format, args...)
+    }
+}
+
+// Fixed-width text, for humans; reports are separated by blank lines.
+//
+type textReport struct {
+    out io.Writer
+    columns []Column
+    started bool
+}
+
+func NewTextReport(out io.Writer) ReportWriter {
+    return &textReport{out: out}
+}
+
+func (r *textReport) Begin(name string, columns ...Column) {
+    if r.started {
+        fmt.Fprintln(r.out)
+    }
+    r.columns = columns
+    r.started = true
+}
+
+func (r *textReport) Row(values ...interface{}) {
+    fields := make([]string, 0, len(values))
+    for i, value := range values {
+        switch value {
+            case "":
+                continue
+            case nil:
+                value = "-"
+        }
+        fields = append(fields, fmt.Sprintf(r.columns[i].Format, value))
+    }
+    fmt.Fprintln(r.out, strings.Join(fields, " "))
+}
+
+func (r *textReport) Total(values ...interface{}) {
+    r.Row(values...)
+}
+
+func (r *textReport) Note(format string, args ...interface{}) {
+    fmt.Fprintf(r.out, format + "\n", args...)
+}
+
+// One JSON object per row, with a "report" member naming the report and a
+// "total" member on summary rows.  Notes are objects with just "report" and a
+// "note" member holding the text.
+//
+type jsonReport struct {
+    out io.Writer
+    name []byte
+    columns [][]byte
+}
+
+func NewJSONReport(out io.Writer) ReportWriter {
+    return &jsonReport{out: out}
+}
+
+func (r *jsonReport) Begin(name string, columns ...Column) {
+    r.name, _ = json.Marshal(name)
+    r.columns = make([][]byte, len(columns))
+    for i, column := range columns {
+        r.columns[i], _ = json.Marshal(column.Name)
+    }
+}
+
+func (r *jsonReport) Row(values ...interface{}) {
+    r.write(values, false)
+}
+
+func (r *jsonReport) Total(values ...interface{}) {
+    r.write(values, true)
+}
+
+func (r *jsonReport) Note(format string, args ...interface{}) {
+    note, _ := json.Marshal(strings.TrimSpace(fmt.Sprintf(format, args...)))
+    fmt.Fprintf(r.out, "{\"report\":%s,\"note\":%s}\n", r.name, note)
+}
+
+func (r *jsonReport) write(values []interface{}, total bool) {
+    var buf bytes.Buffer
+    buf.WriteString(`{"report":`)
+    buf.Write(r.name)
+    for i, value := range values {
+        encoded, err := json.Marshal(value)
+        if err != nil {
+            encoded, _ = json.Marshal(fmt.Sprint(value))
+        }
+        buf.WriteByte(',')
+        buf.Write(r.columns[i])
+        buf.WriteByte(':')
+        buf.Write(encoded)
+    }
+    if total {
+        buf.WriteString(`,"total":true`)
+    }
+    buf.WriteString("}\n")
+    r.out.Write(buf.Bytes())
+}
+
+// CSV with a header row at the start of each report; nil values are empty.
+// Notes are rows with the text in the last column and the others empty.
+//
+type csvReport struct {
+    out *csv.Writer
+    width int
+}
+
+func NewCSVReport(out io.Writer) ReportWriter {
+    return &csvReport{out: csv.NewWriter(out)}
+}
+
+func (r *csvReport) Begin(name string, columns ...Column) {
+    r.width = len(columns)
+    header := make([]string, len(columns))
+    for i, column := range columns {
+        header[i] = column.Name
+    }
+    r.out.Write(header)
+    r.out.Flush()
+}
+
+func (r *csvReport) Row(values ...interface{}) {
+    record := make([]string, len(values))
+    for i, value := range values {
+        if value != nil {
+            record[i] = fmt.Sprint(value)
+        }
+    }
+    r.out.Write(record)
+    r.out.Flush()
+}
+
+func (r *csvReport) Total(values ...interface{}) {
+    r.Row(values...)
+}
+
+func (r *csvReport) Note(format string, args ...interface{}) {
+    record := make([]string, r.width)
+    if r.width == 0 {
+        record = make([]string, 1) // no Begin yet
+    }
+    record[len(record) - 1] = strings.TrimSpace(fmt.Sprintf(format, args...))
+    r.out.Write(record)
+    r.out.Flush()
+}
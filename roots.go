@@ -0,0 +1,183 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "fmt"
+)
+
+// What kind of GC root, per the HPROF heap dump sub-record tags
+//
+type RootKind uint8
+
+const (
+    RootUnknown RootKind = iota
+    RootJNIGlobal
+    RootJNILocal
+    RootJavaFrame
+    RootNativeStack
+    RootStickyClass
+    RootThreadBlock
+    RootMonitorUsed
+    RootThreadObject
+    NumRootKinds
+)
+
+// Names used in the session, indexed by RootKind
+//
+var rootKindNames = []string{
+    "unknown",
+    "jniglobal",
+    "jnilocal",
+    "javaframe",
+    "nativestack",
+    "stickyclass",
+    "threadblock",
+    "monitorused",
+    "threadobject",
+}
+
+func (kind RootKind) String() string {
+    return rootKindNames[kind]
+}
+
+// Return the RootKind with the given session name.
+//
+func RootKindNamed(name string) (RootKind, bool) {
+    for i, kindName := range rootKindNames {
+        if name == kindName {
+            return RootKind(i), true
+        }
+    }
+    return RootUnknown, false
+}
+
+// One of these per GC root sub-record in the heap dump.  Which of the per-root
+// fields are meaningful depends on the kind.
+//
+type GCRoot struct {
+    Kind RootKind
+    // native id of the root object
+    Hid HeapId
+    // object id of same, resolved during PostProcess; 0 if not in the heap
+    Oid ObjectId
+    // thread serial number, for JNI local, java frame, native stack, thread
+    // block and thread object roots
+    ThreadSerial uint32
+    // frame number in the thread's stack trace, for JNI local & java frame
+    // roots; -1 if empty
+    FrameDepth int32
+    // stack trace serial number, for thread object roots
+    StackSerial uint32
+    // JNI global ref id, for JNI global roots
+    JNIRef HeapId
+}
+
+// Return a description of the per-root fields that are meaningful for this kind.
+//
+func (root *GCRoot) Detail() string {
+    switch root.Kind {
+        case RootJNILocal, RootJavaFrame:
+            return fmt.Sprintf("thread %d frame %d", root.ThreadSerial, root.FrameDepth)
+        case RootNativeStack, RootThreadBlock:
+            return fmt.Sprintf("thread %d", root.ThreadSerial)
+        case RootThreadObject:
+            return fmt.Sprintf("thread %d stack %d", root.ThreadSerial, root.StackSerial)
+        case RootJNIGlobal:
+            return fmt.Sprintf("ref %x", root.JNIRef)
+    }
+    return ""
+}
+
+// Return the GC roots of a given kind, or all of them if all is true.
+//
+func (heap *Heap) RootsOfKind(kind RootKind, all bool) []*GCRoot {
+    roots := []*GCRoot{}
+    for _, root := range heap.gcRoots {
+        if all || root.Kind == kind {
+            roots = append(roots, root)
+        }
+    }
+    return roots
+}
+
+// Return a bitset of object IDs that are roots of a given kind, or of any kind
+// if all is true.
+//
+func (heap *Heap) RootObjects(kind RootKind, all bool) BitSet {
+    bits := NewBitSet(uint32(heap.MaxObjectId) + 1)
+    for _, root := range heap.RootsOfKind(kind, all) {
+        if root.Oid != 0 {
+            bits.Set(uint32(root.Oid))
+        }
+    }
+    return bits
+}
+
+// Print a list of GC roots, one per line.
+//
+func (heap *Heap) PrintRoots(out ReportWriter, roots []*GCRoot) {
+    out.Begin("roots", Column{"oid", "%10v"}, Column{"kind", "%-12v"}, Column{"class", "%v"},
+              Column{"detail", "%v"})
+    for _, root := range roots {
+        if root.Oid == 0 {
+            out.Row(nil, root.Kind.String(), "", fmt.Sprintf("not in heap (%x)", root.Hid))
+        } else {
+            out.Row(root.Oid, root.Kind.String(), heap.ClassOf(root.Oid).Name, root.Detail())
+        }
+    }
+}
+
+// Print the number of roots of each kind and the retained size of the objects
+// they hold, as a group.  An object that is a root of more than one kind counts
+// toward the first kind found.
+//
+func (heap *Heap) PrintRootsByKind(out ReportWriter) {
+
+    counts := make([]int, NumRootKinds)
+    kindOf := make(map[ObjectId]int)
+    for _, root := range heap.gcRoots {
+        counts[root.Kind]++
+        if _, ok := kindOf[root.Oid]; !ok && root.Oid != 0 {
+            kindOf[root.Oid] = int(root.Kind)
+        }
+    }
+
+    isRoot := heap.RootObjects(RootUnknown, true)
+    retained := heap.Dominators().GroupRetained(func(oid ObjectId) int {
+        if isRoot.Has(uint32(oid)) {
+            return kindOf[oid]
+        }
+        return -1
+    }, int(NumRootKinds))
+
+    out.Begin("rootsbykind", Column{"count", "%10v"}, Column{"retained", "%10v"}, Column{"kind", "%v"})
+    total := 0
+    for kind, count := range counts {
+        if count > 0 {
+            out.Row(count, retained[kind], RootKind(kind).String())
+            total += count
+        }
+    }
+    out.Total(total, heap.Dominators().ReachableSize(), "total")
+}
@@ -24,12 +24,19 @@ package main
 
 import (
     "log"
+    "strconv"
+    "strings"
 )
 
+// Step types starting with this match GC roots instead of classes, e.g.
+// "root:javaframe" or "root:any"
+//
+const RootStepPrefix = "root:"
+
 // Represents one step in a query.
 //
 type Step struct {
-    // The type name / wildcard, e.g. "ArrayList" 
+    // The type name / wildcard, e.g. "ArrayList", or a root kind, e.g. "root:jniglobal"
     types string
     // Optional variable name, e.g. "list", else ""
     varName string
@@ -37,6 +44,11 @@ type Step struct {
     to bool
     // Skip instances of skipped classes
     skip bool
+    // Optional condition from a "where" clause, else nil
+    where *WhereClause
+    // Follow only refs from this field or array index, e.g. "value" for -[value]->,
+    // else ""
+    via string
 }
 
 // Represents a complete query; includes the step indices whose foci are
@@ -44,6 +56,10 @@ type Step struct {
 type Query struct {
     steps []*Step
     argIndices []int
+    // name of the search function, see collectors.go
+    fnName string
+    // numeric arg to same, e.g. the n in top(n, x), else 0
+    limit int
 }
 
 // Implemented by types that can collect group / member object ids
@@ -73,6 +89,8 @@ type Finder struct {
     *Step
     // what class IDs match Step.types
     classes BitSet
+    // if non-nil, what object IDs match Step.types instead of classes
+    objects BitSet
     // does this step skip skipped classes
     skip bool
     // current object id at this Finder
@@ -85,6 +103,8 @@ type Finder struct {
     next *Finder
     // what objects have been touched on each pass
     touched *UndoableBitSet
+    // Step.via as an array index, or -1 if not a number
+    viaIndex int64
 }
 
 func SearchHeap(heap *Heap, query *Query, coll Collector) {
@@ -99,13 +119,18 @@ func SearchHeap(heap *Heap, query *Query, coll Collector) {
             index: i,
             Heap: heap,
             Step: step,
-            classes: heap.CidsMatching(query.steps[i].types),
+            classes: nil,
+            objects: nil,
             skip: step.skip && i > 0,
             focus: 0,
             stack: make([]ObjectId, 0, 10000),
             next: nil,
             // TODO make this more compact
             touched: touched,
+            viaIndex: -1,
+        }
+        if index, err := strconv.ParseUint(step.via, 10, 32); err == nil {
+            finders[i].viaIndex = int64(index)
         }
     }
 
@@ -113,6 +138,16 @@ func SearchHeap(heap *Heap, query *Query, coll Collector) {
         finders[i].next = finders[i+1]
     }
 
+    for _, finder := range finders {
+        if strings.HasPrefix(finder.types, RootStepPrefix) {
+            kindName := finder.types[len(RootStepPrefix):]
+            kind, _ := RootKindNamed(kindName)
+            finder.objects = heap.RootObjects(kind, kindName == "any")
+        } else {
+            finder.classes = heap.CidsMatching(finder.types)
+        }
+    }
+
     // Save state about collector args
 
     cargs := &CollectorArgs{
@@ -136,7 +171,7 @@ func SearchHeap(heap *Heap, query *Query, coll Collector) {
     start := finders[0]
     for oid := ObjectId(1); oid <= heap.Graph.MaxNode; oid++ {
         class := heap.ClassOf(oid)
-        if start.classes.Has(uint32(class.Cid)) {
+        if start.matches(oid, class) {
             start.check(oid)
             touched.Undo()
         }
@@ -168,19 +203,24 @@ func (finder *Finder) doCheck(oid ObjectId) {
     finder.focus = oid
     class := heap.ClassOf(oid)
     log.Printf("doCheck %d %d a %s\n", finder.index, oid, class.Name)
-    if finder.classes.Has(uint32(class.Cid)) {
+    if finder.matches(oid, class) {
         // Object is a match at this query step
         if finder.next != nil {
             // Not at last query step?  Let next step handle adjacent nodes.
-            if (finder.next.Step.to) {
+            next := finder.next
+            if (next.Step.to) {
                 for dst, pos := heap.OutEdges(oid); pos != 0; dst, pos = heap.NextOutEdge(pos) {
-                    log.Printf("follow %d\n", dst)
-                    finder.next.check(dst)
+                    if next.via == "" || next.isVia(oid, heap.OutLabel(pos)) {
+                        log.Printf("follow %d\n", dst)
+                        next.check(dst)
+                    }
                 }
             } else {
                 for dst, pos := heap.InEdges(oid); pos != 0; dst, pos = heap.NextInEdge(pos) {
-                    log.Printf("follow %d\n", dst)
-                    finder.next.check(dst)
+                    if next.via == "" || next.isVia(dst, heap.InLabel(pos)) {
+                        log.Printf("follow %d\n", dst)
+                        next.check(dst)
+                    }
                 }
             }
         } else {
@@ -211,6 +251,29 @@ func (finder *Finder) doCheck(oid ObjectId) {
     }
 }
 
+// Is a reference from an object, with a given edge label, from the field or
+// array index this finder's step requires.
+//
+func (finder *Finder) isVia(src ObjectId, label uint32) bool {
+    if finder.ClassForObject(src) == nil && finder.ClassOf(src).IsArray() {
+        return int64(label) == finder.viaIndex
+    }
+    return finder.EdgeName(src, label) == finder.via
+}
+
+// Does an object match this finder's step, by class or by object ID.
+//
+func (finder *Finder) matches(oid ObjectId, class *ClassDef) bool {
+    if finder.objects != nil {
+        if !finder.objects.Has(uint32(oid)) {
+            return false
+        }
+    } else if !finder.classes.Has(uint32(class.Cid)) {
+        return false
+    }
+    return finder.where == nil || finder.where.Matches(finder.Heap, oid)
+}
+
 /*
 // TODO: do wildcard matching differently
 val isWild = target.types endsWith ".*"
@@ -23,15 +23,24 @@
 package main
 
 import (
+    "bytes"
+    "encoding/json"
     . "launchpad.net/gocheck"
     "fmt"
+    "io/ioutil"
     "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
 )
 
 type SearchSuite struct{} 
 var _ = Suite(&SearchSuite{})
 
 var testHeap *Heap
+var testHeapName string
 
 func (s *SearchSuite) TestSearch(c *C) {
 
@@ -51,25 +60,646 @@ func (s *SearchSuite) TestSearch(c *C) {
     // manually construct "x group y from Object x -> Integer y"
     query := &Query {
         []*Step {
-            &Step{"Object", "x", true, false},
-            &Step{"Integer", "y", true, false},
+            &Step{"Object", "x", true, false, nil, ""},
+            &Step{"Integer", "y", true, false, nil, ""},
         },
         []int{0, 1},
+        "histo",
+        0,
     }
     histo = heap.NewHisto()
     SearchHeap(heap, query, histo)
-    histo.Print(os.Stdout)
+    histo.Print(NewTextReport(os.Stdout))
+}
+
+// Verify the retained histogram accounts for everything Things hold.
+//
+func (s *SearchSuite) TestRetainedHisto(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+
+    byClass, byLoader := heap.RetainedHistos()
+    byClass.Print(NewTextReport(os.Stdout))
+    byLoader.Print(NewTextReport(os.Stdout))
+
+    thing := heap.ClassNamed("com.myco.GenHeap$Thing")
+    integer := heap.ClassNamed("Integer")
+    count, nbytes := byClass.Counts(thing)
+    c.Check(count, Equals, uint32(10000))
+    c.Check(byClass.counts[thing.Cid].retained >= nbytes, Equals, true)
+    c.Check(byClass.counts[thing.Cid].retained > byClass.counts[integer.Cid].retained, Equals, true)
+}
+
+// Verify we can find why a Thing is alive.
+//
+func (s *SearchSuite) TestPathFromRoot(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+
+    thing := heap.ClassNamed("com.myco.GenHeap$Thing")
+    oid := ObjectId(1)
+    for heap.ClassOf(oid) != thing {
+        oid++
+    }
+
+    path := heap.PathFromRoot(oid, true)
+    heap.PrintPath(NewTextReport(os.Stdout), path)
+    c.Assert(path, NotNil)
+    c.Check(path[len(path)-1], Equals, oid)
+    for i := 1; i < len(path); i++ {
+        c.Check(heap.refName(path[i-1], path[i]), Not(Equals), "?")
+    }
+}
+
+// Verify searches can start from GC roots.
+//
+func (s *SearchSuite) TestRootSearch(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+    parsers := NewParsers()
+
+    frames := heap.RootsOfKind(RootJavaFrame, false)
+    c.Check(len(frames) > 0, Equals, true)
+    heap.PrintRoots(NewTextReport(os.Stdout), frames)
+    heap.PrintRootsByKind(NewTextReport(os.Stdout))
+
+    histo := heap.NewHisto()
+    _, _, result := parsers.Command.Parse("run histo(x, x) from root:javaframe x")
+    SearchHeap(heap, result.(SearchAction).Query, histo)
+    count, _ := histo.Counts(heap.ClassNamed("com.myco.GenHeap"))
+    c.Check(count, Equals, uint32(1))
+}
+
+// Verify class objects are in the graph, with named edges to their superclasses.
+//
+func (s *SearchSuite) TestClassObjects(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+
+    list := heap.ClassNamed("java.util.ArrayList")
+    c.Assert(list.Oid, Not(Equals), ObjectId(0))
+    c.Check(heap.ClassOf(list.Oid).Name, Equals, "java.lang.Class")
+    c.Check(heap.ClassForObject(list.Oid), Equals, list)
+    c.Check(heap.refName(list.Oid, list.Super().Oid), Equals, "<super>")
+}
+
+// Verify thread stacks and the frame locals they hold.
+//
+func (s *SearchSuite) TestThreads(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+
+    threads := heap.Threads()
+    c.Assert(len(threads) > 0, Equals, true)
+    heap.PrintThreads(NewTextReport(os.Stdout))
+
+    var main *Thread
+    for _, thread := range threads {
+        if thread.Name == "main" {
+            main = thread
+        }
+    }
+    c.Assert(main, NotNil)
+    c.Assert(main.Trace, NotNil)
+    c.Check(main.Oid, Not(Equals), ObjectId(0))
+
+    // GenHeap.gen holds the GenHeap instance
+    found := false
+    for i, frame := range main.Trace.Frames {
+        if frame.ClassName == "com.myco.GenHeap" && frame.Method == "gen" {
+            for _, root := range main.Locals[i] {
+                found = found || heap.ClassOf(root.Oid).Name == "com.myco.GenHeap"
+            }
+        }
+    }
+    c.Check(found, Equals, true)
+}
+
+// Verify object contents are decoded, superclass fields included.
+//
+func (s *SearchSuite) TestShowObject(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+
+    list := heap.ClassNamed("java.util.ArrayList")
+    oid := ObjectId(1)
+    for heap.ClassOf(oid) != list {
+        oid++
+    }
+
+    var buf bytes.Buffer
+    heap.ShowObject(&buf, oid)
+    out := buf.String()
+    fmt.Print(out)
+    c.Check(strings.Contains(out, " java.util.ArrayList ("), Equals, true)
+    c.Check(strings.Contains(out, "modCount = "), Equals, true)
+    c.Check(regexp.MustCompile(`elementData = \d+ \(java.lang.Object\[\]\)`).MatchString(out), Equals, true)
+
+    buf.Reset()
+    heap.ShowObject(&buf, list.Oid)
+    fmt.Print(buf.String())
+    c.Check(strings.Contains(buf.String(), " class java.util.ArrayList ("), Equals, true)
+}
+
+// Verify strings are decoded and can be searched by content.
+//
+func (s *SearchSuite) TestStrings(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+    parsers := NewParsers()
+
+    // Take the most common word-like string, whatever the dump has.
+
+    strs := heap.ClassNamed("java.lang.String")
+    counts := make(map[string]uint32)
+    word := regexp.MustCompile(`^\w+$`)
+    for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+        if heap.ClassOf(oid) != strs {
+            continue
+        }
+        text, ok := heap.StringValue(oid)
+        c.Assert(ok, Equals, true, Commentf("can't decode String %d", oid))
+        if word.MatchString(text) {
+            counts[text]++
+        }
+    }
+    common := ""
+    for text, count := range counts {
+        if count > counts[common] || count == counts[common] && text < common {
+            common = text
+        }
+    }
+    c.Assert(common, Not(Equals), "")
+
+    histo := heap.NewHisto()
+    _, _, result := parsers.Command.Parse(`run histo(s, s) from String s where s =~ "^` + common + `$"`)
+    SearchHeap(heap, result.(SearchAction).Query, histo)
+    count, _ := histo.Counts(strs)
+    c.Check(count, Equals, counts[common])
+
+    histo = heap.NewHisto()
+    _, _, result = parsers.Command.Parse(`run histo(s, s) from String s where s =~ "^no such string$"`)
+    SearchHeap(heap, result.(SearchAction).Query, histo)
+    count, _ = histo.Counts(strs)
+    c.Check(count, Equals, uint32(0))
+}
+
+// Search with field comparisons in where clauses.
+//
+func (s *SearchSuite) TestFieldPredicates(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+    search := func(query string, className string) uint32 {
+        return searchCount(c, heap, query, className)
+    }
+
+    // Decode the fields being tested to see what the searches should find.
+
+    list := heap.ClassNamed("java.util.ArrayList")
+    lists, big, withData := uint32(0), uint32(0), uint32(0)
+    thing := heap.ClassNamed("com.myco.GenHeap$Thing")
+    values := []int{}
+    str := heap.ClassNamed("java.lang.String")
+    lengths := map[uint32]uint32{}
+    var someLength uint32
+
+    for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+        switch heap.ClassOf(oid) {
+            case list:
+                lists++
+                if size, _ := heap.intField(heap.seekObject(oid), oid, list, "size"); size > 8 {
+                    big++
+                }
+                if heap.refField(oid, list, "elementData") != 0 {
+                    withData++
+                }
+            case thing:
+                if value := heap.refField(oid, thing, "value"); value != 0 {
+                    n, ok := heap.intField(heap.seekObject(value), value, heap.ClassOf(value), "value")
+                    c.Assert(ok, Equals, true)
+                    values = append(values, int(n))
+                }
+            case str:
+                if chars := heap.refField(oid, str, "value"); chars != 0 {
+                    length, ok := heap.arrayLength(heap.seekObject(chars), chars)
+                    c.Assert(ok, Equals, true)
+                    if len(lengths) == 0 {
+                        someLength = length
+                    }
+                    lengths[length]++
+                }
+        }
+    }
+    c.Assert(lists > 0, Equals, true)
+    c.Assert(len(values) > 0, Equals, true)
+    c.Assert(len(lengths) > 0, Equals, true)
+    things, _ := heap.ClassHisto().Counts(thing)
+
+    // Values in the top tenth, and values no Thing has
+    sort.Ints(values)
+    threshold := values[len(values) * 9 / 10]
+    high := uint32(0)
+    for _, value := range values {
+        if value >= threshold {
+            high++
+        }
+    }
+    missing := values[0] - 1
+
+    listsWhere := "run histo(l, l) from java.util.ArrayList l where "
+    c.Check(search(listsWhere + "l.size > 8", list.Name), Equals, big)
+    c.Check(search(listsWhere + "l.size <= 8", list.Name), Equals, lists - big)
+    c.Check(search(listsWhere + "l.elementData.length >= 0", list.Name), Equals, withData)
+
+    thingsWhere := "run histo(t, t) from " + thing.Name + " t where "
+    c.Check(search(thingsWhere + "t.value == null", thing.Name), Equals, things - uint32(len(values)))
+    c.Check(search(thingsWhere + "t.value != null", thing.Name), Equals, uint32(len(values)))
+    c.Check(search(thingsWhere + fmt.Sprintf("t.value.value >= %d", threshold), thing.Name), Equals, high)
+    c.Check(search(thingsWhere + fmt.Sprintf("t.value.value == %d", missing), thing.Name), Equals, uint32(0))
+    c.Check(search(thingsWhere + "t.nosuchfield == null", thing.Name), Equals, uint32(0))
+
+    c.Check(search(fmt.Sprintf("run histo(s, s) from String s where s.value.length == %d", someLength), str.Name), 
+            Equals, lengths[someLength])
+}
+
+// Search with field-qualified arrows.
+//
+func (s *SearchSuite) TestFieldArrows(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+    search := func(query string, className string) uint32 {
+        return searchCount(c, heap, query, className)
+    }
+
+    // Tally what the map entries' keys and values are, by class.
+
+    entry := heap.ClassNamed("java.util.HashMap$Entry")
+    keys := map[string]map[ObjectId]bool{}
+    values := map[string]map[ObjectId]bool{}
+    tally := func(counts map[string]map[ObjectId]bool, oid ObjectId) {
+        if oid != 0 {
+            name := heap.ClassOf(oid).Name
+            if counts[name] == nil {
+                counts[name] = map[ObjectId]bool{}
+            }
+            counts[name][oid] = true
+        }
+    }
+    for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+        if heap.ClassOf(oid) == entry {
+            tally(keys, heap.refField(oid, entry, "key"))
+            tally(values, heap.refField(oid, entry, "value"))
+        }
+    }
+    c.Assert(len(values["java.util.ArrayList"]) > 0, Equals, true)
+    c.Assert(len(keys["java.lang.Integer"]) > 0, Equals, true)
+
+    // An unqualified arrow finds the keys and values; qualified ones split them.
+
+    entries := "run histo(x, x) from java.util.HashMap$Entry e "
+    for _, name := range []string{"java.util.ArrayList", "java.lang.Integer"} {
+        for oid, _ := range keys[name] {
+            c.Assert(values[name][oid], Equals, false)
+        }
+        byValue := search(entries + "-[value]-> Object x", name)
+        byKey := search(entries + "-[key]-> Object x", name)
+        c.Check(byValue, Equals, uint32(len(values[name])), Commentf(name))
+        c.Check(byKey, Equals, uint32(len(keys[name])), Commentf(name))
+        c.Check(search(entries + "-> Object x", name), Equals, byValue + byKey, Commentf(name))
+    }
+    c.Check(search(entries + "-[nosuchfield]-> Object x", "java.lang.Integer"), Equals, uint32(0))
+
+    lists := "run histo(l, l) from java.util.ArrayList l "
+    c.Check(search(lists + "<-[value]- java.util.HashMap$Entry e", "java.util.ArrayList"), 
+            Equals, uint32(len(values["java.util.ArrayList"])))
+    c.Check(search(lists + "<-[key]- java.util.HashMap$Entry e", "java.util.ArrayList"), 
+            Equals, uint32(len(keys["java.util.ArrayList"])))
+
+    // Array elements by index
+
+    table := "run histo(e, e) from java.util.HashMap$Entry[] t "
+    first := search(table + "-[0]-> java.util.HashMap$Entry e", "java.util.HashMap$Entry")
+    all := search(table + "-> java.util.HashMap$Entry e", "java.util.HashMap$Entry")
+    c.Check(first <= 1, Equals, true)
+    c.Check(all > first, Equals, true)
+}
+
+// Run each search function and check what it collected.
+//
+func (s *SearchSuite) TestSearchFunctions(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+    parsers := NewParsers()
+
+    search := func(command string) ReportCollector {
+        _, _, result := parsers.Command.Parse(command)
+        action, ok := result.(SearchAction)
+        c.Assert(ok, Equals, true, Commentf("%s: %v", command, result))
+        collector := searchFunctions[action.Query.fnName].New(heap, action.Query.limit)
+        SearchHeap(heap, action.Query, collector)
+        collector.Print(NewTextReport(os.Stdout))
+        return collector
+    }
+
+    thing := heap.ClassNamed("com.myco.GenHeap$Thing")
+    things := " from com.myco.GenHeap$Thing t"
+    inLists := " from java.util.ArrayList l -> java.lang.Object[] a -> com.myco.GenHeap$Thing t"
+
+    // What a histo over the same search finds
+    count, nbytes := searchHisto(c, heap, "run histo(t, t)" + things).Counts(thing)
+    c.Assert(count > 0, Equals, true)
+
+    c.Check(search("run count(t)" + things).(*countCollector).matches, Equals, uint64(count))
+    listed := search("run distinct(t)" + inLists).(*distinctCollector).count
+    c.Check(listed > 0, Equals, true)
+    c.Check(search("run count(t)" + inLists).(*countCollector).matches, Equals, uint64(listed))
+
+    distinct := search("run distinct(t)" + things).(*distinctCollector)
+    c.Check(distinct.count, Equals, count)
+    c.Check(distinct.nbytes, Equals, nbytes)
+
+    byClass, _ := heap.RetainedHistos()
+    sum := search("run sum(t)" + things).(*sumCollector)
+    var retained bytes.Buffer
+    sum.Print(NewJSONReport(&retained))
+    c.Check(retained.String(), Equals, 
+            fmt.Sprintf(`{"report":"sum","count":%d,"bytes":%d,"retained":%d}` + "\n", 
+                        count, nbytes, byClass.counts[thing.Cid].retained))
+
+    list := search("run list(g) from com.myco.GenHeap g").(*listCollector)
+    c.Check(len(list.oids), Equals, 1)
+    c.Check(heap.ClassOf(list.oids[0]).Name, Equals, "com.myco.GenHeap")
+
+    // top(n) keeps and shows only the n largest, biggest first
+
+    arrays := heap.ClassNamed("java.lang.Object[]")
+    biggest := uint32(0)
+    for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+        if heap.ClassOf(oid) == arrays && heap.SizeOf(oid) > biggest {
+            biggest = heap.SizeOf(oid)
+        }
+    }
+    arrayCount, _ := heap.ClassHisto().Counts(arrays)
+    c.Assert(arrayCount > 3, Equals, true)
+    top := search("run top(3, a) from java.lang.Object[] a").(*topCollector)
+    c.Check(top.top.Len(), Equals, 3)
+    var topOut bytes.Buffer
+    top.Print(NewCSVReport(&topOut))
+    rows := strings.Split(strings.TrimSpace(topOut.String()), "\n")[1:]
+    c.Check(len(rows), Equals, 3)
+    last := uint64(biggest)
+    for i, row := range rows {
+        size, err := strconv.ParseUint(strings.Split(row, ",")[1], 10, 32)
+        c.Assert(err, IsNil)
+        if i == 0 {
+            c.Check(size, Equals, uint64(biggest))
+        }
+        c.Check(size <= last, Equals, true, Commentf(row))
+        last = size
+    }
+
+    groups := search("run groupby(l, t)" + inLists).(*groupCollector)
+    total := uint32(0)
+    for i, group := range groups.groups {
+        c.Check(heap.ClassOf(group.oid).Name, Equals, "java.util.ArrayList")
+        c.Check(group.retained >= group.nbytes, Equals, true)
+        if i > 0 {
+            c.Check(group.retained <= groups.groups[i-1].retained, Equals, true)
+        }
+        total += group.count
+    }
+    c.Check(total, Equals, listed)
+
+    // Repeated matches count once per group, even across compactions.
+
+    grouper := searchFunctions["groupby"].New(heap, 0).(*groupCollector)
+    for i := 0; i < 3 * groupCompactSize; i++ {
+        grouper.Collect([]ObjectId{1 + ObjectId(i % 2), 3 + ObjectId(i % 5)})
+    }
+    grouper.Print(NewTextReport(os.Stdout))
+    c.Assert(grouper.groups, HasLen, 2)
+    c.Check(grouper.groups[0].count + grouper.groups[1].count, Equals, uint32(10))
+}
+
+// Verify duplicate groups have identical contents and are ranked by waste.
+//
+func (s *SearchSuite) TestDuplicates(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+
+    groups, err := heap.FindDuplicates()
+    c.Assert(err, IsNil)
+    heap.PrintDuplicates(NewTextReport(os.Stdout), groups, DefaultDupGroups)
+    for i, group := range groups {
+        c.Check(len(group.Members) > 1, Equals, true)
+        c.Check(group.Wasted, Equals, uint64(len(group.Members) - 1) * group.Size)
+        if i > 0 {
+            c.Check(group.Wasted <= groups[i-1].Wasted, Equals, true)
+        }
+        if text, ok := heap.StringValue(group.Members[0]); ok {
+            for _, member := range group.Members[1:] {
+                other, _ := heap.StringValue(member)
+                c.Check(other, Equals, text)
+            }
+        }
+    }
+}
+
+// Verify stack frames, which follow their threads as notes, appear in JSON
+// output.
+//
+func (s *SearchSuite) TestJSONNotes(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+
+    var out bytes.Buffer
+    session := &Session{Heap: heap, Settings: DefaultSettings(), Out: &out}
+    c.Assert(session.run("set format json"), Equals, true)
+    c.Assert(session.run("threads"), Equals, true)
+
+    frames, notes := 0, 0
+    for _, thread := range heap.Threads() {
+        if thread.Trace != nil {
+            frames += len(thread.Trace.Frames)
+        }
+    }
+    for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+        var record map[string]interface{}
+        c.Assert(json.Unmarshal([]byte(line), &record), IsNil, Commentf(line))
+        if note, ok := record["note"].(string); ok && strings.HasPrefix(note, "at ") {
+            notes++
+        }
+    }
+    c.Check(frames > 0, Equals, true)
+    c.Check(notes, Equals, frames)
+}
+
+// Verify collection sizes & capacities are found.
+//
+func (s *SearchSuite) TestCollections(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+
+    stats := heap.AnalyzeCollections()
+    heap.PrintCollections(NewTextReport(os.Stdout), stats)
+
+    // Lists are owned by the class of their immediate dominator.
+
+    owners := make(map[string]uint32)
+    list := heap.ClassNamed("java.util.ArrayList")
+    for oid := ObjectId(1); oid <= heap.MaxObjectId; oid++ {
+        if heap.ClassOf(oid) == list {
+            owner := "<none>"
+            if dom := heap.Dominators().Dominator(oid); dom != 0 {
+                owner = heap.ClassOf(dom).Name
+            }
+            owners[owner]++
+        }
+    }
+    c.Assert(len(owners) > 0, Equals, true)
+
+    for _, s := range stats {
+        c.Check(s.Capacity >= s.Size, Equals, true)
+        c.Check(s.Empty <= s.Count, Equals, true)
+        if s.Collection == list {
+            owner := "<none>"
+            if s.Owner != nil {
+                owner = s.Owner.Name
+            }
+            c.Check(s.Count, Equals, owners[owner], Commentf("lists owned by %s", owner))
+            delete(owners, owner)
+        }
+    }
+    c.Check(owners, HasLen, 0)
+}
+
+// Check that histograms honour the mingroupsize, sort and maxrows settings.
+//
+func (s *SearchSuite) TestHistoSettings(c *C) {
+
+    LogTestOutput()
+    var out bytes.Buffer
+    session := &Session{Heap: getHeap(c), Settings: DefaultSettings(), Out: &out}
+    lines := func(commands ...string) []string {
+        out.Reset()
+        c.Assert(session.runBatch(commands, ""), Equals, true)
+        return strings.Split(strings.TrimSpace(out.String()), "\n")
+    }
+
+    // The classes with instances, biggest first, and how many a minimum size
+    // shows: one row for each, one for the hidden ones if any, and the total.
+
+    counts := classCounts{}
+    for _, slot := range getHeap(c).ClassHisto().counts {
+        if slot != nil {
+            counts = append(counts, slot)
+        }
+    }
+    sort.Sort(counts)
+    all := len(counts)
+    c.Assert(all > 6, Equals, true)
+    shown := func(minSize uint64) int {
+        rows := 0
+        for _, slot := range counts {
+            if slot.nbytes >= minSize {
+                rows++
+            }
+        }
+        if rows < all {
+            rows++
+        }
+        return rows + 1
+    }
+
+    result := lines("histo")
+    c.Check(len(result), Equals, shown(1 << 20))
+    if shown(1 << 20) < all + 1 {
+        c.Check(strings.Contains(result[len(result) - 2], "smaller than mingroupsize not shown"), Equals, true)
+    }
+
+    result = lines("set mingroupsize 0", "histo")
+    c.Check(len(result), Equals, all + 1)
+    c.Check(strings.HasSuffix(result[0], " " + string(counts[0].name)), Equals, true)
+
+    minSize := counts[3].nbytes
+    result = lines(fmt.Sprintf("set mingroupsize %d", minSize), "histo")
+    c.Check(len(result), Equals, shown(minSize))
+    c.Check(strings.HasSuffix(result[0], " " + string(counts[0].name)), Equals, true)
+
+    sort.Sort(namedCounts{counts})
+    result = lines("set mingroupsize 0", "set sort name", "histo")
+    c.Check(len(result), Equals, all + 1)
+    c.Check(strings.HasSuffix(result[0], " " + string(counts[0].name)), Equals, true)
+    c.Check(strings.HasSuffix(result[1], " " + string(counts[1].name)), Equals, true)
+
+    result = lines("set maxrows 5", "histo")
+    c.Check(len(result), Equals, 7)
+    c.Check(strings.Contains(result[5], fmt.Sprintf("%d more not shown", all - 5)), Equals, true)
+    c.Check(strings.HasSuffix(result[6], " total"), Equals, true)
+}
+
+// Run a search that ends in histo() and return the count it found for a class.
+//
+func searchCount(c *C, heap *Heap, query string, className string) uint32 {
+    count, _ := searchHisto(c, heap, query).Counts(heap.ClassNamed(className))
+    return count
+}
+
+// Run a search that ends in histo() and return the histo.
+//
+func searchHisto(c *C, heap *Heap, query string) *Histo {
+    _, _, result := NewParsers().Command.Parse(query)
+    action, ok := result.(SearchAction)
+    c.Assert(ok, Equals, true, Commentf("%s: %v", query, result))
+    histo := heap.NewHisto()
+    SearchHeap(heap, action.Query, histo)
+    return histo
 }
 
 func getHeap(c *C) *Heap {
     if testHeap != nil {
         return testHeap
     }
-    heapFile := "./genheap.hprof"
-    if _, err := os.Stat(heapFile); os.IsNotExist(err) {
-        c.Fatal("Can't find %s, make sure it's been generated\n", heapFile)
-    }
-    options := &Options{NeedRefs: true}
-    testHeap := ReadHeapDump(heapFile, options)
+    options := &Options{NeedRefs: true, NoIndex: true}
+    heap, err := ReadHeapDump(testHeapFile(c), options)
+    c.Assert(err, IsNil)
+    testHeap = heap
     return testHeap
 }
+
+// Return the name of the test heap dump, built by BuildGenHeap so the tests
+// see the same heap everywhere.
+//
+func testHeapFile(c *C) string {
+    if testHeapName != "" {
+        return testHeapName
+    }
+    dir, err := ioutil.TempDir("", "helmet")
+    c.Assert(err, IsNil)
+    filename := dir + "/genheap.hprof"
+    c.Assert(BuildGenHeap(10000).WriteFile(filename), IsNil)
+    testHeapName = filename
+    return testHeapName
+}
+
+// Remove the test heap dump.
+//
+func (s *SearchSuite) TearDownSuite(c *C) {
+    if testHeapName != "" {
+        os.RemoveAll(filepath.Dir(testHeapName))
+        testHeapName = ""
+    }
+}
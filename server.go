@@ -0,0 +1,303 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "sync"
+)
+
+// Serves one loaded heap over HTTP, so a big dump need only be loaded once for
+// everyone.  All endpoints are GET; reports come back in the format given by
+// the "format" parameter (json by default, see report.go), everything else as
+// JSON.
+//
+//   /histo?retained=true       class histogram, optionally with retained sizes
+//   /class?name=java.util.Map  class info
+//   /object?oid=123            object info, references & decoded fields
+//   /path?oid=123&all=true     path from a GC root
+//   /query?q=<command>         any session command except skip, e.g. a search
+//
+// Histograms and queries also take settings as parameters, e.g. mingroupsize=0,
+// with the defaults otherwise; see DefaultSettings.
+//
+// The reference graph, dominators and class defs don't change once the heap is
+// loaded, so requests run concurrently.  Those that decode object contents each
+// read through their own view of the heap, since a heap's mapped section can't
+// be shared (see seekObject.)
+//
+type Server struct {
+    heap *Heap
+    // class histogram, for instance counts
+    classHisto *Histo
+    // held shared by requests; anything changing the heap would hold it exclusively
+    lock sync.RWMutex
+    mux *http.ServeMux
+}
+
+// Create a server for a heap read with the reference graph.
+//
+func NewServer(heap *Heap) *Server {
+
+    // Compute everything that's otherwise built on first use.
+
+    heap.Dominators().tree()
+
+    server := &Server{heap: heap, classHisto: heap.ClassHisto(), mux: http.NewServeMux()}
+    server.mux.HandleFunc("/histo", server.histo)
+    server.mux.HandleFunc("/class", server.class)
+    server.mux.HandleFunc("/object", server.object)
+    server.mux.HandleFunc("/path", server.path)
+    server.mux.HandleFunc("/query", server.query)
+    return server
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+        return
+    }
+    server.mux.ServeHTTP(w, r)
+}
+
+func (server *Server) histo(w http.ResponseWriter, r *http.Request) {
+    session, err := server.newSession(w, r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    defer session.unmapView()
+    server.lock.RLock()
+    defer server.lock.RUnlock()
+    session.execute(HistoAction{})
+    if session.Err != nil {
+        http.Error(w, session.Err.Error(), http.StatusInternalServerError)
+    }
+}
+
+// Class info as returned by /class
+//
+type ClassInfo struct {
+    Name string
+    Cid ClassId
+    Oid ObjectId
+    Super string
+    Loader ObjectId
+    Instances uint32
+    Bytes uint64
+    Fields []FieldInfo
+    Subclasses []string
+}
+
+type FieldInfo struct {
+    Name string
+    Type string
+}
+
+func (server *Server) class(w http.ResponseWriter, r *http.Request) {
+    server.lock.RLock()
+    defer server.lock.RUnlock()
+    class := server.heap.ClassNamed(r.FormValue("name"))
+    if class == nil {
+        http.Error(w, fmt.Sprintf("No class named %s", r.FormValue("name")), http.StatusNotFound)
+        return
+    }
+    info := &ClassInfo{
+        Name: class.Name,
+        Cid: class.Cid,
+        Oid: class.Oid,
+        Loader: class.Loader,
+        Fields: []FieldInfo{},
+        Subclasses: []string{},
+    }
+    info.Instances, info.Bytes = server.classHisto.Counts(class)
+    if super := class.Super(); super != nil {
+        info.Super = super.Name
+    }
+    for _, field := range class.fields {
+        info.Fields = append(info.Fields, FieldInfo{field.Name, field.JType.Name()})
+    }
+    for _, subclass := range class.subclasses {
+        info.Subclasses = append(info.Subclasses, subclass.Name)
+    }
+    writeJSON(w, info)
+}
+
+// Object info as returned by /object; Show is the text from the show command
+//
+type ObjectInfo struct {
+    Oid ObjectId
+    Class string
+    Size uint32
+    Retained uint64
+    Dominator ObjectId
+    Refs []RefInfo
+    Show string
+}
+
+type RefInfo struct {
+    Name string
+    Oid ObjectId
+    Class string
+}
+
+func (server *Server) object(w http.ResponseWriter, r *http.Request) {
+    oid, ok := server.objectParam(w, r)
+    if ! ok {
+        return
+    }
+    server.lock.RLock()
+    defer server.lock.RUnlock()
+    heap := server.heap.view()
+    defer heap.unmapView()
+    info := &ObjectInfo{
+        Oid: oid,
+        Class: heap.ClassOf(oid).Name,
+        Size: heap.SizeOf(oid),
+        Retained: heap.RetainedSizeOf(oid),
+        Dominator: heap.Dominators().Dominator(oid),
+        Refs: []RefInfo{},
+    }
+    for dst, pos := heap.OutEdges(oid); pos != 0; dst, pos = heap.NextOutEdge(pos) {
+        info.Refs = append(info.Refs, RefInfo{heap.EdgeName(oid, heap.OutLabel(pos)), dst, heap.ClassOf(dst).Name})
+    }
+    var buf bytes.Buffer
+    if err := heap.ShowObject(&buf, oid); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    info.Show = buf.String()
+    writeJSON(w, info)
+}
+
+func (server *Server) path(w http.ResponseWriter, r *http.Request) {
+    oid, ok := server.objectParam(w, r)
+    if ! ok {
+        return
+    }
+    server.lock.RLock()
+    defer server.lock.RUnlock()
+    path := server.heap.PathFromRoot(oid, r.FormValue("all") != "true")
+    if path == nil {
+        http.Error(w, fmt.Sprintf("Object %d is not reachable from a GC root", oid), http.StatusNotFound)
+        return
+    }
+    server.report(w, r, func(out ReportWriter) {
+        server.heap.PrintPath(out, path)
+    })
+}
+
+// Run a session command in its own session, so "set" commands only apply to the
+// request.  Skip commands change the heap, so aren't allowed.
+//
+func (server *Server) query(w http.ResponseWriter, r *http.Request) {
+    action, err := parseCommand(r.FormValue("q"))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if _, isSkip := action.(SkipAction); isSkip {
+        http.Error(w, "Skip isn't allowed on a shared heap", http.StatusForbidden)
+        return
+    }
+    session, err := server.newSession(w, r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    defer session.unmapView()
+    server.lock.RLock()
+    defer server.lock.RUnlock()
+    session.execute(action)
+    if session.Err != nil {
+        http.Error(w, session.Err.Error(), http.StatusBadRequest)
+    }
+}
+
+// Create a session writing a report to the response, with the default settings
+// except those given as request parameters.  The format defaults to json.  The
+// session has its own view of the heap; call unmapView on it when done.
+//
+func (server *Server) newSession(w http.ResponseWriter, r *http.Request) (*Session, error) {
+    session := &Session{Heap: server.heap.view(), Settings: DefaultSettings(), Out: w}
+    for name, setting := range session.Settings {
+        if value := r.FormValue(name); value != "" && name != "format" {
+            if err := setting.Set(value); err != nil {
+                return nil, err
+            }
+        }
+    }
+    format := reportFormat(r)
+    session.Settings["format"].StringValue = format
+    w.Header().Set("Content-Type", reportContentTypes[format])
+    return session, nil
+}
+
+// Return the object named by the "oid" parameter, or write an error response
+// and return false.
+//
+func (server *Server) objectParam(w http.ResponseWriter, r *http.Request) (ObjectId, bool) {
+    oid, err := strconv.ParseUint(r.FormValue("oid"), 10, 32)
+    if err != nil || oid == 0 || ObjectId(oid) > server.heap.MaxObjectId {
+        http.Error(w, fmt.Sprintf("No object with id %s", r.FormValue("oid")), http.StatusNotFound)
+        return 0, false
+    }
+    return ObjectId(oid), true
+}
+
+// Set the content type for a report in the requested format and write it.
+//
+func (server *Server) report(w http.ResponseWriter, r *http.Request, write func(ReportWriter)) {
+    format := reportFormat(r)
+    w.Header().Set("Content-Type", reportContentTypes[format])
+    write(NewReportWriter(format, w))
+}
+
+// Content types by report format
+//
+var reportContentTypes = map[string]string {
+    "text": "text/plain; charset=utf-8",
+    "json": "application/x-ndjson",
+    "csv": "text/csv",
+}
+
+// Return the report format requested, defaulting to json.
+//
+func reportFormat(r *http.Request) string {
+    format := r.FormValue("format")
+    if reportFormats[format] == nil {
+        return "json"
+    }
+    return format
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(value); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
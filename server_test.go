@@ -0,0 +1,143 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    . "launchpad.net/gocheck"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "sync"
+)
+
+// Exercise the HTTP endpoints, including concurrently.
+//
+func (s *SearchSuite) TestServer(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+    server := httptest.NewServer(NewServer(heap))
+    defer server.Close()
+
+    get := func(path string, status int) string {
+        body, err := fetch(server.URL + path, status)
+        c.Assert(err, IsNil)
+        return body
+    }
+
+    // Histograms use the default settings unless given others as parameters.
+
+    histo := heap.ClassHisto()
+    var wanted bytes.Buffer
+    histo.SetOptions(1 << 20, "size")
+    histo.Print(NewJSONReport(&wanted))
+    body := get("/histo", http.StatusOK)
+    c.Check(body, Equals, wanted.String())
+    wanted.Reset()
+    histo.SetOptions(10 << 10, "count")
+    histo.Print(NewJSONReport(&wanted))
+    body = get("/histo?mingroupsize=10k&sort=count", http.StatusOK)
+    c.Check(body, Equals, wanted.String())
+    get("/histo?mingroupsize=lots", http.StatusBadRequest)
+    body = get("/histo?retained=true&format=text&mingroupsize=0", http.StatusOK)
+    c.Check(strings.Contains(body, "<bootstrap>"), Equals, true)
+
+    var class ClassInfo
+    body = get("/class?name=java.util.ArrayList", http.StatusOK)
+    c.Assert(json.Unmarshal([]byte(body), &class), IsNil)
+    count, nbytes := histo.Counts(heap.ClassNamed("java.util.ArrayList"))
+    c.Check(class.Instances, Equals, count)
+    c.Check(class.Bytes, Equals, nbytes)
+    c.Check(class.Super, Equals, "java.util.AbstractList")
+    get("/class?name=no.such.Class", http.StatusNotFound)
+
+    list := heap.ClassNamed("java.util.ArrayList")
+    oid := ObjectId(1)
+    for heap.ClassOf(oid) != list {
+        oid++
+    }
+    var object ObjectInfo
+    body = get(fmt.Sprintf("/object?oid=%d", oid), http.StatusOK)
+    c.Assert(json.Unmarshal([]byte(body), &object), IsNil)
+    c.Check(object.Class, Equals, "java.util.ArrayList")
+    c.Check(object.Refs[0].Name, Equals, "elementData")
+    c.Check(strings.Contains(object.Show, "size"), Equals, true)
+    get("/object?oid=0", http.StatusNotFound)
+
+    body = get(fmt.Sprintf("/path?oid=%d&format=text", oid), http.StatusOK)
+    c.Check(strings.Contains(body, "(GC root)"), Equals, true)
+
+    body = get("/query?q=" + url.QueryEscape("run histo(t, t) from com.myco.GenHeap$Thing t"), http.StatusOK)
+    count, nbytes = histo.Counts(heap.ClassNamed("com.myco.GenHeap$Thing"))
+    c.Check(count > 0, Equals, true)
+    c.Check(strings.HasSuffix(body, fmt.Sprintf(`{"report":"histo","count":%d,"bytes":%d,"class":"total","total":true}`,
+                                                count, nbytes) + "\n"), Equals, true)
+    get("/query?q=bogus", http.StatusBadRequest)
+    get("/query?q=" + url.QueryEscape("skip java.util.*"), http.StatusForbidden)
+
+    // Failures can't be asserted off the test goroutine, so collect them.
+
+    paths := []string{"/histo?retained=true", fmt.Sprintf("/object?oid=%d", oid),
+                      "/query?q=" + url.QueryEscape(`run histo(s, s) from String s where s =~ "main"`)}
+    errs := make(chan error, 8 * len(paths))
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for _, path := range paths {
+                _, err := fetch(server.URL + path, http.StatusOK)
+                errs <- err
+            }
+        }()
+    }
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        c.Check(err, IsNil)
+    }
+}
+
+// Fetch a URL and return the body, or an error if the request fails or doesn't
+// return the wanted status.
+//
+func fetch(address string, status int) (string, error) {
+    resp, err := http.Get(address)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return "", err
+    }
+    if resp.StatusCode != status {
+        return "", fmt.Errorf("%s: wanted status %d, got %d: %s", address, status, resp.StatusCode, body)
+    }
+    return string(body), nil
+}
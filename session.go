@@ -23,6 +23,8 @@
 package main
 
 import (
+    "bufio"
+    "bytes"
     "fmt"
     "code.google.com/p/go-gnureadline"
     "io"
@@ -36,13 +38,10 @@ import (
 type Session struct {
     *Heap
     Settings map[string]*Setting
-}
-
-// Session settings, may be changed with the "set" command.
-//
-type Setting struct {
-    StringValue string
-    IntValue int
+    // where command output goes; errors go to stderr
+    Out io.Writer
+    // error from the last command run, if it failed; see ErrorAction
+    Err error
 }
 
 // Start interactive console session.  Returns on console EOF or
@@ -65,34 +64,136 @@ func (session *Session) interact() {
     }
 }
 
-// Execute a console command.
+// Run commands given with -e, then the script given with -f, if any.  Returns
+// false at the first failure.
+//
+func (session *Session) runBatch(commands []string, scriptFile string) bool {
+    for _, command := range commands {
+        if ! session.run(command) {
+            return false
+        }
+    }
+    switch scriptFile {
+        case "":
+            return true
+        case "-":
+            return session.runScript(os.Stdin, "stdin")
+    }
+    f, err := os.Open(scriptFile)
+    if err != nil {
+        log.Print(err)
+        return false
+    }
+    defer f.Close()
+    return session.runScript(f, scriptFile)
+}
+
+// Run an action, setting Err if it fails: if it runs an ErrorAction, or panics
+// with a *ReadError from decoding objects in a damaged dump.
+//
+func (session *Session) execute(action Action) {
+    session.Err = nil
+    defer recoverReadError(&session.Err)
+    action.Run(session)
+}
+
+// Execute commands from a script, one per line, skipping blank lines and lines
+// starting with '#'.  Stops at the first command that fails; returns false if
+// one did, or the script couldn't be read.
+//
+func (session *Session) runScript(in io.Reader, name string) bool {
+    scanner := bufio.NewScanner(in)
+    for lineNum := 1; scanner.Scan(); lineNum++ {
+        line := strings.Trim(scanner.Text(), " \t")
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if ! session.run(line) {
+            fmt.Fprintf(os.Stderr, "%s:%d: command failed: %s\n", name, lineNum, line)
+            return false
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        fmt.Fprintf(os.Stderr, "Can't read %s: %s\n", name, err)
+        return false
+    }
+    return true
+}
+
+// Execute a console command.  Returns false if the command couldn't be parsed
+// or failed; see execute.
+//
+func (session *Session) run(command string) bool {
+    action, err := parseCommand(command)
+    if err == nil {
+        session.execute(action)
+        err = session.Err
+    }
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err.Error())
+        return false
+    }
+    return true
+}
+
+// Parse a console command.  Returns an error if the command couldn't be parsed
+// or produced an ErrorAction.
 //
-func (session *Session) run(command string) {
+func parseCommand(command string) (Action, error) {
     parsers := NewParsers()
     ok, _, result := parsers.Command.Parse(command)
-    if ok {
-        action := result.(Action)
-        action.Run(session)
-    } else {
+    if ! ok {
         // TODO better error messages
-        fmt.Printf("Syntax error in command\n")
+        return nil, fmt.Errorf("Syntax error in command")
+    }
+    if failed, isError := result.(ErrorAction); isError {
+        return nil, failed.Error
     }
+    return result.(Action), nil
 }
 
 // Execute a search (called from generated parser function.)
 //
 func (session *Session) runSearch(query *Query) {
-    histo := session.Heap.NewHisto()
-    SearchHeap(session.Heap, query, histo)
-    histo.Print(os.Stdout)
+    collector := searchFunctions[query.fnName].New(session.Heap, query.limit)
+    SearchHeap(session.Heap, query, collector)
+    if histo, isHisto := collector.(*Histo); isHisto {
+        session.printHisto(histo, session.report())
+    } else {
+        collector.Print(session.report())
+    }
+}
+
+// Return a writer for command output in the current report format, limited to
+// the maximum number of rows if set.
+//
+func (session *Session) report() ReportWriter {
+    out := NewReportWriter(session.Settings["format"].StringValue, session.Out)
+    if maxRows := session.Settings["maxrows"].IntValue; maxRows > 0 {
+        out = LimitRows(out, maxRows)
+    }
+    return out
 }
 
-// Create map of default session settings.
+// Print a histogram with the current minimum group size & sort order.
 //
-func DefaultSettings() map[string]*Setting {
-    settings := make(map[string]*Setting)
-    settings["mingroupsize"] = &Setting{"", 1 << 20}
-    return settings
+func (session *Session) printHisto(histo *Histo, out ReportWriter) {
+    histo.SetOptions(uint64(session.Settings["mingroupsize"].IntValue), session.Settings["sort"].StringValue)
+    histo.Print(out)
+}
+
+// Run the commands in a startup file, e.g. ~/.helmetrc, if it exists.
+//
+func (session *Session) loadRC(rcFile string) {
+    f, err := os.Open(rcFile)
+    if os.IsNotExist(err) {
+        return
+    } else if err != nil {
+        log.Print(err)
+        return
+    }
+    defer f.Close()
+    session.runScript(f, rcFile)
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -112,19 +213,155 @@ func (action SearchAction) Run(session *Session) {
     session.runSearch(action.Query)
 }
 
+type HistoAction struct {
+    Retained bool
+}
+
+func (action HistoAction) Run(session *Session) {
+    if action.Retained || session.Settings["retained"].BoolValue {
+        byClass, byLoader := session.Heap.RetainedHistos()
+        report := session.report()
+        session.printHisto(byClass, report)
+        session.printHisto(byLoader, report)
+    } else {
+        session.printHisto(session.Heap.ClassHisto(), session.report())
+    }
+}
+
+type PathAction struct {
+    Oid ObjectId
+    All bool
+}
+
+func (action PathAction) Run(session *Session) {
+    heap := session.Heap
+    if action.Oid == 0 || action.Oid > heap.MaxObjectId {
+        ErrorAction{fmt.Errorf("No object with id %d", action.Oid)}.Run(session)
+        return
+    }
+    path := heap.PathFromRoot(action.Oid, !action.All)
+    if path == nil {
+        report := session.report()
+        report.Begin("path", Column{"text", "%v"})
+        report.Note("Object %d is not reachable from a GC root", action.Oid)
+        return
+    }
+    heap.PrintPath(session.report(), path)
+}
+
+type SkipAction struct {
+    Name string
+}
+
+func (action SkipAction) Run(session *Session) {
+    session.Heap.AddSkip(action.Name)
+    session.Heap.ProcessSkips()
+}
+
+type RootsAction struct {
+    Kind string
+    ByKind bool
+}
+
+func (action RootsAction) Run(session *Session) {
+    heap := session.Heap
+    if action.ByKind {
+        heap.PrintRootsByKind(session.report())
+    } else {
+        kind, _ := RootKindNamed(action.Kind)
+        heap.PrintRoots(session.report(), heap.RootsOfKind(kind, action.Kind == ""))
+    }
+}
+
+type DanglingAction struct {
+    ByClass bool
+}
+
+func (action DanglingAction) Run(session *Session) {
+    if action.ByClass {
+        session.Heap.PrintDanglingByClass(session.report())
+    } else {
+        session.Heap.PrintDangling(session.report())
+    }
+}
+
+type ShowAction struct {
+    Oid ObjectId
+}
+
+func (action ShowAction) Run(session *Session) {
+    heap := session.Heap
+    if action.Oid == 0 || action.Oid > heap.MaxObjectId {
+        ErrorAction{fmt.Errorf("No object with id %d", action.Oid)}.Run(session)
+        return
+    }
+    var text bytes.Buffer
+    if err := heap.ShowObject(&text, action.Oid); err != nil {
+        ErrorAction{err}.Run(session)
+        return
+    }
+
+    // The object is shown as notes, one per line, so it isn't cut off by
+    // maxrows and other formats are still JSON or CSV.
+
+    report := session.report()
+    report.Begin("show", Column{"text", "%v"})
+    for _, line := range strings.Split(strings.TrimSuffix(text.String(), "\n"), "\n") {
+        report.Note("%s", line)
+    }
+}
+
+type DupsAction struct {
+    Limit int
+}
+
+func (action DupsAction) Run(session *Session) {
+    heap := session.Heap
+    groups, err := heap.FindDuplicates()
+    if err != nil {
+        ErrorAction{err}.Run(session)
+        return
+    }
+    heap.PrintDuplicates(session.report(), groups, action.Limit)
+}
+
+type CollectionsAction struct {}
+
+func (action CollectionsAction) Run(session *Session) {
+    heap := session.Heap
+    heap.PrintCollections(session.report(), heap.AnalyzeCollections())
+}
+
+type ThreadsAction struct {}
+
+func (action ThreadsAction) Run(session *Session) {
+    session.Heap.PrintThreads(session.report())
+}
+
 type SettingsAction struct {
     Name string
-    Value int
+    Value string
 }
 
 func (action SettingsAction) Run(session *Session) {
-    session.Settings[action.Name].IntValue = action.Value
+    if err := session.Settings[action.Name].Set(action.Value); err != nil {
+        ErrorAction{err}.Run(session)
+    }
 }
 
+type ShowSettingsAction struct {}
+
+func (action ShowSettingsAction) Run(session *Session) {
+    PrintSettings(session.report(), session.Settings)
+}
+
+// A failed command.  The parser returns these for bad commands, and actions run
+// them for errors they find against the heap, so the command fails; see run.
+//
 type ErrorAction struct {
     Error error
 }
 
 func (action ErrorAction) Run(session *Session) {
-    fmt.Println(action.Error.Error())
+    session.Err = action.Error
 }
@@ -0,0 +1,67 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    . "launchpad.net/gocheck"
+    "strings"
+)
+
+// Run a script in batch mode, checking output goes to the session writer and
+// that the first failing command stops it.
+//
+func (s *SearchSuite) TestBatch(c *C) {
+
+    LogTestOutput()
+    var out bytes.Buffer
+    session := &Session{Heap: getHeap(c), Settings: DefaultSettings(), Out: &out}
+
+    ok := session.runScript(strings.NewReader("# a comment\n\nthreads\n  roots bykind\n"), "test")
+    c.Check(ok, Equals, true)
+    c.Check(strings.Contains(out.String(), `thread 1 "main"`), Equals, true)
+    c.Check(strings.HasSuffix(out.String(), " total\n"), Equals, true)
+
+    out.Reset()
+    ok = session.runScript(strings.NewReader("roots bogus\nthreads\n"), "test")
+    c.Check(ok, Equals, false)
+    c.Check(out.String(), Equals, "")
+
+    ok = session.runBatch([]string{"threads", "no such command"}, "")
+    c.Check(ok, Equals, false)
+    c.Check(strings.Contains(out.String(), `thread 1 "main"`), Equals, true)
+
+    ok = session.runBatch(nil, c.MkDir() + "/missing.hlm")
+    c.Check(ok, Equals, false)
+
+    // Commands that fail against the heap fail the batch too.
+
+    missing := fmt.Sprint(getHeap(c).MaxObjectId + 1)
+    c.Check(session.runBatch([]string{"show " + fmt.Sprint(getHeap(c).roots[0])}, ""), Equals, true)
+    for _, command := range []string{"show 0", "show " + missing, "path " + missing, "set maxrows lots"} {
+        out.Reset()
+        c.Check(session.runBatch([]string{command, "threads"}, ""), Equals, false, Commentf(command))
+        c.Check(out.String(), Equals, "", Commentf(command))
+    }
+}
@@ -0,0 +1,189 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// What kind of value a setting holds
+//
+type SettingKind int
+
+const (
+    // a byte count, e.g. 100k, 5m, 1g
+    SizeSetting SettingKind = iota
+    // a count of things other than bytes, e.g. rows
+    IntSetting
+    // true or false, also on or off
+    BoolSetting
+    // text, restricted to Setting.Choices if given
+    StringSetting
+)
+
+// Session settings, may be changed with the "set" command, e.g. in ~/.helmetrc.
+// Size & int values are in IntValue, bool and string values in BoolValue and
+// StringValue.
+//
+type Setting struct {
+    Kind SettingKind
+    // allowed values of a string setting, or nil for any
+    Choices []string
+    // description for "show settings"
+    Help string
+    StringValue string
+    IntValue int
+    BoolValue bool
+}
+
+// Create map of default session settings.
+//
+func DefaultSettings() map[string]*Setting {
+    settings := make(map[string]*Setting)
+    settings["mingroupsize"] = &Setting{Kind: SizeSetting, IntValue: 1 << 20,
+        Help: "omit histogram rows smaller than this"}
+    settings["maxrows"] = &Setting{Kind: IntSetting, IntValue: 0,
+        Help: "limit reports to this many rows; 0 for no limit"}
+    settings["sort"] = &Setting{Kind: StringSetting, StringValue: "size", Choices: []string{"size", "bytes", "count", "name"},
+        Help: "histogram order; size is retained size if known, else bytes"}
+    settings["format"] = &Setting{Kind: StringSetting, StringValue: "text", Choices: []string{"text", "json", "csv"},
+        Help: "report output format"}
+    settings["retained"] = &Setting{Kind: BoolSetting, BoolValue: false,
+        Help: "always show retained sizes in histo"}
+    return settings
+}
+
+// Check that a setting exists and would accept a value, without changing it.
+// Called on a default setting from the parser.
+//
+func (setting *Setting) check(name string, text string) error {
+    if setting == nil {
+        return fmt.Errorf("Unknown setting %s", name)
+    }
+    scratch := *setting
+    return scratch.Set(text)
+}
+
+// Change a setting given the text of a value, checking it's the right kind.
+//
+func (setting *Setting) Set(text string) error {
+    switch setting.Kind {
+        case SizeSetting:
+            value, err := parseSize(text)
+            if err != nil {
+                return err
+            }
+            setting.IntValue = value
+        case IntSetting:
+            value, err := strconv.ParseUint(text, 10, 31)
+            if err != nil {
+                return fmt.Errorf("Bad value %s, must be a number", text)
+            }
+            setting.IntValue = int(value)
+        case BoolSetting:
+            switch strings.ToLower(text) {
+                case "true", "on":
+                    setting.BoolValue = true
+                case "false", "off":
+                    setting.BoolValue = false
+                default:
+                    return fmt.Errorf("Bad value %s, must be true or false", text)
+            }
+        case StringSetting:
+            if setting.Choices != nil {
+                found := false
+                for _, choice := range setting.Choices {
+                    found = found || choice == text
+                }
+                if ! found {
+                    return fmt.Errorf("Bad value %s, must be one of %s", text, strings.Join(setting.Choices, ", "))
+                }
+            }
+            setting.StringValue = text
+    }
+    return nil
+}
+
+// Return a setting's value as it would be given to Set.
+//
+func (setting *Setting) String() string {
+    switch setting.Kind {
+        case SizeSetting:
+            return formatSize(setting.IntValue)
+        case IntSetting:
+            return strconv.Itoa(setting.IntValue)
+        case BoolSetting:
+            return strconv.FormatBool(setting.BoolValue)
+    }
+    return setting.StringValue
+}
+
+// Parse a byte count with an optional k, m or g suffix.
+//
+func parseSize(text string) (int, error) {
+    multiplier := 1
+    digits := strings.ToLower(text)
+    if n := len(digits); n > 0 {
+        switch digits[n-1] {
+            case 'k': multiplier = 1 << 10
+            case 'm': multiplier = 1 << 20
+            case 'g': multiplier = 1 << 30
+        }
+        if multiplier > 1 {
+            digits = digits[:n-1]
+        }
+    }
+    value, err := strconv.ParseUint(digits, 10, 31)
+    if err != nil {
+        return 0, fmt.Errorf("Bad size %s, must be a number optionally followed by k, m or g", text)
+    }
+    return int(value) * multiplier, nil
+}
+
+// Format a byte count, using a k, m or g suffix if it's an exact multiple.
+//
+func formatSize(value int) string {
+    for _, unit := range []struct{suffix string; size int} {{"g", 1 << 30}, {"m", 1 << 20}, {"k", 1 << 10}} {
+        if value != 0 && value % unit.size == 0 {
+            return strconv.Itoa(value / unit.size) + unit.suffix
+        }
+    }
+    return strconv.Itoa(value)
+}
+
+// Print settings with their values & descriptions, by name.
+//
+func PrintSettings(out ReportWriter, settings map[string]*Setting) {
+    names := make([]string, 0, len(settings))
+    for name := range settings {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    out.Begin("settings", Column{"name", "%-14v"}, Column{"value", "%-8v"}, Column{"help", "%v"})
+    for _, name := range names {
+        out.Row(name, settings[name].String(), settings[name].Help)
+    }
+}
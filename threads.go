@@ -0,0 +1,260 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "sort"
+)
+
+// One of these per STACK_FRAME record in the heap dump.
+//
+type StackFrame struct {
+    // native id of the frame, referenced by STACK_TRACE records
+    Hid HeapId
+    // method name & signature, e.g. "gen" and "()V"
+    Method string
+    Signature string
+    // source file name, or "" if unknown
+    SourceFile string
+    // serial number of the declaring class from LOAD_CLASS
+    classSerial uint32
+    // name of the declaring class, resolved during PostProcess
+    ClassName string
+    // line number if > 0; else -1 for unknown, -2 for compiled, -3 for native
+    Line int32
+}
+
+// Describe a frame the way Java stack traces do, e.g.
+// com.myco.GenHeap.gen(GenHeap.java:55)
+//
+func (frame *StackFrame) String() string {
+    var where string
+    switch {
+        case frame.Line == -3:
+            where = "Native Method"
+        case frame.SourceFile == "":
+            where = "Unknown Source"
+        case frame.Line > 0:
+            where = fmt.Sprintf("%s:%d", frame.SourceFile, frame.Line)
+        default:
+            where = frame.SourceFile
+    }
+    return fmt.Sprintf("%s.%s(%s)", frame.ClassName, frame.Method, where)
+}
+
+// One of these per STACK_TRACE record in the heap dump.
+//
+type StackTrace struct {
+    Serial uint32
+    ThreadSerial uint32
+    // frames, innermost first, resolved during PostProcess
+    Frames []*StackFrame
+    // native ids of same, from the dump
+    frameHids []HeapId
+}
+
+// A thread, from a START_THREAD record or a ROOT_THREAD_OBJECT root; heap
+// dumps written by jmap usually have only the latter.
+//
+type Thread struct {
+    Serial uint32
+    // native id of the java.lang.Thread object
+    Hid HeapId
+    // object id of same, resolved during PostProcess; 0 if not in the heap
+    Oid ObjectId
+    // thread name from START_THREAD or the Thread object, if known, else ""
+    Name string
+    // stack trace at the time of the dump, or nil if none
+    Trace *StackTrace
+    // stack trace serial number, resolved to Trace during PostProcess
+    traceSerial uint32
+    // GC roots held by each frame in Trace, indexed by frame depth
+    Locals [][]*GCRoot
+    // GC roots held by the thread but not by any known frame
+    Other []*GCRoot
+}
+
+// Note a LOAD_CLASS serial number, for resolving stack frame classes.
+//
+func (heap *Heap) AddClassSerial(serial uint32, classHid HeapId) {
+    heap.classSerials[serial] = classHid
+}
+
+// Note a STACK_FRAME record.
+//
+func (heap *Heap) AddStackFrame(frame *StackFrame) {
+    heap.stackFrames[frame.Hid] = frame
+}
+
+// Note a STACK_TRACE record.
+//
+func (heap *Heap) AddStackTrace(trace *StackTrace) {
+    heap.stackTraces[trace.Serial] = trace
+}
+
+// Note a START_THREAD record.
+//
+func (heap *Heap) AddThread(thread *Thread) {
+    heap.threads = append(heap.threads, thread)
+}
+
+// Tie stack frames to their classes, stack traces to their frames, and threads
+// to their traces and GC roots.  Called from PostProcess after GC roots are
+// resolved.
+//
+func (heap *Heap) resolveThreads() {
+
+    for _, frame := range heap.stackFrames {
+        frame.ClassName = "?"
+        if class := heap.classesByHid[heap.classSerials[frame.classSerial]]; class != nil {
+            frame.ClassName = class.Name
+        }
+    }
+
+    for _, trace := range heap.stackTraces {
+        trace.Frames = make([]*StackFrame, len(trace.frameHids))
+        for i, hid := range trace.frameHids {
+            trace.Frames[i] = heap.stackFrames[hid]
+            if trace.Frames[i] == nil {
+                trace.Frames[i] = &StackFrame{Hid: hid, Method: "?", ClassName: "?", Line: -1}
+            }
+        }
+        trace.frameHids = nil
+    }
+
+    // Threads not announced by START_THREAD are known from their roots.
+
+    bySerial := make(map[uint32]*Thread, len(heap.threads))
+    for _, thread := range heap.threads {
+        bySerial[thread.Serial] = thread
+    }
+    for _, root := range heap.gcRoots {
+        if root.Kind == RootThreadObject && bySerial[root.ThreadSerial] == nil {
+            thread := &Thread{Serial: root.ThreadSerial, Hid: root.Hid, traceSerial: root.StackSerial}
+            heap.threads = append(heap.threads, thread)
+            bySerial[thread.Serial] = thread
+        }
+    }
+
+    for _, thread := range heap.threads {
+        thread.Oid = heap.objectMap.Get(thread.Hid)
+        thread.Trace = heap.stackTraces[thread.traceSerial]
+        if thread.Trace != nil {
+            thread.Locals = make([][]*GCRoot, len(thread.Trace.Frames))
+        }
+    }
+
+    for _, root := range heap.gcRoots {
+        switch root.Kind {
+            case RootJNILocal, RootJavaFrame, RootNativeStack, RootThreadBlock:
+                thread := bySerial[root.ThreadSerial]
+                if thread == nil {
+                    continue
+                }
+                depth := int(root.FrameDepth)
+                if (root.Kind == RootJNILocal || root.Kind == RootJavaFrame) && 
+                        depth >= 0 && depth < len(thread.Locals) {
+                    thread.Locals[depth] = append(thread.Locals[depth], root)
+                } else {
+                    thread.Other = append(thread.Other, root)
+                }
+        }
+    }
+
+    sort.Sort(threadsBySerial(heap.threads))
+}
+
+// Name the threads that had no START_THREAD record, as in dumps from jmap, from
+// the name fields of their java.lang.Thread objects.  That's a String, or a char
+// array before JDK 9.  Requires the reference graph and the dump file, so this
+// is done after PostProcess.
+//
+func (heap *Heap) nameThreads() {
+    if heap.Graph == nil {
+        return
+    }
+    for _, thread := range heap.threads {
+        if thread.Name != "" || thread.Oid == 0 {
+            continue
+        }
+        name := heap.refField(thread.Oid, heap.ClassOf(thread.Oid), "name")
+        if name == 0 {
+            continue
+        }
+        if text, ok := heap.StringValue(name); ok {
+            thread.Name = text
+        } else if jtype, data := heap.primitiveArray(heap.seekObject(name), name); jtype != nil && jtype.ArrayClass == "[C" {
+            thread.Name = decodeUTF16(data, binary.BigEndian)
+        }
+    }
+}
+
+// Return all threads, ordered by serial number.
+//
+func (heap *Heap) Threads() []*Thread {
+    return heap.threads
+}
+
+// Print each thread with its stack trace, and under each frame the objects that
+// frame holds as GC roots, with their retained sizes.
+//
+func (heap *Heap) PrintThreads(out ReportWriter) {
+    dominators := heap.Dominators()
+    printRoots := func(roots []*GCRoot) {
+        for _, root := range roots {
+            if root.Oid != 0 {
+                out.Note("%10d %10d     %s (%s)", root.Oid, 
+                         dominators.RetainedSize(root.Oid), heap.ClassOf(root.Oid).Name, root.Kind)
+            }
+        }
+    }
+    out.Begin("threads", Column{"oid", "%10v"}, Column{"retained", "%10v"}, Column{"serial", "thread %v"},
+              Column{"name", "\"%v\""})
+    for _, thread := range heap.threads {
+        name := thread.Name
+        if name == "" {
+            name = "?"
+        }
+        if thread.Oid == 0 {
+            out.Row(nil, nil, thread.Serial, name)
+        } else {
+            out.Row(thread.Oid, dominators.RetainedSize(thread.Oid), thread.Serial, name)
+        }
+        if thread.Trace != nil {
+            for i, frame := range thread.Trace.Frames {
+                out.Note("%21s   at %s", "", frame)
+                printRoots(thread.Locals[i])
+            }
+        }
+        printRoots(thread.Other)
+    }
+}
+
+// Sort threads by serial number
+//
+type threadsBySerial []*Thread
+func (t threadsBySerial) Len() int { return len(t) }
+func (t threadsBySerial) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t threadsBySerial) Less(i, j int) bool { return t[i].Serial < t[j].Serial }
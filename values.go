@@ -0,0 +1,360 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "encoding/binary"
+    "math"
+    "regexp"
+    "unicode/utf16"
+)
+
+// Decode the text of a java.lang.String instance.  Returns false if the object
+// isn't a string, its value array can't be found or it can't be read, as in a
+// damaged dump; this requires the reference graph.
+//
+func (heap *Heap) StringValue(oid ObjectId) (text string, ok bool) {
+    var err error
+    defer recoverReadError(&err)
+    return heap.stringValue(heap.seekObject(oid), oid)
+}
+
+// Same as StringValue, reading through a given section so callers on other
+// goroutines can use their own.
+//
+func (heap *Heap) stringValue(in *MappedSection, oid ObjectId) (string, bool) {
+
+    class := heap.ClassOf(oid)
+    if class.Name != "java.lang.String" || heap.Graph == nil {
+        return "", false
+    }
+    value := heap.refField(oid, class, "value")
+    if value == 0 {
+        return "", false
+    }
+
+    // JDK 9+ strings have a coder, 0 for Latin-1 and 1 for UTF-16.  JDK 6 strings
+    // may share a char[] with others, so have an offset & count into it.
+
+    coder, _ := heap.intField(in, oid, class, "coder")
+    offset, hasOffset := heap.intField(in, oid, class, "offset")
+    count, _ := heap.intField(in, oid, class, "count")
+
+    // Read the array last, since its contents are only valid until the next seek.
+
+    jtype, data := heap.primitiveArray(in, value)
+    if jtype == nil {
+        return "", false
+    }
+
+    switch jtype.ArrayClass {
+        case "[C":
+            if hasOffset {
+                start, end := 2 * offset, 2 * (offset + count)
+                if start < 0 || end > int64(len(data)) || start > end {
+                    return "", false
+                }
+                data = data[start:end]
+            }
+            return decodeUTF16(data, binary.BigEndian), true
+        case "[B":
+            if coder == 0 {
+                return decodeLatin1(data), true
+            }
+            // Compact strings store UTF-16 in the JVM's native byte order; assume
+            // the dump came from a little-endian platform.
+            return decodeUTF16(data, binary.LittleEndian), true
+    }
+    return "", false
+}
+
+// Return the type and raw contents of a primitive array, or nil if the object
+// isn't one.  The contents are only valid until the next read from the section.
+//
+func (heap *Heap) primitiveArray(in *MappedSection, oid ObjectId) (*JType, []byte) {
+
+    // header is
+    //
+    // tag              byte        (0x23)
+    // instance id      HeapId
+    // stack serial     uint32      (ignored)
+    // # elements       uint32
+    // element type     byte
+
+    in.Seek(heap.objectOffsets[oid])
+    in.Demand(heap.IdSize + 10)
+    if in.GetByte() != 0x23 {
+        return nil, nil
+    }
+    in.Skip(heap.IdSize + 4)
+    count := in.GetUInt32()
+    jtype := heap.getJType(in)
+    in.Demand(count * jtype.Size)
+    return jtype, in.GetRaw(count * jtype.Size)
+}
+
+// Return the number of elements in an array, or false if the object isn't one.
+//
+func (heap *Heap) arrayLength(in *MappedSection, oid ObjectId) (uint32, bool) {
+
+    // header is
+    //
+    // tag              byte        (0x22 or 0x23)
+    // instance id      HeapId
+    // stack serial     uint32      (ignored)
+    // # elements       uint32
+
+    if oid == 0 {
+        return 0, false
+    }
+    in.Seek(heap.objectOffsets[oid])
+    in.Demand(heap.IdSize + 9)
+    if tag := in.GetByte(); tag != 0x22 && tag != 0x23 {
+        return 0, false
+    }
+    in.Skip(heap.IdSize + 4)
+    return in.GetUInt32(), true
+}
+
+// Return the object a reference field of an instance points to, or 0 if it's null,
+// not in the heap, or the class has no such field.  Requires the reference graph.
+//
+func (heap *Heap) refField(oid ObjectId, class *ClassDef, name string) ObjectId {
+    dst, _ := heap.findRefField(oid, class, name)
+    return dst
+}
+
+// Same as refField, but also return false if the class has no such field, as
+// opposed to the field being null.
+//
+func (heap *Heap) findRefField(oid ObjectId, class *ClassDef, name string) (ObjectId, bool) {
+    for i, field := range class.RefFields() {
+        if field.Name == name {
+            for dst, pos := heap.OutEdges(oid); pos != 0; dst, pos = heap.NextOutEdge(pos) {
+                if heap.OutLabel(pos) == uint32(i) {
+                    return dst, true
+                }
+            }
+            return 0, true
+        }
+    }
+    return 0, false
+}
+
+// Return the value of an integral primitive field of an instance, or false if the
+// class has no such field.  If a superclass declares a field of the same name,
+// the subclass field wins.
+//
+func (heap *Heap) intField(in *MappedSection, oid ObjectId, class *ClassDef, name string) (int64, bool) {
+
+    fields, offsets := class.Layout()
+    for i, field := range fields {
+        if field.Name != name || field.JType.IsObj {
+            continue
+        }
+        // skip tag, instance id, stack serial, class id, length
+        in.Seek(heap.objectOffsets[oid] + uint64(9 + 2 * heap.IdSize + offsets[i]))
+        in.Demand(8)
+        switch field.JType.ArrayClass {
+            case "[Z", "[B":
+                return int64(int8(in.GetByte())), true
+            case "[C":
+                return int64(in.GetUInt16()), true
+            case "[S":
+                return int64(int16(in.GetUInt16())), true
+            case "[I":
+                return int64(in.GetInt32()), true
+            case "[J":
+                return int64(in.GetUInt64()), true
+        }
+        return 0, false
+    }
+    return 0, false
+}
+
+// Same as intField, but for any primitive field including floating point ones.
+//
+func (heap *Heap) numberField(in *MappedSection, oid ObjectId, class *ClassDef, name string) (float64, bool) {
+
+    fields, offsets := class.Layout()
+    for i, field := range fields {
+        if field.Name != name || field.JType.IsObj {
+            continue
+        }
+        switch field.JType.ArrayClass {
+            case "[F", "[D":
+                in.Seek(heap.objectOffsets[oid] + uint64(9 + 2 * heap.IdSize + offsets[i]))
+                in.Demand(8)
+                if field.JType.Size == 4 {
+                    return float64(math.Float32frombits(uint32(in.GetInt32()))), true
+                }
+                return math.Float64frombits(in.GetUInt64()), true
+        }
+        value, ok := heap.intField(in, oid, class, name)
+        return float64(value), ok
+    }
+    return 0, false
+}
+
+// Position the heap's own section at an object's record.  Not safe for use by
+// more than one goroutine.
+//
+func (heap *Heap) seekObject(oid ObjectId) *MappedSection {
+    offset := heap.objectOffsets[oid]
+    if heap.section == nil {
+        heap.section = heap.file.MapAt(offset)
+    } else {
+        heap.section.Seek(offset)
+    }
+    return heap.section
+}
+
+// Return a copy of the heap that shares everything but the section used by
+// seekObject, so it can read object contents alongside the original, e.g. in
+// another server request.  Call unmapView when done with it.
+//
+func (heap *Heap) view() *Heap {
+    view := *heap
+    view.section = nil
+    return &view
+}
+
+func (heap *Heap) unmapView() {
+    if heap.section != nil {
+        heap.section.unmap()
+        heap.section = nil
+    }
+}
+
+// Decode UTF-16 text in the given byte order.
+//
+func decodeUTF16(data []byte, order binary.ByteOrder) string {
+    units := make([]uint16, len(data) / 2)
+    for i := range units {
+        units[i] = order.Uint16(data[2*i:])
+    }
+    return string(utf16.Decode(units))
+}
+
+// Decode ISO-8859-1 text.
+//
+func decodeLatin1(data []byte) string {
+    runes := make([]rune, len(data))
+    for i, b := range data {
+        runes[i] = rune(b)
+    }
+    return string(runes)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// A condition on objects matching a query step, from a "where" clause.
+//
+type Predicate interface {
+    Matches(heap *Heap, oid ObjectId) bool
+}
+
+// Matches strings whose text matches a regular expression, e.g. s =~ "jdbc:.*"
+//
+type StringMatch struct {
+    Pattern *regexp.Regexp
+}
+
+func (pred *StringMatch) Matches(heap *Heap, oid ObjectId) bool {
+    text, ok := heap.StringValue(oid)
+    return ok && pred.Pattern.MatchString(text)
+}
+
+// Compares a field with a number or null, e.g. m.size > 1000 or t.value == null.
+// The field may be reached through reference fields, e.g. s.value.length, where
+// "length" is the number of elements in an array.  A null anywhere along the
+// way makes the value null.  Objects without the named fields don't match.
+//
+type FieldCompare struct {
+    // field names following the step variable
+    Path []string
+    // one of == != < <= > >=
+    Op string
+    // compare with null, else with Value
+    Null bool
+    Value float64
+}
+
+func (pred *FieldCompare) Matches(heap *Heap, oid ObjectId) bool {
+
+    last := len(pred.Path) - 1
+    for _, name := range pred.Path[:last] {
+        dst, ok := heap.findRefField(oid, heap.ClassOf(oid), name)
+        if ! ok {
+            return false
+        }
+        if dst == 0 {
+            return pred.compareNull(true)
+        }
+        oid = dst
+    }
+
+    name := pred.Path[last]
+    class := heap.ClassOf(oid)
+    if dst, ok := heap.findRefField(oid, class, name); ok {
+        return pred.compareNull(dst == 0)
+    }
+    in := heap.seekObject(oid)
+    if value, ok := heap.numberField(in, oid, class, name); ok {
+        return pred.compareNumber(value)
+    }
+    if length, ok := heap.arrayLength(in, oid); ok && name == "length" {
+        return pred.compareNumber(float64(length))
+    }
+    return false
+}
+
+// Compare a reference, or a null found along the path.  Only == and != are
+// meaningful, so references never match numbers.
+//
+func (pred *FieldCompare) compareNull(isNull bool) bool {
+    switch {
+        case ! pred.Null:
+            return false
+        case pred.Op == "==":
+            return isNull
+        case pred.Op == "!=":
+            return ! isNull
+    }
+    return false
+}
+
+func (pred *FieldCompare) compareNumber(value float64) bool {
+    if pred.Null {
+        return pred.Op == "!="
+    }
+    switch pred.Op {
+        case "==": return value == pred.Value
+        case "!=": return value != pred.Value
+        case "<": return value < pred.Value
+        case "<=": return value <= pred.Value
+        case ">": return value > pred.Value
+        case ">=": return value >= pred.Value
+    }
+    return false
+}
@@ -0,0 +1,294 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    "bytes"
+    "html/template"
+    "net/http"
+    "sort"
+)
+
+// Limit on instances listed on a class page
+//
+const MaxWebInstances = 100
+
+// Adds a browsable HTML UI to a server, a la jhat: a class list, class pages
+// with some instances, object pages with fields & references in both directions,
+// and a query box.  Pages are rendered on the server from the templates below,
+// with no scripts or external assets, so it works on air-gapped machines.
+//
+//   /ui                        classes by shallow size
+//   /ui/class?name=...         one class
+//   /ui/object?oid=...         one object
+//   /ui/query?q=...            results of a session command
+//
+func (server *Server) AddWebUI() {
+    server.mux.HandleFunc("/ui", server.classesPage)
+    server.mux.HandleFunc("/ui/class", server.classPage)
+    server.mux.HandleFunc("/ui/object", server.objectPage)
+    server.mux.HandleFunc("/ui/query", server.queryPage)
+    server.mux.HandleFunc("/", server.homePage)
+}
+
+// Redirect / to the class list.  Other unknown paths are errors, as without the
+// UI, not pages.
+//
+func (server *Server) homePage(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path != "/" {
+        http.NotFound(w, r)
+        return
+    }
+    http.Redirect(w, r, "/ui", http.StatusFound)
+}
+
+// One row in the class list
+//
+type webClass struct {
+    Name string
+    Count uint32
+    Bytes uint64
+}
+
+// One reference on an object page, in either direction
+//
+type webRef struct {
+    Name string
+    Oid ObjectId
+    Class string
+}
+
+func (server *Server) classesPage(w http.ResponseWriter, r *http.Request) {
+    server.lock.RLock()
+    defer server.lock.RUnlock()
+    classes := []webClass{}
+    var total webClass
+    for _, class := range server.heap.classes[1:] {
+        count, nbytes := server.classHisto.Counts(class)
+        if count > 0 {
+            classes = append(classes, webClass{class.Name, count, nbytes})
+            total.Count += count
+            total.Bytes += nbytes
+        }
+    }
+    sort.Sort(webClassesBySize(classes))
+    server.render(w, "classes", map[string]interface{} {
+        "Classes": classes,
+        "Total": total,
+    })
+}
+
+func (server *Server) classPage(w http.ResponseWriter, r *http.Request) {
+    server.lock.RLock()
+    defer server.lock.RUnlock()
+    heap := server.heap
+    class := heap.ClassNamed(r.FormValue("name"))
+    if class == nil {
+        http.Error(w, "No class named " + r.FormValue("name"), http.StatusNotFound)
+        return
+    }
+    count, nbytes := server.classHisto.Counts(class)
+    instances := []ObjectId{}
+    for oid := ObjectId(1); oid <= heap.MaxObjectId && len(instances) < MaxWebInstances; oid++ {
+        if heap.objectCids[oid] == class.Cid {
+            instances = append(instances, oid)
+        }
+    }
+    fields, _ := class.Layout()
+    server.render(w, "class", map[string]interface{} {
+        "Class": class,
+        "Super": class.Super(),
+        "Fields": fields,
+        "Subclasses": class.subclasses,
+        "Count": count,
+        "Bytes": nbytes,
+        "Instances": instances,
+        "More": count > uint32(len(instances)),
+    })
+}
+
+func (server *Server) objectPage(w http.ResponseWriter, r *http.Request) {
+    oid, ok := server.objectParam(w, r)
+    if ! ok {
+        return
+    }
+    server.lock.RLock()
+    defer server.lock.RUnlock()
+    heap := server.heap.view()
+    defer heap.unmapView()
+
+    out := []webRef{}
+    for dst, pos := heap.OutEdges(oid); pos != 0; dst, pos = heap.NextOutEdge(pos) {
+        out = append(out, webRef{heap.EdgeName(oid, heap.OutLabel(pos)), dst, heap.ClassOf(dst).Name})
+    }
+    in := []webRef{}
+    for src, pos := heap.InEdges(oid); pos != 0; src, pos = heap.NextInEdge(pos) {
+        in = append(in, webRef{heap.EdgeName(src, heap.InLabel(pos)), src, heap.ClassOf(src).Name})
+    }
+    var show bytes.Buffer
+    if err := heap.ShowObject(&show, oid); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    server.render(w, "object", map[string]interface{} {
+        "Oid": oid,
+        "Class": heap.ClassOf(oid).Name,
+        "Size": heap.SizeOf(oid),
+        "Retained": heap.RetainedSizeOf(oid),
+        "Dominator": heap.Dominators().Dominator(oid),
+        "Show": show.String(),
+        "Out": out,
+        "In": in,
+    })
+}
+
+// Run a session command as in /query, showing text output.
+//
+func (server *Server) queryPage(w http.ResponseWriter, r *http.Request) {
+    query := r.FormValue("q")
+    data := map[string]interface{} {"Query": query}
+    action, err := parseCommand(query)
+    if query == "" {
+        data["Error"] = "Enter a command, e.g. a search"
+    } else if _, isSkip := action.(SkipAction); isSkip {
+        data["Error"] = "Skip isn't allowed on a shared heap"
+    } else if err != nil {
+        data["Error"] = err.Error()
+    } else {
+        var out bytes.Buffer
+        session := &Session{Heap: server.heap.view(), Settings: DefaultSettings(), Out: &out}
+        server.lock.RLock()
+        session.execute(action)
+        server.lock.RUnlock()
+        session.unmapView()
+        data["Output"] = out.String()
+        if session.Err != nil {
+            data["Error"] = session.Err.Error()
+        }
+    }
+    server.render(w, "query", data)
+}
+
+// Render a page, or an error response if rendering fails.
+//
+func (server *Server) render(w http.ResponseWriter, name string, data interface{}) {
+    var page bytes.Buffer
+    if err := webTemplates.ExecuteTemplate(&page, name, data); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.Write(page.Bytes())
+}
+
+// Sort class list by shallow size, then name
+//
+type webClassesBySize []webClass
+func (c webClassesBySize) Len() int { return len(c) }
+func (c webClassesBySize) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+
+func (c webClassesBySize) Less(i, j int) bool {
+    if c[i].Bytes != c[j].Bytes {
+        return c[i].Bytes > c[j].Bytes
+    }
+    return c[i].Name < c[j].Name
+}
+
+var webTemplates = template.Must(template.New("web").Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>helmet - {{.}}</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 1em 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 2px 10px; text-align: left; }
+td.n { text-align: right; font-family: monospace; }
+tr:nth-child(even) { background: #f0f0f0; }
+pre { background: #f8f8f8; padding: 0.5em; }
+a { text-decoration: none; }
+</style></head><body>
+<p><a href="/ui">Classes</a></p>
+<form action="/ui/query"><input name="q" size="80" placeholder="run histo(x, x) from java.util.HashMap x"> <input type="submit" value="Run"></form>
+<h2>{{.}}</h2>
+{{end}}
+
+{{define "footer"}}</body></html>
+{{end}}
+
+{{define "classlink"}}<a href="/ui/class?name={{.}}">{{.}}</a>{{end}}
+{{define "objectlink"}}<a href="/ui/object?oid={{.}}">{{.}}</a>{{end}}
+
+{{define "classes"}}{{template "header" "Classes"}}
+<table>
+<tr><th>Count</th><th>Bytes</th><th>Class</th></tr>
+{{range .Classes}}<tr><td class="n">{{.Count}}</td><td class="n">{{.Bytes}}</td><td>{{template "classlink" .Name}}</td></tr>
+{{end}}<tr><td class="n">{{.Total.Count}}</td><td class="n">{{.Total.Bytes}}</td><td>total</td></tr>
+</table>
+{{template "footer"}}{{end}}
+
+{{define "class"}}{{template "header" .Class.Name}}
+<table>
+<tr><td>Superclass</td><td>{{with .Super}}{{template "classlink" .Name}}{{end}}</td></tr>
+<tr><td>Class object</td><td>{{if .Class.Oid}}{{template "objectlink" .Class.Oid}}{{end}}</td></tr>
+<tr><td>Loader</td><td>{{if .Class.Loader}}{{template "objectlink" .Class.Loader}}{{else}}&lt;bootstrap&gt;{{end}}</td></tr>
+<tr><td>Instances</td><td>{{.Count}}</td></tr>
+<tr><td>Bytes</td><td>{{.Bytes}}</td></tr>
+</table>
+<h3>Fields</h3>
+<table>
+{{range .Fields}}<tr><td>{{.JType.Name}}</td><td>{{.Name}}</td></tr>
+{{end}}</table>
+{{with .Subclasses}}<h3>Subclasses</h3>
+{{range .}}{{template "classlink" .Name}}<br>
+{{end}}{{end}}
+<h3>Instances</h3>
+{{range .Instances}}{{template "objectlink" .}}
+{{end}}{{if .More}}...{{end}}
+{{template "footer"}}{{end}}
+
+{{define "object"}}{{template "header" .Class}}
+<table>
+<tr><td>Object id</td><td>{{.Oid}}</td></tr>
+<tr><td>Class</td><td>{{template "classlink" .Class}}</td></tr>
+<tr><td>Size</td><td>{{.Size}}</td></tr>
+<tr><td>Retained</td><td>{{.Retained}}</td></tr>
+<tr><td>Dominator</td><td>{{if .Dominator}}{{template "objectlink" .Dominator}}{{else}}GC root or unreachable{{end}}</td></tr>
+</table>
+<h3>Fields</h3>
+<pre>{{.Show}}</pre>
+<h3>References</h3>
+<table>
+{{range .Out}}<tr><td>{{.Name}}</td><td>{{template "objectlink" .Oid}}</td><td>{{template "classlink" .Class}}</td></tr>
+{{end}}</table>
+<h3>Referrers</h3>
+<table>
+{{range .In}}<tr><td>{{template "objectlink" .Oid}}</td><td>{{template "classlink" .Class}}</td><td>via {{.Name}}</td></tr>
+{{end}}</table>
+{{template "footer"}}{{end}}
+
+{{define "query"}}{{template "header" "Query"}}
+<pre>{{.Query}}</pre>
+{{with .Error}}<p>{{.}}</p>{{end}}
+{{with .Output}}<pre>{{.}}</pre>{{end}}
+{{template "footer"}}{{end}}
+`))
@@ -0,0 +1,78 @@
+/*
+    Copyright (c) 2013 by Jonathan Ross (jonross@alum.mit.edu)
+
+    Permission is hereby granted, free of charge, to any person obtaining a copy
+    of this software and associated documentation files (the "Software"), to deal
+    in the Software without restriction, including without limitation the rights
+    to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+    copies of the Software, and to permit persons to whom the Software is
+    furnished to do so, subject to the following conditions:
+
+    The above copyright notice and this permission notice shall be included in
+    all copies or substantial portions of the Software.
+
+    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+    IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+    FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+    AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+    LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+    OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+    SOFTWARE.
+*/
+
+package main
+
+import (
+    . "launchpad.net/gocheck"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "regexp"
+    "strings"
+)
+
+// Click through the web UI from the class list to an object, checking that no
+// page refers to anything off the server.
+//
+func (s *SearchSuite) TestWebUI(c *C) {
+
+    LogTestOutput()
+    heap := getHeap(c)
+    server := NewServer(heap)
+    server.AddWebUI()
+    web := httptest.NewServer(server)
+    defer web.Close()
+
+    external := regexp.MustCompile(`https?://|(src|href|action)="//|url\(['"]?//|@import`)
+    get := func(path string) string {
+        body, err := fetch(web.URL + path, http.StatusOK)
+        c.Assert(err, IsNil)
+        c.Check(external.FindString(body), Equals, "", Commentf(path))
+        return body
+    }
+    link := regexp.MustCompile(`href="(/ui/object\?oid=\d+)"`)
+
+    body := get("/")
+    c.Check(strings.Contains(body, `<a href="/ui/class?name=com.myco.GenHeap%24Thing">com.myco.GenHeap$Thing</a>`),
+            Equals, true)
+
+    body = get("/ui/class?name=java.util.ArrayList")
+    c.Check(strings.Contains(body, "elementData"), Equals, true)
+    instance := link.FindStringSubmatch(body[strings.Index(body, "<h3>Instances</h3>"):])
+    c.Assert(instance, NotNil)
+
+    body = get(instance[1])
+    c.Check(strings.Contains(body, "<h3>References</h3>"), Equals, true)
+    c.Check(strings.Contains(body, "via value"), Equals, true)
+
+    body = get("/ui/query?q=" + url.QueryEscape("run histo(x, x) from com.myco.GenHeap$Thing x"))
+    c.Check(strings.Contains(body, "com.myco.GenHeap$Thing"), Equals, true)
+    c.Check(strings.Contains(body, " total"), Equals, true)
+    body = get("/ui/query?q=bogus")
+    c.Check(strings.Contains(body, "Syntax error"), Equals, true)
+
+    // Only / itself goes to the UI; mistyped API paths aren't found.
+
+    _, err := fetch(web.URL + "/histgram", http.StatusNotFound)
+    c.Check(err, IsNil)
+}